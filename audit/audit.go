@@ -0,0 +1,238 @@
+// Package audit implements an append-only log of the operations performed on presets. Entries
+// are appended to a file as JSON, one per line. When the file would exceed its maximum size, it
+// is rotated: audit.log becomes audit.log.1, audit.log.1 becomes audit.log.2 and so on, and the
+// oldest file is discarded once the maximum number of files has been reached.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ninjasphere/app-presets/model"
+)
+
+const fileName = "audit.log"
+
+// A Log is an append-only audit log stored in rotating files in a directory.
+type Log struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+// Open opens the audit log in the specified directory, creating the directory if necessary.
+// Each file is limited to maxSize bytes and at most maxFiles files, including the current
+// file, are retained.
+func Open(dir string, maxSize int64, maxFiles int) (*Log, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("illegal argument: maxSize must be positive: %d", maxSize)
+	}
+	if maxFiles < 1 {
+		return nil, fmt.Errorf("illegal argument: maxFiles must be at least 1: %d", maxFiles)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append appends the specified entry to the log, rotating the files first if necessary.
+func (l *Log) Append(e *model.AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("illegal state: the audit log is closed")
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Query answers the entries of the log that match the specified query, newest first. The files
+// are opened with the mutex held, but read without it, so that entries may be appended meanwhile.
+// Entries appended after the files are opened are not answered.
+func (l *Log) Query(q *model.AuditQuery) ([]*model.AuditEntry, error) {
+	files, err := l.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	result := make([]*model.AuditEntry, 0)
+	for _, f := range files {
+		entries, err := readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(entries) - 1; j >= 0; j-- {
+			if matches(entries[j], q) {
+				result = append(result, entries[j])
+				if q.Limit > 0 && len(result) == q.Limit {
+					return result, nil
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// answer the path of the file with the specified index, 0 being the current file
+func (l *Log) path(index int) string {
+	if index == 0 {
+		return filepath.Join(l.dir, fileName)
+	}
+	return filepath.Join(l.dir, fmt.Sprintf("%s.%d", fileName, index))
+}
+
+// a file of the log opened for reading, of which only the size it had when opened is read
+type openFile struct {
+	*os.File
+	size int64
+}
+
+// open the files of the log for reading, newest first. An open file may still be read once it
+// has been rotated, even if it has been discarded.
+func (l *Log) openFiles() ([]*openFile, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	result := make([]*openFile, 0, l.maxFiles)
+	for i := 0; i < l.maxFiles; i++ {
+		f, err := openPath(l.path(i))
+		if err != nil {
+			for _, opened := range result {
+				opened.Close()
+			}
+			return nil, err
+		}
+		if f != nil {
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
+
+// open the file with the specified path for reading, or answer nil if it does not exist
+func openPath(path string) (*openFile, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &openFile{File: f, size: info.Size()}, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// shift each file to the next index, discarding the oldest, then start a new current file
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	if err := os.Remove(l.path(l.maxFiles - 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := l.maxFiles - 2; i >= 0; i-- {
+		if err := os.Rename(l.path(i), l.path(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// answer the entries of the specified file, oldest first
+func readFile(f *openFile) ([]*model.AuditEntry, error) {
+	result := make([]*model.AuditEntry, 0)
+	scanner := bufio.NewScanner(io.LimitReader(f, f.size))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		e := &model.AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// skip lines that were only partially written
+			continue
+		}
+		result = append(result, e)
+	}
+	return result, scanner.Err()
+}
+
+func matches(e *model.AuditEntry, q *model.AuditQuery) bool {
+	if q.Since != nil && e.Time.Before(*q.Since) {
+		return false
+	}
+	if q.Until != nil && e.Time.After(*q.Until) {
+		return false
+	}
+	if q.Op != "" && e.Op != q.Op {
+		return false
+	}
+	if q.Scene != "" {
+		for _, id := range e.Scenes {
+			if id == q.Scene {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
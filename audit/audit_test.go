@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+)
+
+func openTemp(t *testing.T, maxSize int64, maxFiles int) (*Log, string) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	l, err := Open(dir, maxSize, maxFiles)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	return l, dir
+}
+
+func TestAppendAndQuery(t *testing.T) {
+	l, dir := openTemp(t, 1024*1024, 3)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	start := time.Now()
+	for i, op := range []string{model.AuditStore, model.AuditApply, model.AuditApply, model.AuditDelete} {
+		if err := l.Append(&model.AuditEntry{
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Op:      op,
+			Caller:  model.Caller{Transport: model.TransportRPC},
+			Scenes:  []string{fmt.Sprintf("scene-%d", i%2)},
+			Outcome: "ok",
+		}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+
+	if entries, err := l.Query(&model.AuditQuery{}); err != nil || len(entries) != 4 || entries[0].Op != model.AuditDelete {
+		t.Fatalf("unexpected entries: %v, %v", entries, err)
+	}
+	if entries, _ := l.Query(&model.AuditQuery{Op: model.AuditApply}); len(entries) != 2 {
+		t.Fatalf("expected 2 apply entries, found %d", len(entries))
+	}
+	if entries, _ := l.Query(&model.AuditQuery{Scene: "scene-1"}); len(entries) != 2 {
+		t.Fatalf("expected 2 entries for scene-1, found %d", len(entries))
+	}
+	since := start.Add(90 * time.Second)
+	if entries, _ := l.Query(&model.AuditQuery{Since: &since, Limit: 1}); len(entries) != 1 || entries[0].Op != model.AuditDelete {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	l, dir := openTemp(t, 200, 3)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := l.Append(&model.AuditEntry{Time: time.Now(), Op: model.AuditApply, Scenes: []string{fmt.Sprintf("scene-%d", i)}}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.2")); err != nil {
+		t.Fatalf("expected the log to have been rotated: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.3")); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 3 files")
+	}
+	entries, err := l.Query(&model.AuditQuery{})
+	if err != nil || len(entries) == 0 || len(entries) >= 20 || entries[0].Scenes[0] != "scene-19" {
+		t.Fatalf("unexpected entries after rotation: %d, %v", len(entries), err)
+	}
+}
+
+func TestQueryWhileRotating(t *testing.T) {
+	l, dir := openTemp(t, 1024, 2)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := l.Append(&model.AuditEntry{Time: time.Now(), Op: model.AuditApply, Scenes: []string{fmt.Sprintf("scene-%d", i)}}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+
+	// the opened files are read even once they have been rotated away, and later entries are not
+	files, err := l.openFiles()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected files: %v, %v", files, err)
+	}
+	defer files[0].Close()
+	for i := 3; i < 40; i++ {
+		if err := l.Append(&model.AuditEntry{Time: time.Now(), Op: model.AuditApply, Scenes: []string{fmt.Sprintf("scene-%d", i)}}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+	entries, err := readFile(files[0])
+	if err != nil || len(entries) != 3 || entries[2].Scenes[0] != "scene-2" {
+		t.Fatalf("unexpected entries: %d, %v", len(entries), err)
+	}
+	if entries, _ := l.Query(&model.AuditQuery{Scene: "scene-0"}); len(entries) != 0 {
+		t.Fatalf("expected the first file to have been discarded")
+	}
+}
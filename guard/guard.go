@@ -0,0 +1,256 @@
+// Package guard implements the small expression language used to make the channel states of
+// a scene conditional on the live states of things.
+//
+// A guard is a boolean expression. Operands are literals (numbers, "strings", true, false and
+// null) or references to live states:
+//
+//	state                        the current state of the guarded channel
+//	channel("channel-id")        the current state of a channel of the guarded thing
+//	thing("thing-id", "chan-id") the current state of a channel of any thing
+//
+// The fields of object states may be selected with '.', e.g. state.mode. Operands may be compared
+// with ==, != (any values), <, <=, > and >= (numbers or strings) and comparisons combined with
+// &&, || and !. Parentheses may be used for grouping. For example:
+//
+//	channel("on-off") == true && thing("6bd7...", "illuminance") < 50
+package guard
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// An Environment answers the live states referred to by an expression.
+type Environment interface {
+	// State answers the current state of the guarded channel.
+	State() (interface{}, error)
+	// Channel answers the current state of the specified channel of the guarded thing.
+	Channel(id string) (interface{}, error)
+	// Thing answers the current state of the specified channel of the specified thing.
+	Thing(thingID string, channelID string) (interface{}, error)
+}
+
+// An Expression is a parsed guard.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Parse parses the specified source and answers the resulting expression.
+func Parse(source string) (*Expression, error) {
+	p := &parser{lexer: &lexer{input: source}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", p.token, p.token.offset)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String answers the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate evaluates the expression in the specified environment. An error is answered if a
+// reference cannot be resolved, if the operands of an operator have unsuitable types or if
+// the expression does not evaluate to a boolean.
+func (e *Expression) Evaluate(env Environment) (bool, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, fmt.Errorf("expression evaluated to %v, not a boolean", v)
+}
+
+// a node of the syntax tree
+type node interface {
+	eval(env Environment) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(env Environment) (interface{}, error) {
+	return n.value, nil
+}
+
+type stateRef struct{}
+
+func (n *stateRef) eval(env Environment) (interface{}, error) {
+	return env.State()
+}
+
+type channelRef struct {
+	channel string
+}
+
+func (n *channelRef) eval(env Environment) (interface{}, error) {
+	return env.Channel(n.channel)
+}
+
+type thingRef struct {
+	thing   string
+	channel string
+}
+
+func (n *thingRef) eval(env Environment) (interface{}, error) {
+	return env.Thing(n.thing, n.channel)
+}
+
+type field struct {
+	operand node
+	name    string
+}
+
+func (n *field) eval(env Environment) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return normalize(m[n.name]), nil
+	}
+	return nil, fmt.Errorf("cannot select field '%s' of %v", n.name, v)
+}
+
+type not struct {
+	operand node
+}
+
+func (n *not) eval(env Environment) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := v.(bool); ok {
+		return !b, nil
+	}
+	return nil, fmt.Errorf("operand of ! is not a boolean: %v", v)
+}
+
+type logical struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *logical) eval(env Environment) (interface{}, error) {
+	left, err := evalBool(n.op, n.left, env)
+	if err != nil {
+		return nil, err
+	}
+	if (n.op == "&&" && !left) || (n.op == "||" && left) {
+		return left, nil
+	}
+	return evalBool(n.op, n.right, env)
+}
+
+func evalBool(op string, n node, env Environment) (bool, error) {
+	v, err := n.eval(env)
+	if err != nil {
+		return false, err
+	}
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, fmt.Errorf("operand of %s is not a boolean: %v", op, v)
+}
+
+type comparison struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *comparison) eval(env Environment) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	left, right = normalize(left), normalize(right)
+
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		return !reflect.DeepEqual(left, right), nil
+	}
+
+	var c int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+		}
+		c = compareFloats(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+		}
+		c = compareStrings(l, r)
+	default:
+		return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(l, r string) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// convert numeric values to float64, so that values compare as they would once serialized as JSON
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
@@ -0,0 +1,122 @@
+package guard
+
+import (
+	"fmt"
+	"testing"
+)
+
+type mockEnvironment struct {
+	state  interface{}
+	things map[string]map[string]interface{}
+}
+
+func (e *mockEnvironment) State() (interface{}, error) {
+	return e.state, nil
+}
+
+func (e *mockEnvironment) Channel(id string) (interface{}, error) {
+	return e.Thing("self", id)
+}
+
+func (e *mockEnvironment) Thing(thingID string, channelID string) (interface{}, error) {
+	if channels, ok := e.things[thingID]; ok {
+		if state, ok := channels[channelID]; ok {
+			return state, nil
+		}
+	}
+	return nil, fmt.Errorf("no such channel: %s, %s", thingID, channelID)
+}
+
+var env = &mockEnvironment{
+	state: true,
+	things: map[string]map[string]interface{}{
+		"self": {
+			"on-off":      true,
+			"temperature": 21.5,
+			"color":       map[string]interface{}{"mode": "hue", "hue": 0.5},
+		},
+		"6bd7-lux": {
+			"illuminance": 42.0,
+		},
+	},
+}
+
+func TestEvaluate(t *testing.T) {
+	cases := map[string]bool{
+		`state`:                                 true,
+		`state == true`:                         true,
+		`!state`:                                false,
+		`channel("on-off") != false`:            true,
+		`channel("temperature") >= 21.5`:        true,
+		`channel("temperature") < -1`:           false,
+		`thing("6bd7-lux", "illuminance") < 50`: true,
+		`channel('color').mode == "hue"`:        true,
+		`channel("color").hue > 0.25`:           true,
+		`"abc" < "abd"`:                         true,
+		`null == null`:                          true,
+		`false || true && false`:                false,
+		`(false || true) && !false`:             true,
+	}
+
+	for source, expected := range cases {
+		e, err := Parse(source)
+		if err != nil {
+			t.Fatalf("%s: unexpected parse error: %v", source, err)
+		}
+		if result, err := e.Evaluate(env); err != nil {
+			t.Fatalf("%s: unexpected evaluation error: %v", source, err)
+		} else if result != expected {
+			t.Fatalf("%s: was %v but expected %v", source, result, expected)
+		}
+	}
+}
+
+func TestShortCircuit(t *testing.T) {
+	e, err := Parse(`false && thing("missing", "channel") == 1`)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if result, err := e.Evaluate(env); err != nil || result {
+		t.Fatalf("was %v, %v but expected false, nil", result, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`state ==`,
+		`(state`,
+		`state)`,
+		`channel(on-off)`,
+		`thing("a")`,
+		`"unterminated`,
+		`1.2.3 == 1`,
+		`state # 1`,
+		`foo == 1`,
+		`state.`,
+	} {
+		if _, err := Parse(source); err == nil {
+			t.Fatalf("%s: expected a parse error", source)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	for _, source := range []string{
+		`channel("temperature")`,
+		`channel("temperature") < "warm"`,
+		`channel("on-off") > 1`,
+		`thing("missing", "channel") == 1`,
+		`!channel("temperature")`,
+		`channel("temperature") && true`,
+		`channel("temperature").value == 1`,
+	} {
+		e, err := Parse(source)
+		if err != nil {
+			t.Fatalf("%s: unexpected parse error: %v", source, err)
+		}
+		if _, err := e.Evaluate(env); err == nil {
+			t.Fatalf("%s: expected an evaluation error", source)
+		}
+	}
+}
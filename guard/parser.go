@@ -0,0 +1,294 @@
+package guard
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	tokenEOF = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind   int
+	text   string
+	offset int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// the operators of the language, longest first so that the lexer prefers "<=" to "<"
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", ",", ".", "-"}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+// answer the next token of the input
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokenEOF, offset: start}, nil
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.input) && (isDigit(l.input[l.pos]) || l.input[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokenNumber, text: l.input[start:l.pos], offset: start}, nil
+	case c == '"' || c == '\'':
+		l.pos++
+		var b bytes.Buffer
+		for l.pos < len(l.input) && l.input[l.pos] != c {
+			if l.input[l.pos] == '\\' && l.pos+1 < len(l.input) {
+				l.pos++
+			}
+			b.WriteByte(l.input[l.pos])
+			l.pos++
+		}
+		if l.pos >= len(l.input) {
+			return token{}, fmt.Errorf("unterminated string at offset %d", start)
+		}
+		l.pos++
+		return token{kind: tokenString, text: b.String(), offset: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.input) && (l.input[l.pos] == '_' || isDigit(l.input[l.pos]) || unicode.IsLetter(rune(l.input[l.pos]))) {
+			l.pos++
+		}
+		return token{kind: tokenIdent, text: l.input[start:l.pos], offset: start}, nil
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokenOperator, text: op, offset: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character '%c' at offset %d", c, start)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// a recursive descent parser with one token of lookahead
+type parser struct {
+	lexer *lexer
+	token token
+}
+
+func (p *parser) advance() error {
+	t, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.token = t
+	return nil
+}
+
+func (p *parser) isOperator(ops ...string) bool {
+	if p.token.kind != tokenOperator {
+		return false
+	}
+	for _, op := range ops {
+		if p.token.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOperator(op) {
+		return fmt.Errorf("expected '%s' but found %s at offset %d", op, p.token, p.token.offset)
+	}
+	return p.advance()
+}
+
+// or := and ( '||' and )*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.isOperator("||") {
+		var right node
+		if err = p.advance(); err == nil {
+			if right, err = p.parseAnd(); err == nil {
+				left = &logical{op: "||", left: left, right: right}
+			}
+		}
+	}
+	return left, err
+}
+
+// and := not ( '&&' not )*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	for err == nil && p.isOperator("&&") {
+		var right node
+		if err = p.advance(); err == nil {
+			if right, err = p.parseNot(); err == nil {
+				left = &logical{op: "&&", left: left, right: right}
+			}
+		}
+	}
+	return left, err
+}
+
+// not := '!' not | comparison
+func (p *parser) parseNot() (node, error) {
+	if p.isOperator("!") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &not{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+// comparison := operand ( ( '==' | '!=' | '<' | '<=' | '>' | '>=' ) operand )?
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOperator("==", "!=", "<", "<=", ">", ">=") {
+		op := p.token.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &comparison{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+// operand := primary ( '.' ident )*
+func (p *parser) parseOperand() (node, error) {
+	n, err := p.parsePrimary()
+	for err == nil && p.isOperator(".") {
+		if err = p.advance(); err != nil {
+			break
+		}
+		if p.token.kind != tokenIdent {
+			return nil, fmt.Errorf("expected a field name but found %s at offset %d", p.token, p.token.offset)
+		}
+		n = &field{operand: n, name: p.token.text}
+		err = p.advance()
+	}
+	return n, err
+}
+
+// primary := number | '-' number | string | 'true' | 'false' | 'null' | 'state' | '(' or ')'
+// | 'channel' '(' string ')' | 'thing' '(' string ',' string ')'
+func (p *parser) parsePrimary() (node, error) {
+	t := p.token
+	switch t.kind {
+	case tokenNumber:
+		return p.parseNumber(1)
+	case tokenString:
+		return &literal{value: t.text}, p.advance()
+	case tokenIdent:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null":
+			return &literal{value: nil}, nil
+		case "state":
+			return &stateRef{}, nil
+		case "channel":
+			args, err := p.parseArguments(1)
+			if err != nil {
+				return nil, err
+			}
+			return &channelRef{channel: args[0]}, nil
+		case "thing":
+			args, err := p.parseArguments(2)
+			if err != nil {
+				return nil, err
+			}
+			return &thingRef{thing: args[0], channel: args[1]}, nil
+		}
+		return nil, fmt.Errorf("unknown identifier '%s' at offset %d", t.text, t.offset)
+	case tokenOperator:
+		switch t.text {
+		case "-":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if p.token.kind != tokenNumber {
+				return nil, fmt.Errorf("expected a number but found %s at offset %d", p.token, p.token.offset)
+			}
+			return p.parseNumber(-1)
+		case "(":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at offset %d", t, t.offset)
+}
+
+func (p *parser) parseNumber(sign float64) (node, error) {
+	f, err := strconv.ParseFloat(p.token.text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad number '%s' at offset %d", p.token.text, p.token.offset)
+	}
+	return &literal{value: sign * f}, p.advance()
+}
+
+// parse a parenthesized list of the specified number of string arguments
+func (p *parser) parseArguments(n int) ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		if p.token.kind != tokenString {
+			return nil, fmt.Errorf("expected a string but found %s at offset %d", p.token, p.token.offset)
+		}
+		args = append(args, p.token.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.expect(")")
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"fmt"
+	"github.com/ninjasphere/app-presets/audit"
+	"github.com/ninjasphere/app-presets/metrics"
 	"github.com/ninjasphere/app-presets/model"
 	"github.com/ninjasphere/app-presets/rest"
 	"github.com/ninjasphere/app-presets/service"
 	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/support"
+	"time"
 )
 
 var (
@@ -35,8 +39,18 @@ func (a *PresetsApp) Start(m *model.Presets) error {
 			Save: func(m *model.Presets) {
 				a.SendEvent("config", m)
 			},
-			Conn: a.Conn,
-			Log:  a.Log,
+			Conn:    a.Conn,
+			Log:     a.Log,
+			Metrics: metrics.NewRegistry(),
+		}
+		if dir := config.String("audit", "app-presets.audit.dir"); dir != "" {
+			maxBytes := config.Int(1024*1024, "app-presets.audit.maxBytes")
+			maxFiles := config.Int(5, "app-presets.audit.maxFiles")
+			if log, err := audit.Open(dir, int64(maxBytes), maxFiles); err != nil {
+				a.Log.Warningf("failed to open the audit log - operations will not be audited: %v", err)
+			} else {
+				service.Audit = log
+			}
 		}
 		service.Save(m)
 		if err := service.Init(); err != nil {
@@ -45,8 +59,11 @@ func (a *PresetsApp) Start(m *model.Presets) error {
 			a.service = service
 			a.restServer.Log = a.Log
 			a.restServer.Presets = service
+			a.restServer.ShutdownTimeout = time.Duration(config.Int(10, "app-presets.service.shutdownSeconds")) * time.Second
 		}
 		if err := a.restServer.Start(); err != nil {
+			a.service = nil
+			service.Destroy()
 			return err
 		}
 	}
@@ -61,10 +78,20 @@ func (a *PresetsApp) Stop() error {
 	if tmp == nil {
 		return fmt.Errorf("The service is not started - action has been ignored.")
 	} else {
-		a.restServer.Stop()
-		tmp.Destroy()
+		var result error
+		if err := a.restServer.Stop(); err != nil {
+			a.Log.Warningf("failed to stop the REST server cleanly: %v", err)
+			result = err
+		}
+		if err := tmp.Destroy(); err != nil {
+			a.Log.Warningf("failed to stop the service cleanly: %v", err)
+			result = err
+		}
+		if tmp.Audit != nil {
+			tmp.Audit.Close()
+		}
+		return result
 	}
-	return nil
 }
 
 func main() {
@@ -0,0 +1,248 @@
+// Package metrics implements counters and histograms that can be written in the Prometheus text
+// exposition format. Each metric is a family of series, one for each combination of the values of
+// its labels. Counters, histograms and registries may be nil, in which case they record nothing,
+// so that instrumented code need not check whether metrics are enabled.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of a latency histogram.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	kindCounter   = "counter"
+	kindHistogram = "histogram"
+)
+
+// A Registry holds a set of metrics, which are written in the order in which they were registered.
+type Registry struct {
+	mutex    sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // the upper bounds of the buckets of a histogram, in increasing order
+	mutex   sync.Mutex
+	series  map[string]*series // keyed by the label values, joined by a zero byte
+}
+
+type series struct {
+	values []string
+	value  float64  // the value of a counter or the sum of a histogram
+	count  uint64   // the number of observations of a histogram
+	counts []uint64 // the number of observations that fell in each bucket of a histogram
+}
+
+// A Counter is a metric whose values only ever increase.
+type Counter struct {
+	f *family
+}
+
+// A Histogram is a metric that counts observations in buckets.
+type Histogram struct {
+	f *family
+}
+
+// NewRegistry answers an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{byName: make(map[string]*family)}
+}
+
+// Counter answers the counter with the specified name and labels, registering it if necessary.
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	if r == nil {
+		return nil
+	}
+	return &Counter{r.register(name, help, kindCounter, nil, labels)}
+}
+
+// Histogram answers the histogram with the specified name, buckets and labels, registering it if
+// necessary. The buckets are the upper bounds of each bucket; a bucket for +Inf is implied.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if r == nil {
+		return nil
+	}
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	return &Histogram{r.register(name, help, kindHistogram, sorted, labels)}
+}
+
+// answer the registered family with the specified name, or register a new one. A metric may be
+// registered more than once, so that it survives a restart of the instrumented code, but only
+// with the same kind and labels.
+func (r *Registry) register(name string, help string, kind string, buckets []float64, labels []string) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if f, ok := r.byName[name]; ok {
+		if f.kind != kind || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metric %s is already registered as a %s with labels %v", name, f.kind, f.labels))
+		}
+		return f
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	r.byName[name] = f
+	return f
+}
+
+// answer the series with the specified label values, creating it if necessary. The caller must
+// hold the mutex of the family.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v but %d values were specified", f.name, f.labels, len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: values}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Inc adds 1 to the series of the counter with the specified label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds a non-negative amount to the series of the counter with the specified label values.
+func (c *Counter) Add(v float64, values ...string) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+	c.f.get(values).value += v
+}
+
+// Observe records an observation in the series of the histogram with the specified label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+	s := h.f.get(values)
+	s.value += v
+	s.count++
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+}
+
+// Since records the number of seconds elapsed since the specified time.
+func (h *Histogram) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Write writes every metric of the registry in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	families := make([]*family, len(r.families))
+	copy(families, r.families)
+	r.mutex.Unlock()
+
+	b := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(b)
+	}
+	return b.Flush()
+}
+
+// ServeHTTP answers the metrics of the registry.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+func (f *family) write(b *bufio.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		switch f.kind {
+		case kindCounter:
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelSet(s.values, "", ""), format(s.value))
+		case kindHistogram:
+			cumulative := uint64(0)
+			for i, bound := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s.values, "le", format(bound)), cumulative)
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s.values, "le", "+Inf"), s.count)
+			fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelSet(s.values, "", ""), format(s.value))
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelSet(s.values, "", ""), s.count)
+		}
+	}
+}
+
+// answer the label set of a series, with an additional label if extra is not empty
+func (f *family) labelSet(values []string, extra string, extraValue string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, f.labels[i], escape(v, true)))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func format(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape backslashes and newlines and, in label values, double quotes
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "The number of requests.", "route", "status")
+	h := r.Histogram("latency_seconds", "The latency of requests.", []float64{1, 0.1})
+
+	c.Inc("/a", "200")
+	c.Inc("/a", "200")
+	c.Add(3, "/b\"\n", "500")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	b := &bytes.Buffer{}
+	if err := r.Write(b); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	expected := `# HELP requests_total The number of requests.
+# TYPE requests_total counter
+requests_total{route="/a",status="200"} 2
+requests_total{route="/b\"\n",status="500"} 3
+# HELP latency_seconds The latency of requests.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`
+	if b.String() != expected {
+		t.Fatalf("output was\n%s\nbut expected\n%s", b.String(), expected)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("total", "help", "a").Inc("x")
+	r.Counter("total", "help", "a").Inc("x")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, nil)
+	if !strings.Contains(w.Body.String(), `total{a="x"} 2`) {
+		t.Fatalf("expected the series to be shared, but got\n%s", w.Body.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a panic when a metric is registered with different labels")
+		}
+	}()
+	r.Counter("total", "help", "b")
+}
+
+func TestNil(t *testing.T) {
+	var r *Registry
+	c := r.Counter("total", "help")
+	h := r.Histogram("latency", "help", DefaultBuckets)
+	c.Inc()
+	h.Observe(1)
+}
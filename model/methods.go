@@ -1,7 +1,13 @@
 package model
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
 )
 
 // given a thing state, produce a new thing state with the same
@@ -11,12 +17,13 @@ func (m *ThingState) MergeUndoState(u *ThingState) *ThingState {
 	result := &ThingState{
 		ID:       m.ID,
 		Channels: make([]ChannelState, len(m.Channels)),
+		Guard:    m.Guard,
 	}
 
 	tmp := make(map[string]*ChannelState)
 	if u != nil {
-		for _, ch := range u.Channels {
-			tmp[ch.ID] = &ch
+		for i := range u.Channels {
+			tmp[u.Channels[i].ID] = &u.Channels[i]
 		}
 	}
 
@@ -37,8 +44,10 @@ func (m *ThingState) MergeUndoState(u *ThingState) *ThingState {
 // of the specified undo channel state.
 func (m *ChannelState) MergeUndoState(u *ChannelState) *ChannelState {
 	result := &ChannelState{
-		ID:    m.ID,
-		State: m.State,
+		ID:     m.ID,
+		State:  m.State,
+		Adjust: m.Adjust,
+		Guard:  m.Guard,
 	}
 	if u != nil {
 		result.UndoState = u.State
@@ -53,6 +62,7 @@ func (m *ThingState) MatchState(c *ThingState) *ThingState {
 	result := &ThingState{
 		ID:       m.ID,
 		Channels: make([]ChannelState, 0, len(m.Channels)),
+		Guard:    m.Guard,
 	}
 	tmp := make(map[string][]byte)
 	for _, ch := range c.Channels {
@@ -84,3 +94,287 @@ Channels:
 	}
 	return result
 }
+
+// Answer true if the specified states are equal. As for MatchState, states are assumed to be equal
+// if their JSON serializations are equal.
+func SameState(a interface{}, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(x) == string(y)
+}
+
+// Answer the differences between the thing states of the receiver and the specified scene. Channels
+// are reported in the order of the receiver's things followed by any things only in the other scene.
+func (m *Scene) Diff(o *Scene) *SceneDiff {
+	result := &SceneDiff{
+		From:    m.ID,
+		To:      o.ID,
+		Added:   make([]string, 0),
+		Removed: make([]string, 0),
+		Changes: make([]ChannelChange, 0),
+	}
+
+	others := make(map[string]*ThingState)
+	for i := range o.Things {
+		others[o.Things[i].ID] = &o.Things[i]
+	}
+
+	for _, t := range m.Things {
+		other := others[t.ID]
+		delete(others, t.ID)
+		if other == nil {
+			result.Removed = append(result.Removed, t.ID)
+		}
+
+		otherChannels := make(map[string]*ChannelState)
+		if other != nil {
+			for i := range other.Channels {
+				otherChannels[other.Channels[i].ID] = &other.Channels[i]
+			}
+		}
+		for _, ch := range t.Channels {
+			otherChannel, ok := otherChannels[ch.ID]
+			delete(otherChannels, ch.ID)
+			if !ok {
+				result.Changes = append(result.Changes, ChannelChange{Thing: t.ID, Channel: ch.ID, Change: ChangeRemoved, From: ch.State})
+			} else if !SameState(ch.State, otherChannel.State) {
+				result.Changes = append(result.Changes, ChannelChange{Thing: t.ID, Channel: ch.ID, Change: ChangeState, From: ch.State, To: otherChannel.State})
+			}
+		}
+		if other != nil {
+			for _, ch := range other.Channels {
+				if _, ok := otherChannels[ch.ID]; ok {
+					result.Changes = append(result.Changes, ChannelChange{Thing: t.ID, Channel: ch.ID, Change: ChangeAdded, To: ch.State})
+				}
+			}
+		}
+	}
+
+	for _, t := range o.Things {
+		if _, ok := others[t.ID]; ok {
+			result.Added = append(result.Added, t.ID)
+			for _, ch := range t.Channels {
+				result.Changes = append(result.Changes, ChannelChange{Thing: t.ID, Channel: ch.ID, Change: ChangeAdded, To: ch.State})
+			}
+		}
+	}
+	return result
+}
+
+// Answer a human-readable rendering of the differences, one line per changed channel, in the style
+// of a unified diff: '+' for added channels, '-' for removed channels and '~' for changed states.
+func (d *SceneDiff) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", d.From, d.To)
+	for _, c := range d.Changes {
+		switch c.Change {
+		case ChangeAdded:
+			fmt.Fprintf(&b, "+ %s/%s: %s\n", c.Thing, c.Channel, renderState(c.To))
+		case ChangeRemoved:
+			fmt.Fprintf(&b, "- %s/%s: %s\n", c.Thing, c.Channel, renderState(c.From))
+		default:
+			fmt.Fprintf(&b, "~ %s/%s: %s -> %s\n", c.Thing, c.Channel, renderState(c.From), renderState(c.To))
+		}
+	}
+	return b.String()
+}
+
+func renderState(state interface{}) string {
+	if encoded, err := json.Marshal(state); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprintf("%v", state)
+}
+
+// Given a list of orphans, produce a new scene which is a copy of the receiver, but without the
+// orphaned things and channels. Things which are left with no channels are removed entirely.
+func (m *Scene) Prune(orphans []Orphan) *Scene {
+	result := *m
+	result.Things = make([]ThingState, 0, len(m.Things))
+
+	missingThings := make(map[string]bool)
+	missingChannels := make(map[string]map[string]bool)
+	for _, o := range orphans {
+		if o.Channel == "" {
+			missingThings[o.Thing] = true
+		} else {
+			if _, ok := missingChannels[o.Thing]; !ok {
+				missingChannels[o.Thing] = make(map[string]bool)
+			}
+			missingChannels[o.Thing][o.Channel] = true
+		}
+	}
+
+	for _, t := range m.Things {
+		if missingThings[t.ID] {
+			continue
+		}
+		kept := ThingState{
+			ID:       t.ID,
+			Channels: make([]ChannelState, 0, len(t.Channels)),
+			Guard:    t.Guard,
+		}
+		for _, ch := range t.Channels {
+			if !missingChannels[t.ID][ch.ID] {
+				kept.Channels = append(kept.Channels, ch)
+			}
+		}
+		if len(kept.Channels) > 0 {
+			result.Things = append(result.Things, kept)
+		}
+	}
+	return &result
+}
+
+// Resolve answers the flattened list of thing states of the receiver, after the included scenes,
+// and the scenes they include, have been layered beneath the receiver's own thing states. lookup
+// answers the scene with the specified id, or nil if there is no such scene. An error is answered
+// if an included scene does not exist or if the scene includes itself, directly or indirectly.
+func (m *Scene) Resolve(lookup func(id string) *Scene) ([]ThingState, error) {
+	return m.resolve(lookup, []string{})
+}
+
+func (m *Scene) resolve(lookup func(id string) *Scene, path []string) ([]ThingState, error) {
+	for _, id := range path {
+		if id == m.ID {
+			return nil, fmt.Errorf("scene '%s' includes itself: %s -> %s", m.ID, strings.Join(path, " -> "), m.ID)
+		}
+	}
+	path = append(append(make([]string, 0, len(path)+1), path...), m.ID)
+
+	layers := make([][]ThingState, 0, len(m.Includes)+1)
+	for _, id := range m.Includes {
+		included := lookup(id)
+		if included == nil {
+			return nil, fmt.Errorf("scene '%s' includes scene '%s' which does not exist", m.ID, id)
+		}
+		things, err := included.resolve(lookup, path)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, things)
+	}
+	layers = append(layers, m.Things)
+	return overlay(layers), nil
+}
+
+// overlay the specified layers of thing states so that the channel states of later layers replace
+// the channel states of earlier layers. Things and channels retain the order in which they first appear.
+func overlay(layers [][]ThingState) []ThingState {
+	result := make([]ThingState, 0)
+	things := make(map[string]int)
+	channels := make(map[string]map[string]int)
+
+	for _, layer := range layers {
+		for _, t := range layer {
+			x, ok := things[t.ID]
+			if !ok {
+				x = len(result)
+				things[t.ID] = x
+				channels[t.ID] = make(map[string]int)
+				result = append(result, ThingState{
+					ID:       t.ID,
+					Channels: make([]ChannelState, 0, len(t.Channels)),
+				})
+			}
+			if t.Guard != "" {
+				result[x].Guard = t.Guard
+			}
+			for _, ch := range t.Channels {
+				if y, ok := channels[t.ID][ch.ID]; ok {
+					result[x].Channels[y] = ch
+				} else {
+					channels[t.ID][ch.ID] = len(result[x].Channels)
+					result[x].Channels = append(result[x].Channels, ch)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Validate answers an error if the adjustment does not specify a recognized operation or
+// if its bounds are inconsistent.
+func (a *Adjustment) Validate() error {
+	switch a.Op {
+	case AdjustIncrease, AdjustDecrease, AdjustToggle:
+	default:
+		return fmt.Errorf("illegal argument: unrecognized adjustment: '%s'", a.Op)
+	}
+	if a.Min != nil && a.Max != nil && *a.Min > *a.Max {
+		return fmt.Errorf("illegal argument: adjustment min %v exceeds max %v", *a.Min, *a.Max)
+	}
+	return nil
+}
+
+// Apply answers the state that results from applying the adjustment to the specified current
+// state. min and max are the bounds of the channel's range, or nil if the range is unknown; the
+// adjustment's own bounds take precedence over them.
+func (a *Adjustment) Apply(current interface{}, min *float64, max *float64) (interface{}, error) {
+	if a.Op == AdjustToggle {
+		if on, ok := current.(bool); ok {
+			return !on, nil
+		}
+		return nil, fmt.Errorf("cannot toggle non-boolean state: %v", current)
+	}
+
+	value, ok := current.(float64)
+	if !ok {
+		return nil, fmt.Errorf("cannot %s non-numeric state: %v", a.Op, current)
+	}
+
+	if a.Min != nil {
+		min = a.Min
+	}
+	if a.Max != nil {
+		max = a.Max
+	}
+
+	delta := a.By
+	if a.Percent {
+		if min != nil && max != nil {
+			delta = a.By / 100 * (*max - *min)
+		} else {
+			delta = a.By / 100 * math.Abs(value)
+		}
+	}
+	if a.Op == AdjustDecrease {
+		delta = -delta
+	}
+
+	value += delta
+	if min != nil && value < *min {
+		value = *min
+	}
+	if max != nil && value > *max {
+		value = *max
+	}
+	return value, nil
+}
+
+// Answer the hash of an API key, as stored.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Answer the privilege of the specified role, or 0 if the role is not known.
+func RoleLevel(role string) int {
+	switch role {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleEditor:
+		return 3
+	case RoleAdmin:
+		return 4
+	}
+	return 0
+}
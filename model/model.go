@@ -1,42 +1,701 @@
 // Presets is the configuration for the app-presets app. It consists of
 package model
 
-// A ChannelState represents the state of a single channel.
+import (
+	"time"
+)
+
+// A ChannelState represents the state of a single channel. If Adjust is specified, the state
+// to apply is computed from the channel's current state each time the scene is applied and State
+// records the state computed by the last apply.
 type ChannelState struct {
 	ID        string      `json:"id"`
-	State     interface{} `json:"state,omitempty"` // the state to apply
-	UndoState interface{} `json:"undo,omitempty"`  // the state immediately prior to the last apply
+	State     interface{} `json:"state,omitempty"`  // the state to apply
+	UndoState interface{} `json:"undo,omitempty"`   // the state immediately prior to the last apply
+	Adjust    *Adjustment `json:"adjust,omitempty"` // the change to apply to the current state, if relative
+	Guard     string      `json:"guard,omitempty"`  // the channel is only set if this expression is true
+}
+
+// The operations that an Adjustment may specify.
+const (
+	AdjustIncrease = "increase"
+	AdjustDecrease = "decrease"
+	AdjustToggle   = "toggle"
+)
+
+// An Adjustment describes a change relative to the current state of a channel. Increase and decrease
+// operate on numeric states and toggle operates on boolean states. If Percent is true, By is a
+// percentage of the channel's range or, if the channel has no known range, of its current state.
+// The result is clamped to Min and Max, if specified, otherwise to the channel's known range. A
+// channel whose range is not known is only increased if Max is specified, and decreased if Min is.
+type Adjustment struct {
+	Op      string   `json:"op"`
+	By      float64  `json:"by,omitempty"`
+	Percent bool     `json:"percent,omitempty"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
 }
 
 // A ThingState represents the state of a single thing. It consists of the id of the thing,
-// a list of channel states and a boolean which indicates whether the thing is
-// included in the scene.
+// a list of channel states and an optional guard expression. If the guard is specified, none
+// of the thing's channels are set unless the guard evaluates to true.
 type ThingState struct {
 	ID       string         `json:"id"`
 	Channels []ChannelState `json:"channels"`
+	Guard    string         `json:"guard,omitempty"`
 }
 
 // A Scene encodes the state of multiple things within a scope. It has a UUID that is a unique
 // identifier the scene, a slot number, which is the position of the scene within a
 // UI menu, a label which provides a human readable label for a scene, a scope which restricts the
 // set of selectable things and a list of thing states.
+//
+// A scene may also include other scenes by id. The included scenes are layered in the order
+// they are listed, each overriding the channel states of the scenes before it, and the scene's
+// own thing states are layered last of all.
 type Scene struct {
-	ID     string       `json:"id"`
-	Slot   int          `json:"slot"`
-	Label  string       `json:"label"`
-	Scope  string       `json:"scope"`
-	Things []ThingState `json:"things"`
+	ID          string                 `json:"id"`
+	Slot        int                    `json:"slot"`
+	Label       string                 `json:"label"`
+	Scope       string                 `json:"scope"`
+	Things      []ThingState           `json:"things"`
+	Includes    []string               `json:"includes,omitempty"` // the ids of the included scenes
+	Applied     []ThingState           `json:"applied,omitempty"`  // the resolved thing states of the last apply of a composite scene
+	Tags        []string               `json:"tags,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Icon        string                 `json:"icon,omitempty"`       // an icon identifier, interpreted by clients
+	Color       string                 `json:"color,omitempty"`      // a display color of the form #rrggbb
+	Favorite    bool                   `json:"favorite,omitempty"`   // true if the scene is a favorite
+	Properties  map[string]interface{} `json:"properties,omitempty"` // free-form properties of clients
+	Priority    int                    `json:"priority,omitempty"`   // the priority of the scene when its scope is locked
+	Hold        int                    `json:"hold,omitempty"`       // the seconds the scene holds its scope once applied; -1 until released
+	Modified    time.Time              `json:"modified"`             // the time the scene was last stored or modified
+	ModifiedBy  string                 `json:"modifiedBy,omitempty"` // who last stored or modified the scene, if known
+	Health      *SceneHealth           `json:"health,omitempty"`     // the result of the last audit, if any
+	Report      *ApplyReport           `json:"report,omitempty"`     // the outcome of the last apply, if any
+}
+
+// A ScenePatch describes changes to the metadata of the scene with the specified id. Only the
+// fields that are specified are changed. The properties are merged with the scene's existing
+// properties; a property with a null value is removed.
+type ScenePatch struct {
+	ID          string                 `json:"id"`
+	Label       *string                `json:"label,omitempty"`
+	Tags        *[]string              `json:"tags,omitempty"`
+	Description *string                `json:"description,omitempty"`
+	Icon        *string                `json:"icon,omitempty"`
+	Color       *string                `json:"color,omitempty"`
+	Favorite    *bool                  `json:"favorite,omitempty"`
+	Properties  map[string]interface{} `json:"properties,omitempty"`
+	Priority    *int                   `json:"priority,omitempty"`
+	Hold        *int                   `json:"hold,omitempty"`
+	ModifiedBy  string                 `json:"modifiedBy,omitempty"`
+}
+
+// A TagCount records the number of scenes that have a tag.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// A CaptureRequest describes a scene to be captured from the current states of the things in a
+// scope and stored in a slot. If Things is specified, only the specified things are captured and if
+// Schemas is specified, only channels with the specified schemas are captured. If Update is true and
+// a scene with the specified ID, or if no ID is specified, a scene in the specified slot of the scope
+// already exists, the thing states of that scene are replaced and its ID and metadata are retained.
+type CaptureRequest struct {
+	Scope   string   `json:"scope,omitempty"`
+	Slot    int      `json:"slot,omitempty"`
+	Label   string   `json:"label,omitempty"`
+	Things  []string `json:"things,omitempty"`
+	Schemas []string `json:"schemas,omitempty"`
+	Update  bool     `json:"update,omitempty"`
+	ID      string   `json:"id,omitempty"`
+	Author  string   `json:"author,omitempty"` // who requested the capture, if known
+}
+
+// A ChannelRef identifies a channel of a thing.
+type ChannelRef struct {
+	Thing   string `json:"thing"`
+	Channel string `json:"channel"`
+}
+
+// A CaptureResult records the scene stored by a capture, the channels that were captured and
+// the channels that were not captured together with the reasons why.
+type CaptureResult struct {
+	Scene    *Scene           `json:"scene"`
+	Captured []ChannelRef     `json:"captured"`
+	Skipped  []SkippedChannel `json:"skipped"`
+}
+
+// A RefreshRequest describes the refresh of an existing scene from the current states of its
+// things. Only the things and channels already in the scene are refreshed unless AddNew is true,
+// in which case presetable things in the scope of the scene that are not yet in the scene are
+// added too. If DryRun is true, the refreshed scene is answered but not stored.
+type RefreshRequest struct {
+	ID     string `json:"id"`
+	AddNew bool   `json:"addNew,omitempty"`
+	DryRun bool   `json:"dryRun,omitempty"`
+	Author string `json:"author,omitempty"` // who requested the refresh, if known
+}
+
+// A RefreshResult records the refreshed scene, the differences between the scene before and after
+// the refresh and the channels that could not be refreshed together with the reasons why.
+type RefreshResult struct {
+	Scene   *Scene           `json:"scene"`
+	Diff    *SceneDiff       `json:"diff"`
+	Skipped []SkippedChannel `json:"skipped"`
+	Stored  bool             `json:"stored"`
+}
+
+// The possible values of ChannelChange.Change.
+const (
+	ChangeAdded   = "added"   // the channel is only in the second scene
+	ChangeRemoved = "removed" // the channel is only in the first scene
+	ChangeState   = "changed" // the channel is in both scenes, with different states
+)
+
+// A ChannelChange describes a difference between the states of a channel in two scenes.
+type ChannelChange struct {
+	Thing   string      `json:"thing"`
+	Channel string      `json:"channel"`
+	Change  string      `json:"change"`
+	From    interface{} `json:"from,omitempty"`
+	To      interface{} `json:"to,omitempty"`
+}
+
+// A SceneDiff describes the differences between the thing states of two scenes. The things that
+// are only in one of the scenes are listed in Added and Removed and each of their channels is
+// also reported in Changes.
+type SceneDiff struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Added   []string        `json:"added"`
+	Removed []string        `json:"removed"`
+	Changes []ChannelChange `json:"changes"`
+}
+
+// A DiffRequest identifies two scenes to be compared. If a revision is specified, the scene as
+// of that revision is compared rather than the current scene.
+type DiffRequest struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	FromRevision int    `json:"fromRevision,omitempty"`
+	ToRevision   int    `json:"toRevision,omitempty"`
+}
+
+// The possible values of Revision.Action.
+const (
+	RevisionStore    = "store"    // the scene was stored
+	RevisionPatch    = "patch"    // the metadata of the scene was patched
+	RevisionRollback = "rollback" // the scene was rolled back to a previous revision
+	RevisionPrune    = "prune"    // orphaned things and channels were pruned from the scene
+	RevisionMove     = "move"     // the scene was moved to an empty slot
+	RevisionSwap     = "swap"     // the scene was swapped with the scene in another slot
+	RevisionInsert   = "insert"   // the scene was moved, or shifted, by an insert into a slot
+	RevisionCompact  = "compact"  // the scene was moved by a compaction of the slots of its scope
+)
+
+// A Revision records a version of a scene: who stored it, when and how, which fields of the scene
+// changed and how its thing states differ from those of the previous revision.
+type Revision struct {
+	Revision int        `json:"revision"`
+	Modified time.Time  `json:"modified"`
+	Author   string     `json:"author,omitempty"`
+	Action   string     `json:"action"`
+	Changed  []string   `json:"changed"`
+	Diff     *SceneDiff `json:"diff"`
+	Scene    *Scene     `json:"scene"`
+	Rollback int        `json:"rollback,omitempty"` // the revision that was restored by a rollback
+}
+
+// A RevisionRequest identifies a revision of a scene. Author records who requested a rollback.
+type RevisionRequest struct {
+	ID       string `json:"id"`
+	Revision int    `json:"revision"`
+	Author   string `json:"author,omitempty"`
+}
+
+// The possible values of AuditEntry.Op.
+const (
+	AuditStore    = "store"
+	AuditPatch    = "patch"
+	AuditDelete   = "delete"
+	AuditApply    = "apply"
+	AuditUndo     = "undo"
+	AuditCapture  = "capture"
+	AuditRefresh  = "refresh"
+	AuditRollback = "rollback"
+	AuditLock     = "lock"
+	AuditRelease  = "release"
+	AuditSimulate = "simulate"
+	AuditSequence = "sequence"
+	AuditSet      = "set"
+	AuditSlots    = "slots"
+	AuditZone     = "zone"
+	AuditKey      = "key"
+	AuditPrune    = "prune"
+)
+
+// The possible values of Caller.Transport.
+const (
+	TransportRPC        = "rpc"
+	TransportREST       = "rest"
+	TransportSimulation = "simulation" // the applies of a presence simulation
+	TransportSequence   = "sequence"   // the steps of a sequence
+	TransportAuditor    = "auditor"    // the periodic orphan audit
+)
+
+// A Caller identifies who requested an operation: the transport of the request and, for REST
+// requests, the remote address and the name of the API key used, if any.
+type Caller struct {
+	Transport  string `json:"transport"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Key        string `json:"key,omitempty"`
+}
+
+// An AuditEntry records an operation on presets: when it was performed, by whom, the ids of the
+// affected scenes, the parameters of the operation and its outcome.
+type AuditEntry struct {
+	Time    time.Time   `json:"time"`
+	Op      string      `json:"op"`
+	Caller  Caller      `json:"caller"`
+	Scenes  []string    `json:"scenes"`
+	Params  interface{} `json:"params,omitempty"`
+	Outcome string      `json:"outcome"` // "ok" or "error"
+	Error   string      `json:"error,omitempty"`
+}
+
+// An AuditQuery selects entries of the audit log. Only the entries recorded between Since and
+// Until, of the operation Op and affecting the scene with the id Scene are selected, if specified.
+// At most Limit entries are selected, if Limit is positive.
+type AuditQuery struct {
+	Since *time.Time `json:"since,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	Op    string     `json:"op,omitempty"`
+	Scene string     `json:"scene,omitempty"`
+	Limit int        `json:"limit,omitempty"`
+}
+
+// The roles of API keys, in order of increasing privilege. Each role may perform the operations
+// of the roles before it.
+const (
+	RoleViewer   = "viewer"   // may fetch scenes, zones, tags and prototypes
+	RoleOperator = "operator" // may also apply and undo scenes
+	RoleEditor   = "editor"   // may also store, change and delete scenes and zones
+	RoleAdmin    = "admin"    // may also manage API keys and read the audit log
+)
+
+// An APIKey grants the holder of a key a role. Only a hash of the key is stored.
+type APIKey struct {
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// A KeyRequest describes an API key to be created.
+type KeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// A KeyGrant answers a newly created API key. The key itself is only ever answered once.
+type KeyGrant struct {
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// An ApplyReport records the outcome of the last apply of a scene.
+type ApplyReport struct {
+	Applied time.Time        `json:"applied"`
+	Skipped []SkippedChannel `json:"skipped,omitempty"`
+}
+
+// A SkippedChannel identifies a channel, or an entire thing if Channel is empty, that was not
+// set when a scene was applied, together with the reason it was skipped.
+type SkippedChannel struct {
+	Thing   string `json:"thing"`
+	Channel string `json:"channel,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// The possible values of SceneHealth.Status.
+const (
+	HealthOK       = "ok"       // every thing and channel in the scene exists
+	HealthOrphaned = "orphaned" // the scene refers to things or channels that no longer exist
+	HealthStale    = "stale"    // the scene was orphaned and has been marked stale
+)
+
+// An Orphan identifies a thing, or a single channel of a thing, that is referenced by a scene
+// but which no longer exists in the thing model. If Channel is empty, the entire thing is missing.
+type Orphan struct {
+	Thing   string `json:"thing"`
+	Channel string `json:"channel,omitempty"`
+}
+
+// A SceneHealth records the outcome of the most recent orphan audit of a scene.
+type SceneHealth struct {
+	Status  string    `json:"status"`
+	Orphans []Orphan  `json:"orphans,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// A Zone is a user-defined group of rooms, e.g. "downstairs". A zone may be used as the
+// scope of a scene with the scope "zone:{zone-id}".
+type Zone struct {
+	ID    string   `json:"id"`
+	Label string   `json:"label"`
+	Rooms []string `json:"rooms"`
 }
 
-// A Presets object is a collection of Scenes.
+// A Presets object is a collection of Scenes and the Zones they may be scoped to. SlotLimits
+// records the maximum slot number of each scope that has a limit, keyed by the normalized scope.
 type Presets struct {
-	Version string   `json:"version"`
-	Scenes  []*Scene `json:"scenes"`
+	Version     string                 `json:"version"`
+	Scenes      []*Scene               `json:"scenes"`
+	Zones       []*Zone                `json:"zones,omitempty"`
+	SlotLimits  map[string]int         `json:"slotLimits,omitempty"`
+	Revisions   map[string][]*Revision `json:"revisions,omitempty"`   // the revisions of each scene, oldest first
+	Keys        []*APIKey              `json:"keys,omitempty"`        // the API keys of the REST server
+	Locks       map[string]*ScopeLock  `json:"locks,omitempty"`       // the locks held on scopes, keyed by the normalized scope
+	Simulations map[string]*Simulation `json:"simulations,omitempty"` // the presence simulations, keyed by the normalized scope
+	Sequences   []*Sequence            `json:"sequences,omitempty"`
+	Runs        []*SequenceRun         `json:"runs,omitempty"` // the runs of sequences, oldest first
+	Sets        []*SetResult           `json:"sets,omitempty"` // the latest channels set without a scene, oldest first
 }
 
-// A Query object can be used to restrict a query to a subset of scenes.
+// A SlotRequest describes an operation on the slots of a scope. ID identifies the scene to be moved or
+// inserted, Slot the target slot of a move or insert, and Slot and With the two slots of a swap.
+type SlotRequest struct {
+	Scope  string `json:"scope"`
+	ID     string `json:"id,omitempty"`
+	Slot   int    `json:"slot,omitempty"`
+	With   int    `json:"with,omitempty"`
+	Author string `json:"author,omitempty"` // who requested the change, if known
+}
+
+// A SlotLimit records the maximum slot number of a scope. A Max of 0 means the scope has no limit.
+type SlotLimit struct {
+	Scope string `json:"scope"`
+	Max   int    `json:"max"`
+}
+
+// A SlotChange records the movement of a scene from one slot to another.
+type SlotChange struct {
+	ID   string `json:"id"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// A SlotEvent is the payload of the "slots" event sent when the slots of a scope are changed.
+type SlotEvent struct {
+	Scope   string       `json:"scope"`
+	Op      string       `json:"op"`
+	Changes []SlotChange `json:"changes"`
+}
+
+// A Query object can be used to restrict a query to a subset of scenes. A scene is selected
+// only if it satisfies every criterion that is specified. If Room is specified, only scenes that
+// touch the room, i.e. that are scoped to the room or that contain things located in the room,
+// are selected. If both Thing and Channel are specified, only scenes that contain that channel
+// of that thing are selected.
+//
+// The selected scenes are ordered by Sort, which is one of "slot" (scope, then slot), "label"
+// or "modified", optionally prefixed with '-' for descending order. If Sort is empty, scenes are
+// answered in the order in which they are stored. Offset and Limit select a page of the ordered
+// scenes; a Limit of 0 selects all the remaining scenes.
 type Query struct {
-	Scope *string `json:"scope,omitempty"`
-	Slot  *int    `json:"slot,omitempty"`
-	ID    *string `json:"id,omitempty"`
+	Scope         *string    `json:"scope,omitempty"`
+	Slot          *int       `json:"slot,omitempty"`
+	ID            *string    `json:"id,omitempty"`
+	Room          *string    `json:"room,omitempty"`
+	Label         *string    `json:"label,omitempty"`      // a case-insensitive substring of the label
+	LabelRegex    *string    `json:"labelRegex,omitempty"` // a regular expression that matches the label
+	Thing         *string    `json:"thing,omitempty"`
+	Channel       *string    `json:"channel,omitempty"`
+	Tags          []string   `json:"tags,omitempty"`        // the scene must have every tag
+	Description   *string    `json:"description,omitempty"` // a case-insensitive substring of the description
+	Icon          *string    `json:"icon,omitempty"`
+	Color         *string    `json:"color,omitempty"`
+	Favorite      *bool      `json:"favorite,omitempty"`
+	Property      *string    `json:"property,omitempty"` // the name of a property the scene must have
+	ModifiedSince *time.Time `json:"modifiedSince,omitempty"`
+	Sort          string     `json:"sort,omitempty"`
+	Offset        int        `json:"offset,omitempty"`
+	Limit         int        `json:"limit,omitempty"`
+}
+
+// The actions that may be requested of an orphan audit.
+const (
+	OrphanReport    = "report"     // record the health of each scene, but otherwise leave it unchanged
+	OrphanPrune     = "prune"      // remove orphaned things and channels from each scene
+	OrphanMarkStale = "mark-stale" // mark each orphaned scene as stale
+)
+
+// An OrphanRequest selects the scenes to be audited for orphans and the action to be
+// taken with the orphans that are found.
+type OrphanRequest struct {
+	Scope  *string `json:"scope,omitempty"`
+	ID     *string `json:"id,omitempty"`
+	Action string  `json:"action,omitempty"`
+	Author string  `json:"author,omitempty"` // who requested the audit, if known
+}
+
+// The possible values of HealthReport.Status.
+const (
+	ServiceOK          = "ok"          // the service is live, or ready, as reported
+	ServiceUnavailable = "unavailable" // at least one check failed
+)
+
+// A HealthReport records the outcome of a liveness or readiness check of the service. Checks
+// records the outcome of each individual check, which is either "ok" or the reason it failed.
+type HealthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// An ApplyFailure records a call to a thing that failed while a scene was applied or undone.
+type ApplyFailure struct {
+	Time   time.Time `json:"time"`
+	Topic  string    `json:"topic"`
+	Method string    `json:"method"`
+	Error  string    `json:"error"`
+}
+
+// A ServiceStatus reports the internal state of the service for diagnostic purposes. Generation
+// is incremented each time the model is stored and Scenes counts the scenes of each scope.
+// RecentFailures holds the most recent apply failures, newest first, while ApplyFailures counts
+// every failure since the service was initialized.
+type ServiceStatus struct {
+	Started        time.Time      `json:"started"`
+	UptimeSeconds  int64          `json:"uptimeSeconds"`
+	Stopping       bool           `json:"stopping"`
+	Workers        int            `json:"workers"`
+	QueueDepth     int            `json:"queueDepth"`
+	QueueCapacity  int            `json:"queueCapacity"`
+	Generation     uint64         `json:"generation"`
+	Scenes         map[string]int `json:"scenes"`
+	ApplyFailures  int            `json:"applyFailures"`
+	RecentFailures []ApplyFailure `json:"recentFailures"`
+}
+
+// An ActivateRequest requests that a scene be applied, subject to the lock of its scope. The scene
+// is identified by ID or, if ID is empty, by the slot of the scope. A manual activation, i.e. one
+// requested by a person rather than by a schedule or another app, ranks with at least the manual
+// priority. Hold is the number of seconds the scene holds its scope once applied, or -1 to hold it
+// until it is released; if it is not specified, the Hold of the scene, if any, is used or, for a
+// manual activation, the configured manual hold, if any. If Defer is true, an activation that conflicts
+// with the lock of its scope is deferred until the lock is released, rather than rejected.
+type ActivateRequest struct {
+	ID     string `json:"id,omitempty"`
+	Scope  string `json:"scope,omitempty"`
+	Slot   int    `json:"slot,omitempty"`
+	Manual bool   `json:"manual,omitempty"`
+	Hold   *int   `json:"hold,omitempty"`
+	Defer  bool   `json:"defer,omitempty"`
+	Holder string `json:"holder,omitempty"` // who requested the activation, if known
+}
+
+// The possible values of ActivateResult.Outcome and LockEvent.Outcome.
+const (
+	LockApplied  = "applied"  // the scene was applied
+	LockDeferred = "deferred" // the scene will be applied once the lock of its scope is released
+	LockRejected = "rejected" // the scene was not applied because its scope is locked
+	LockAcquired = "acquired" // the scope was locked
+	LockReleased = "released" // the lock of the scope was released
+	LockExpired  = "expired"  // the lock of the scope expired
+)
+
+// An ActivateResult records the outcome of an activation: the scene that was applied or
+// deferred, the lock of its scope, if any, and, if the activation was deferred, the reason.
+type ActivateResult struct {
+	Scene   *Scene     `json:"scene"`
+	Outcome string     `json:"outcome"`
+	Reason  string     `json:"reason,omitempty"`
+	Lock    *ScopeLock `json:"lock,omitempty"`
+}
+
+// A ScopeLock records that a scene holds a scope, so that scenes of a lower priority cannot be
+// applied to the scope until the lock expires or is released. A nil Expires means the lock is
+// held until it is released. Scene is empty if the scope was locked without a scene.
+type ScopeLock struct {
+	Scope    string     `json:"scope"`
+	Scene    string     `json:"scene,omitempty"`
+	Priority int        `json:"priority"`
+	Holder   string     `json:"holder,omitempty"`
+	Acquired time.Time  `json:"acquired"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// A LockRequest requests that a scope be locked, or released. If ID is specified, the scope is
+// locked on behalf of that scene, at its priority unless Priority is specified, and Scope
+// defaults to the scope of the scene. Hold is the number of seconds the lock is held; 0 or -1
+// means until it is released.
+type LockRequest struct {
+	Scope    string `json:"scope"`
+	ID       string `json:"id,omitempty"`
+	Priority *int   `json:"priority,omitempty"`
+	Hold     int    `json:"hold,omitempty"`
+	Holder   string `json:"holder,omitempty"`
+}
+
+// A LockEvent is the payload of the "lock" event sent when the lock of a scope changes or when an
+// activation is deferred or rejected because of it. Scene identifies the scene being activated,
+// if any.
+type LockEvent struct {
+	Scope   string     `json:"scope"`
+	Outcome string     `json:"outcome"`
+	Scene   string     `json:"scene,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+	Lock    *ScopeLock `json:"lock,omitempty"`
+}
+
+// The possible values of Simulation.Source.
+const (
+	SimulationHistory = "history" // replay the applies recorded in the audit log
+	SimulationPattern = "pattern" // apply the scenes of the configured pattern
+)
+
+// A Simulation makes a scope look lived-in while nobody is present by applying its scenes at
+// plausible times. Each day, the simulation either replays the applies of the scenes of the scope
+// on a day chosen at random from the last HistoryDays days of the audit log, at the same times of
+// day, or applies each scene of the Pattern at a random time within its window. Each apply is
+// moved by a random amount of up to Jitter minutes either way.
+//
+// If PresenceThing and PresenceChannel are specified, the simulation stops as soon as that
+// channel is found in the PresenceState (default: true), e.g. when a motion sensor detects motion.
+// Planned lists the applies planned for the current day that are yet to be performed.
+type Simulation struct {
+	Scope           string             `json:"scope"`
+	Source          string             `json:"source"`
+	Pattern         []SimulationWindow `json:"pattern,omitempty"`
+	HistoryDays     int                `json:"historyDays,omitempty"` // default: 14
+	Jitter          int                `json:"jitter,omitempty"`
+	PresenceThing   string             `json:"presenceThing,omitempty"`
+	PresenceChannel string             `json:"presenceChannel,omitempty"`
+	PresenceState   interface{}        `json:"presenceState,omitempty"`
+	Enabled         bool               `json:"enabled"`
+	Started         time.Time          `json:"started"`
+	Stopped         *time.Time         `json:"stopped,omitempty"`
+	StopReason      string             `json:"stopReason,omitempty"`
+	Planned         []SimulatedApply   `json:"planned,omitempty"`
+}
+
+// A SimulationWindow specifies that a scene is applied once a day at a random time between From
+// and To, which are local times of day of the form "hh:mm".
+type SimulationWindow struct {
+	Scene string `json:"scene"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// A SimulatedApply is an apply of a scene planned by a simulation.
+type SimulatedApply struct {
+	Time  time.Time `json:"time"`
+	Scene string    `json:"scene"`
+}
+
+// The possible values of SequenceStep.Action.
+const (
+	StepApply = "apply" // apply Scene
+	StepUndo  = "undo"  // undo Scene
+	StepSet   = "set"   // set Channel of Thing to State
+	StepWait  = "wait"  // wait for Seconds
+)
+
+// The possible values of Sequence.Restart.
+const (
+	RestartResume = "resume" // runs interrupted by a restart of the service continue where they left off
+	RestartAbort  = "abort"  // runs interrupted by a restart of the service are aborted
+)
+
+// A Sequence is an ordered list of steps that are performed one after the other when the sequence
+// is run, e.g. to dim the lounge, then turn off the kitchen 2 minutes later. Restart determines
+// what happens to the runs of the sequence that are interrupted by a restart of the service
+// (default: the app-presets.service.sequences.restart configuration setting, or abort).
+type Sequence struct {
+	ID      string         `json:"id"`
+	Label   string         `json:"label"`
+	Steps   []SequenceStep `json:"steps"`
+	Restart string         `json:"restart,omitempty"`
+}
+
+// A SequenceStep is a step of a sequence.
+type SequenceStep struct {
+	Action  string      `json:"action"`
+	Scene   string      `json:"scene,omitempty"`
+	Thing   string      `json:"thing,omitempty"`
+	Channel string      `json:"channel,omitempty"`
+	State   interface{} `json:"state,omitempty"`
+	Seconds float64     `json:"seconds,omitempty"`
+}
+
+// The possible values of SequenceRun.Status.
+const (
+	RunRunning   = "running"
+	RunPaused    = "paused"
+	RunCompleted = "completed"
+	RunCancelled = "cancelled"
+	RunFailed    = "failed"  // a step failed
+	RunAborted   = "aborted" // the run was interrupted by a restart of the service
+)
+
+// A SequenceRun records the progress of a run of a sequence. Step is the index of the next step
+// to be performed, or of the wait step in progress, in which case Due is the time the wait ends
+// or, if the run is paused, Remaining is the number of seconds that remain.
+type SequenceRun struct {
+	ID        string     `json:"id"`
+	Sequence  string     `json:"sequence"`
+	Status    string     `json:"status"`
+	Step      int        `json:"step"`
+	Steps     int        `json:"steps"`
+	Due       *time.Time `json:"due,omitempty"`
+	Remaining float64    `json:"remaining,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Holder    string     `json:"holder,omitempty"` // who started the run, if known
+}
+
+// A ChannelSet specifies the state to which a channel of a thing is set.
+type ChannelSet struct {
+	Thing   string      `json:"thing"`
+	Channel string      `json:"channel"`
+	State   interface{} `json:"state"`
+}
+
+// A SetRequest requests that channels be set without defining a scene.
+type SetRequest struct {
+	Channels []ChannelSet `json:"channels"`
+}
+
+// A SetResult records the channels set by a SetRequest, with the state of each channel before it
+// was set as its undo state, so that the set can be undone like a scene.
+type SetResult struct {
+	ID     string       `json:"id"`
+	Things []ThingState `json:"things"`
+	Report *ApplyReport `json:"report"`
+	Undone *time.Time   `json:"undone,omitempty"`
+	Holder string       `json:"holder,omitempty"` // who requested the set, if known
+}
+
+// A Selector selects the settable channels of the promoted things in Scope (default: site) that
+// have the specified Type, if any, whose channels have the specified Schema and, if Tags are
+// specified, that belong to a scene with every tag. The schema must be specified, since every
+// selected channel is set to the same state, and may be specified by its URI or by the last
+// element of its URI, e.g. "on-off".
+type Selector struct {
+	Scope  string   `json:"scope,omitempty"`
+	Type   string   `json:"type,omitempty"`
+	Schema string   `json:"schema"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// A GroupRequest requests that every channel selected by the Selector be set to State.
+type GroupRequest struct {
+	Selector Selector    `json:"selector"`
+	State    interface{} `json:"state"`
 }
@@ -3,6 +3,7 @@ package model
 import (
 	"encoding/json"
 	"log"
+	"math"
 	"testing"
 )
 
@@ -15,8 +16,8 @@ func assert(t *testing.T, description string, assertion func() bool) {
 func TestJSONRoundTrip(t *testing.T) {
 	item := &Presets{
 		Version: "1.0",
-		Scenes: []Scene{
-			Scene{
+		Scenes: []*Scene{
+			&Scene{
 				ID:    "CAFE-BABE-0001",
 				Slot:  1,
 				Label: "Romantic",
@@ -60,3 +61,158 @@ func TestDeserialization(t *testing.T) {
 	}
 	log.Printf("%v", deserialized.Scenes[0].Things[0].Channels[0].State)
 }
+
+func TestPrune(t *testing.T) {
+	scene := &Scene{
+		ID: "CAFE-BABE-0001",
+		Things: []ThingState{
+			ThingState{
+				ID: "thing-1",
+				Channels: []ChannelState{
+					ChannelState{ID: "on-off", State: true},
+					ChannelState{ID: "brightness", State: 0.5},
+				},
+			},
+			ThingState{
+				ID:       "thing-2",
+				Channels: []ChannelState{ChannelState{ID: "on-off", State: true}},
+			},
+			ThingState{
+				ID:       "thing-3",
+				Channels: []ChannelState{ChannelState{ID: "on-off", State: true}},
+			},
+		},
+	}
+	pruned := scene.Prune([]Orphan{
+		Orphan{Thing: "thing-1", Channel: "brightness"},
+		Orphan{Thing: "thing-2"},
+		Orphan{Thing: "thing-3", Channel: "on-off"},
+	})
+
+	assert(t, "one thing remains", func() bool { return len(pruned.Things) == 1 })
+	assert(t, "thing-1 remains", func() bool { return pruned.Things[0].ID == "thing-1" })
+	assert(t, "on-off remains", func() bool {
+		return len(pruned.Things[0].Channels) == 1 && pruned.Things[0].Channels[0].ID == "on-off"
+	})
+	assert(t, "receiver is unchanged", func() bool { return len(scene.Things) == 3 })
+}
+
+func TestResolve(t *testing.T) {
+	scenes := map[string]*Scene{
+		"dim": &Scene{
+			ID: "dim",
+			Things: []ThingState{
+				ThingState{ID: "lamp", Channels: []ChannelState{
+					ChannelState{ID: "on-off", State: true},
+					ChannelState{ID: "brightness", State: 0.2},
+				}},
+			},
+		},
+		"off": &Scene{
+			ID: "off",
+			Things: []ThingState{
+				ThingState{ID: "kitchen", Channels: []ChannelState{ChannelState{ID: "on-off", State: false}}},
+				ThingState{ID: "lamp", Channels: []ChannelState{ChannelState{ID: "on-off", State: false}}},
+			},
+		},
+	}
+	lookup := func(id string) *Scene { return scenes[id] }
+
+	movie := &Scene{
+		ID:       "movie",
+		Includes: []string{"dim", "off"},
+		Things: []ThingState{
+			ThingState{ID: "lamp", Channels: []ChannelState{ChannelState{ID: "brightness", State: 0.1}}},
+		},
+	}
+	things, err := movie.Resolve(lookup)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert(t, "two things", func() bool { return len(things) == 2 })
+	assert(t, "lamp first", func() bool { return things[0].ID == "lamp" && things[1].ID == "kitchen" })
+	assert(t, "later include overrides", func() bool { return things[0].Channels[0].State == false })
+	assert(t, "own things override", func() bool { return things[0].Channels[1].State == 0.1 })
+	assert(t, "included scene is unchanged", func() bool { return scenes["dim"].Things[0].Channels[1].State == 0.2 })
+
+	scenes["off"].Includes = []string{"movie"}
+	scenes["movie"] = movie
+	if _, err := movie.Resolve(lookup); err == nil {
+		t.Fatalf("expected a cycle to be detected")
+	}
+
+	scenes["off"].Includes = []string{"deleted"}
+	if _, err := movie.Resolve(lookup); err == nil {
+		t.Fatalf("expected an error for a missing scene")
+	}
+}
+
+func TestAdjustmentApply(t *testing.T) {
+	zero, one := 0.0, 1.0
+	cases := []struct {
+		adjustment Adjustment
+		current    interface{}
+		expected   interface{}
+	}{
+		{Adjustment{Op: AdjustIncrease, By: 20, Percent: true}, 0.5, 0.7},
+		{Adjustment{Op: AdjustIncrease, By: 20, Percent: true}, 0.9, 1.0},
+		{Adjustment{Op: AdjustDecrease, By: 1}, 21.0, 20.0},
+		{Adjustment{Op: AdjustDecrease, By: 1, Min: &one}, 1.5, 1.0},
+		{Adjustment{Op: AdjustToggle}, true, false},
+	}
+	for _, c := range cases {
+		result, err := c.adjustment.Apply(c.current, &zero, &one)
+		if c.adjustment.By == 1 {
+			result, err = c.adjustment.Apply(c.current, nil, nil)
+		}
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", c.adjustment, err)
+		}
+		if f, ok := result.(float64); ok {
+			result = math.Floor(f*1000+0.5) / 1000
+		}
+		if result != c.expected {
+			t.Fatalf("%+v applied to %v was %v but expected %v", c.adjustment, c.current, result, c.expected)
+		}
+	}
+
+	if _, err := (&Adjustment{Op: AdjustToggle}).Apply(0.5, nil, nil); err == nil {
+		t.Fatalf("expected an error toggling a number")
+	}
+	if err := (&Adjustment{Op: "double"}).Validate(); err == nil {
+		t.Fatalf("expected an error for an unrecognized operation")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := &Scene{
+		ID: "a",
+		Things: []ThingState{
+			{ID: "lamp", Channels: []ChannelState{{ID: "on-off", State: true}, {ID: "brightness", State: 0.5}}},
+			{ID: "tv", Channels: []ChannelState{{ID: "on-off", State: false}}},
+		},
+	}
+	b := &Scene{
+		ID: "b",
+		Things: []ThingState{
+			{ID: "lamp", Channels: []ChannelState{{ID: "on-off", State: true}, {ID: "brightness", State: 0.8}, {ID: "color", State: "red"}}},
+			{ID: "heater", Channels: []ChannelState{{ID: "on-off", State: true}}},
+		},
+	}
+
+	diff := a.Diff(b)
+	if len(diff.Added) != 1 || diff.Added[0] != "heater" || len(diff.Removed) != 1 || diff.Removed[0] != "tv" {
+		t.Fatalf("unexpected things: %+v", diff)
+	}
+	expected := "--- a\n+++ b\n" +
+		"~ lamp/brightness: 0.5 -> 0.8\n" +
+		"+ lamp/color: \"red\"\n" +
+		"- tv/on-off: false\n" +
+		"+ heater/on-off: true\n"
+	if diff.String() != expected {
+		t.Fatalf("diff was\n%s\nbut expected\n%s", diff, expected)
+	}
+	if len(a.Diff(a).Changes) != 0 {
+		t.Fatalf("expected no changes between a scene and itself")
+	}
+}
@@ -18,10 +18,13 @@ package rest
 //
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-martini/martini"
@@ -42,9 +45,20 @@ type listener struct {
 
 // RestServer Holds stuff shared by all the rest services
 type RestServer struct {
-	Presets *service.PresetsService
-	Log     *logger.Logger
-	listener
+	Presets         *service.PresetsService
+	Log             *logger.Logger
+	Addr            string        // the address to listen at; if empty, the port specified by app-presets.rest.port
+	ShutdownTimeout time.Duration // the time Stop waits for requests to complete; if zero, 10 seconds
+	handler         http.Handler  // if not nil, used instead of the REST API
+
+	mutex    sync.Mutex
+	listener *listener
+	server   *http.Server
+	serving  chan struct{}               // closed when the server stops accepting connections
+	conns    map[net.Conn]http.ConnState // the open connections and their states
+	active   int                         // the number of requests in progress
+	idle     chan struct{}               // if not nil, closed when no requests are in progress
+	stopping bool
 }
 
 var StoppedError = errors.New("Listener stopped")
@@ -56,6 +70,9 @@ func (ln listener) Accept() (c net.Conn, err error) {
 
 		select {
 		case <-ln.stop:
+			if tc != nil {
+				tc.Close()
+			}
 			return nil, StoppedError
 		default:
 		}
@@ -78,40 +95,203 @@ func (ln listener) Accept() (c net.Conn, err error) {
 	}
 }
 
+// Start starts the server, which serves requests in the background. Start answers once the server
+// is listening, so that requests are accepted as soon as it returns, or answers an error if the
+// server cannot listen. A server that has been stopped may be started again.
 func (r *RestServer) Start() error {
-	return r.listen()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.serving != nil {
+		return fmt.Errorf("illegal state: the REST server is already started")
+	}
+
+	handler := r.handler
+	if handler == nil {
+		handler = r.presetsHandler()
+	}
+	tlsConfig, err := r.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	listenAddress := r.Addr
+	if listenAddress == "" {
+		listenAddress = fmt.Sprintf(":%d", config.MustInt("app-presets.rest.port"))
+	}
+	ln, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	r.listener = &listener{
+		TCPListener: ln.(*net.TCPListener),
+		stop:        make(chan struct{}),
+	}
+	var l net.Listener = r.listener
+	if tlsConfig != nil {
+		r.Log.Infof("Serving HTTPS")
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	r.server = &http.Server{
+		Handler:   r.track(handler),
+		TLSConfig: tlsConfig,
+		ConnState: r.connState,
+	}
+	r.conns = make(map[net.Conn]http.ConnState)
+	r.stopping = false
+	serving := make(chan struct{})
+	r.serving = serving
+
+	r.Log.Infof("Listening at %s", ln.Addr())
+	go func(srv *http.Server) {
+		if err := srv.Serve(l); err != StoppedError {
+			r.Log.Errorf("REST server failed: %v", err)
+		}
+		close(serving)
+	}(r.server)
+	return nil
 }
 
-func (r *RestServer) Stop() {
-	close(r.stop)
-	return
+// Stop stops the server. The server stops accepting connections immediately, idle connections are
+// closed and Stop then waits for the requests in progress to complete, for at most the shutdown
+// timeout, before closing the remaining connections. Requests made on existing connections while
+// the server is stopping are refused.
+func (r *RestServer) Stop() error {
+	r.mutex.Lock()
+	if r.serving == nil {
+		r.mutex.Unlock()
+		return fmt.Errorf("illegal state: the REST server is not started")
+	}
+	serving := r.serving
+	r.stopping = true
+	close(r.listener.stop)
+	r.listener.Close()
+	r.server.SetKeepAlivesEnabled(false)
+	for c, state := range r.conns {
+		if state == http.StateIdle || state == http.StateNew {
+			c.Close()
+		}
+	}
+	idle := make(chan struct{})
+	if r.active == 0 {
+		close(idle)
+	} else {
+		r.idle = idle
+	}
+	r.mutex.Unlock()
+
+	timeout := r.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	deadline := time.After(timeout)
+
+	var err error
+	select {
+	case <-idle:
+	case <-deadline:
+		err = fmt.Errorf("timed out after %v waiting for requests to complete", timeout)
+	}
+	<-serving
+
+	r.mutex.Lock()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.serving = nil
+	r.idle = nil
+	r.mutex.Unlock()
+	return err
 }
 
-func (r *RestServer) listen() error {
+// ListenAddr answers the address the server is listening at, or nil if the server is not started.
+func (r *RestServer) ListenAddr() net.Addr {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.serving == nil {
+		return nil
+	}
+	return r.listener.Addr()
+}
 
-	m := martini.Classic()
+// record the state of each connection, so that idle connections can be closed by Stop
+func (r *RestServer) connState(c net.Conn, state http.ConnState) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(r.conns, c)
+	case http.StateIdle:
+		if r.stopping {
+			c.Close()
+		}
+		r.conns[c] = state
+	default:
+		r.conns[c] = state
+	}
+}
 
-	m.Use(cors.Allow(&cors.Options{
-		AllowAllOrigins: true,
-	}))
+// answer a handler that counts the requests in progress and refuses requests once the server is stopping
+func (r *RestServer) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mutex.Lock()
+		if r.stopping {
+			r.mutex.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, "error: the server is stopping", http.StatusServiceUnavailable)
+			return
+		}
+		r.active++
+		r.mutex.Unlock()
 
-	task := NewPresetsRouter()
-	task.presets = r.Presets
+		defer func() {
+			r.mutex.Lock()
+			r.active--
+			if r.active == 0 && r.idle != nil {
+				close(r.idle)
+				r.idle = nil
+			}
+			r.mutex.Unlock()
+		}()
+		h.ServeHTTP(w, req)
+	})
+}
 
-	m.Group("/rest/v1/presets", task.Register)
+// answer the CORS options that allow the specified comma-separated list of origins, or any origin if
+// the list is "*". No cross-origin requests are allowed if the list is empty.
+func corsOptions(origins string) *cors.Options {
+	result := &cors.Options{
+		AllowOrigins: []string{},
+		AllowMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowHeaders: []string{"Origin", "Content-Type", "Authorization", "X-API-Key"},
+	}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o == "*" {
+			result.AllowAllOrigins = true
+		} else if o != "" {
+			result.AllowOrigins = append(result.AllowOrigins, o)
+		}
+	}
+	return result
+}
 
-	listenAddress := fmt.Sprintf(":%d", config.MustInt("app-presets.rest.port"))
+// answer the handler of the REST API
+func (r *RestServer) presetsHandler() http.Handler {
+	m := martini.Classic()
 
-	r.Log.Infof("Listening at %s", listenAddress)
+	m.Use(cors.Allow(corsOptions(config.String("", "app-presets.rest.cors.origins"))))
 
-	srv := &http.Server{Addr: listenAddress, Handler: m}
-	ln, err := net.Listen("tcp", listenAddress)
-	if err != nil {
-		return err
+	task := NewPresetsRouter()
+	task.presets = r.Presets
+	if task.auth && task.adminKey == "" {
+		// without an admin key, there would be no way to create the first keys
+		if key, err := service.BootstrapKey(r.Presets); err != nil {
+			r.Log.Errorf("failed to create the bootstrap API key: %v", err)
+		} else if key != "" {
+			r.Log.Warningf("created the API key 'bootstrap' with the admin role, which is only shown once: %s", key)
+		}
 	}
 
-	return srv.Serve(listener{
-		TCPListener: ln.(*net.TCPListener),
-		stop:        make(chan struct{}),
-	})
+	m.Group("/rest/v1/presets", task.Register)
+	return m
 }
@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/logger"
+)
+
+// answer a server whose handler signals each request on started, then waits for release
+func makeRestServer(started chan struct{}, release chan struct{}) *RestServer {
+	return &RestServer{
+		Log:  logger.GetLogger("test"),
+		Addr: "127.0.0.1:0",
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if started != nil {
+				started <- struct{}{}
+				<-release
+			}
+			w.Write([]byte("ok"))
+		}),
+	}
+}
+
+func get(r *RestServer) (int, error) {
+	resp, err := http.Get("http://" + r.ListenAddr().String() + "/")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, nil
+}
+
+func TestStartAndRestart(t *testing.T) {
+	r := makeRestServer(nil, nil)
+	if err := r.Stop(); err == nil {
+		t.Fatalf("expected an error when stopping a server that is not started")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := r.Start(); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+		if err := r.Start(); err == nil {
+			t.Fatalf("expected an error when starting a started server")
+		}
+		// the server accepts requests as soon as Start returns
+		if code, err := get(r); err != nil || code != http.StatusOK {
+			t.Fatalf("unexpected response: %d, %v", code, err)
+		}
+		addr := r.ListenAddr().String()
+		if err := r.Stop(); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+		if r.ListenAddr() != nil {
+			t.Fatalf("expected no address once stopped")
+		}
+		if _, err := http.Get("http://" + addr + "/"); err == nil {
+			t.Fatalf("expected connections to be refused once stopped")
+		}
+	}
+}
+
+func TestStopDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	r := makeRestServer(started, release)
+	if err := r.Start(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	result := make(chan int)
+	go func() {
+		code, _ := get(r)
+		result <- code
+	}()
+	<-started
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- r.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned %v before the request completed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if code := <-result; code != http.StatusOK {
+		t.Fatalf("code was %d but expected 200", code)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	r := makeRestServer(started, release)
+	r.ShutdownTimeout = 50 * time.Millisecond
+	if err := r.Start(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	go get(r)
+	<-started
+	if err := r.Stop(); err == nil {
+		t.Fatalf("expected Stop to time out")
+	}
+}
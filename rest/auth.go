@@ -0,0 +1,63 @@
+package rest
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/ninjasphere/app-presets/model"
+	"github.com/ninjasphere/app-presets/service"
+)
+
+// answer the API key presented by the request, either in an X-API-Key header or as a bearer token
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// answer the API key presented by the request, or nil if the request presents no valid key
+func (pr *PresetsRouter) authenticate(r *http.Request) *model.APIKey {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		// the client presented a certificate issued by the configured client CA
+		return &model.APIKey{
+			Name: "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName,
+			Role: pr.clientRole,
+		}
+	}
+	key := requestKey(r)
+	if key == "" {
+		return nil
+	}
+	if pr.adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(pr.adminKey)) == 1 {
+		return &model.APIKey{Name: "admin", Role: model.RoleAdmin}
+	}
+	return service.Authenticate(pr.presets, key)
+}
+
+// the role of routes that may be requested without an API key
+const public = ""
+
+// answer a handler that refuses requests that do not present an API key with at least the
+// specified role, unless authentication is disabled or the route is public
+func (pr *PresetsRouter) authorize(role string) func(w http.ResponseWriter, r *http.Request) {
+	required := model.RoleLevel(role)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if role == public || !pr.auth {
+			return
+		}
+		key := pr.authenticate(r)
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="presets"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("error: a valid API key is required\n"))
+		} else if model.RoleLevel(key.Role) < required {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("error: the " + key.Role + " role is not permitted to perform this operation\n"))
+		}
+	}
+}
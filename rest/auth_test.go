@@ -0,0 +1,154 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+	"github.com/ninjasphere/app-presets/model"
+	"github.com/ninjasphere/app-presets/service"
+)
+
+var roles = []string{model.RoleViewer, model.RoleOperator, model.RoleEditor, model.RoleAdmin}
+
+// answer a server with the routes of the router, each of which answers its own pattern once authorized
+func makeServer(pr *PresetsRouter) http.Handler {
+	m := martini.Classic()
+	m.Group("/rest/v1/presets", func(r martini.Router) {
+		for _, rt := range pr.routes() {
+			pattern := rt.method + " " + rt.pattern
+			addRoute(r, rt.method, rt.pattern, pr.authorize(rt.role), func(w http.ResponseWriter) {
+				w.Write([]byte(pattern))
+			})
+		}
+	})
+	return m
+}
+
+func makeRouter() *PresetsRouter {
+	keys := make([]*model.APIKey, 0, len(roles))
+	for _, role := range roles {
+		keys = append(keys, &model.APIKey{Name: role + "-key", Role: role, Hash: model.HashKey(role + "-secret")})
+	}
+	return &PresetsRouter{
+		presets: &service.PresetsService{Model: &model.Presets{Keys: keys}},
+		auth:    true,
+	}
+}
+
+// answer a path that matches the pattern, with each parameter replaced by its name
+func concrete(pattern string) string {
+	return "/rest/v1/presets" + strings.Replace(pattern, ":", "", -1)
+}
+
+func serve(h http.Handler, method string, path string, key string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestEveryRouteRequiresItsRole(t *testing.T) {
+	pr := makeRouter()
+	server := makeServer(pr)
+
+	for _, rt := range pr.routes() {
+		pattern := rt.method + " " + rt.pattern
+		path := concrete(rt.pattern)
+
+		if rt.role == public {
+			if w := serve(server, rt.method, path, ""); w.Code != http.StatusOK || w.Body.String() != pattern {
+				t.Fatalf("%s: code was %d without a key but expected 200", pattern, w.Code)
+			}
+			continue
+		}
+		if w := serve(server, rt.method, path, ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: code was %d without a key but expected 401", pattern, w.Code)
+		}
+		if w := serve(server, rt.method, path, "wrong-secret"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: code was %d with an unknown key but expected 401", pattern, w.Code)
+		}
+		for _, role := range roles {
+			w := serve(server, rt.method, path, role+"-secret")
+			if model.RoleLevel(role) < model.RoleLevel(rt.role) {
+				if w.Code != http.StatusForbidden {
+					t.Fatalf("%s: code was %d for the %s role but expected 403", pattern, w.Code, role)
+				}
+			} else if w.Code != http.StatusOK || w.Body.String() != pattern {
+				t.Fatalf("%s: the %s role got %d '%s' but expected 200 '%s'", pattern, role, w.Code, w.Body.String(), pattern)
+			}
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	server := makeServer(makeRouter())
+	req, _ := http.NewRequest("POST", "/rest/v1/presets/scene-id/apply", nil)
+	req.Header.Set("Authorization", "Bearer operator-secret")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("code was %d but expected 200", w.Code)
+	}
+}
+
+func TestAdminKey(t *testing.T) {
+	pr := makeRouter()
+	pr.adminKey = "bootstrap"
+	if w := serve(makeServer(pr), "POST", "/rest/v1/presets/keys", "bootstrap"); w.Code != http.StatusOK {
+		t.Fatalf("code was %d but expected 200", w.Code)
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	pr := makeRouter()
+	pr.auth = false
+	if w := serve(makeServer(pr), "DELETE", "/rest/v1/presets", ""); w.Code != http.StatusOK {
+		t.Fatalf("code was %d but expected 200", w.Code)
+	}
+}
+
+func TestAuthBootstrap(t *testing.T) {
+	pr := &PresetsRouter{
+		presets: &service.PresetsService{Model: &model.Presets{Keys: make([]*model.APIKey, 0)}, Save: func(*model.Presets) {}},
+		auth:    true,
+	}
+	server := makeServer(pr)
+
+	// an empty key store does not disable authentication
+	if w := serve(server, "POST", "/rest/v1/presets/keys", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("code was %d without any keys but expected 401", w.Code)
+	}
+	if w := serve(server, "DELETE", "/rest/v1/presets", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("code was %d without any keys but expected 401", w.Code)
+	}
+
+	// instead, a bootstrap key with the admin role is created
+	key, err := service.BootstrapKey(pr.presets)
+	if err != nil || key == "" {
+		t.Fatalf("unexpected bootstrap key: '%s', %v", key, err)
+	}
+	if w := serve(server, "POST", "/rest/v1/presets/keys", key); w.Code != http.StatusOK {
+		t.Fatalf("code was %d with the bootstrap key but expected 200", w.Code)
+	}
+	if again, err := service.BootstrapKey(pr.presets); err != nil || again != "" {
+		t.Fatalf("expected no bootstrap key once a key exists: '%s', %v", again, err)
+	}
+}
+
+func TestCorsOptions(t *testing.T) {
+	if o := corsOptions(""); o.AllowAllOrigins || len(o.AllowOrigins) != 0 {
+		t.Fatalf("expected no origins to be allowed: %+v", o)
+	}
+	if o := corsOptions("http://a.local, http://b.local"); o.AllowAllOrigins || len(o.AllowOrigins) != 2 || o.AllowOrigins[1] != "http://b.local" {
+		t.Fatalf("unexpected origins: %+v", o)
+	}
+	if o := corsOptions("*"); !o.AllowAllOrigins {
+		t.Fatalf("expected all origins to be allowed: %+v", o)
+	}
+}
@@ -4,32 +4,161 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-martini/martini"
+	"github.com/ninjasphere/app-presets/metrics"
 	"github.com/ninjasphere/app-presets/model"
 	"github.com/ninjasphere/app-presets/service"
 	"github.com/ninjasphere/go-ninja/config"
 )
 
 type PresetsRouter struct {
-	presets *service.PresetsService
+	presets    *service.PresetsService
+	auth       bool   // if true, requests must present an API key with a sufficient role
+	adminKey   string // if not empty, a key that grants the admin role, e.g. to create the first keys
+	clientRole string // the role granted to clients that present a verified certificate
+	requests   *metrics.Counter
 }
 
 func NewPresetsRouter() *PresetsRouter {
-	return &PresetsRouter{}
+	return &PresetsRouter{
+		auth:       config.Bool(true, "app-presets.rest.auth"),
+		adminKey:   config.String("", "app-presets.rest.adminKey"),
+		clientRole: config.String(model.RoleOperator, "app-presets.rest.tls.clientRole"),
+	}
+}
+
+// a route of the REST API, together with the role required to use it
+type route struct {
+	method  string
+	pattern string
+	role    string
+	handler martini.Handler
+}
+
+// answer the routes of the REST API, in the order in which they are matched
+func (pr *PresetsRouter) routes() []route {
+	viewer, operator, editor, admin := model.RoleViewer, model.RoleOperator, model.RoleEditor, model.RoleAdmin
+	return []route{
+		{"GET", "/health", public, pr.GetHealth},
+		{"GET", "/ready", public, pr.GetReadiness},
+		{"GET", "/debug/status", viewer, pr.GetStatus},
+		{"GET", "/metrics", viewer, pr.GetMetrics},
+		{"GET", "/keys", admin, pr.GetKeys},
+		{"POST", "/keys", admin, pr.PostKey},
+		{"DELETE", "/keys/:name", admin, pr.DeleteKey},
+		{"GET", "/orphans", viewer, pr.GetOrphans},
+		{"POST", "/orphans", editor, pr.PostOrphans},
+		{"GET", "/tags", viewer, pr.GetTags},
+		{"GET", "/audit", admin, pr.GetAudit},
+		{"GET", "/zones", viewer, pr.GetZones},
+		{"POST", "/zones", editor, pr.PutZone},
+		{"GET", "/zones/:zoneID", viewer, pr.GetZone},
+		{"PUT", "/zones/:zoneID", editor, pr.PutZone},
+		{"DELETE", "/zones/:zoneID", editor, pr.DeleteZone},
+		{"GET", "/prototype/zone/:zoneID", viewer, pr.GetZonePrototype},
+		{"POST", "/scopes/:scope/slots/move", editor, pr.MoveScene},
+		{"POST", "/scopes/:scope/slots/swap", editor, pr.SwapSlots},
+		{"POST", "/scopes/:scope/slots/insert", editor, pr.InsertScene},
+		{"POST", "/scopes/:scope/slots/compact", editor, pr.CompactSlots},
+		{"POST", "/scopes/:scope/slots/:slot/apply", operator, pr.ApplySlot},
+		{"POST", "/scopes/:scope/slots/:slot/undo", operator, pr.UndoSlot},
+		{"GET", "/scopes/:scope/slots/:slot/preview", viewer, pr.PreviewSlot},
+		{"GET", "/scopes/:scope/limit", viewer, pr.GetSlotLimit},
+		{"PUT", "/scopes/:scope/limit", editor, pr.PutSlotLimit},
+		{"POST", "/scopes/:scope/lock", operator, pr.LockScope},
+		{"DELETE", "/scopes/:scope/lock", operator, pr.ReleaseScope},
+		{"GET", "/locks", viewer, pr.GetLocks},
+		{"GET", "/scopes/:scope/simulation", viewer, pr.GetSimulation},
+		{"PUT", "/scopes/:scope/simulation", editor, pr.PutSimulation},
+		{"DELETE", "/scopes/:scope/simulation", editor, pr.DeleteSimulation},
+		{"GET", "/simulations", viewer, pr.GetSimulations},
+		{"GET", "/sequences", viewer, pr.GetSequences},
+		{"POST", "/sequences", editor, pr.PutSequence},
+		{"GET", "/sequences/:sequenceID", viewer, pr.GetSequence},
+		{"PUT", "/sequences/:sequenceID", editor, pr.PutSequence},
+		{"DELETE", "/sequences/:sequenceID", editor, pr.DeleteSequence},
+		{"POST", "/sequences/:sequenceID/start", operator, pr.StartSequence},
+		{"POST", "/channels", operator, pr.SetChannels},
+		{"GET", "/channels/sets", viewer, pr.GetChannelSets},
+		{"POST", "/groups/apply", operator, pr.ApplyGroup},
+		{"POST", "/groups/preview", viewer, pr.PreviewGroup},
+		{"POST", "/channels/sets/:setID/undo", operator, pr.UndoChannels},
+		{"GET", "/runs", viewer, pr.GetRuns},
+		{"GET", "/runs/:runID", viewer, pr.GetRun},
+		{"POST", "/runs/:runID/cancel", operator, pr.CancelRun},
+		{"POST", "/runs/:runID/pause", operator, pr.PauseRun},
+		{"POST", "/runs/:runID/resume", operator, pr.ResumeRun},
+		{"POST", "/capture", editor, pr.CaptureScene},
+		{"GET", "/:id", viewer, pr.GetScene},
+		{"GET", "/prototype/site", viewer, pr.GetSitePrototype},
+		{"GET", "/prototype/room/:roomID", viewer, pr.GetRoomPrototype},
+		{"PUT", "/:id", editor, pr.PutScene},
+		{"PATCH", "/:id", editor, pr.PatchScene},
+		{"DELETE", "/:id", editor, pr.DeleteScene},
+		{"POST", "/:id/apply", operator, pr.ApplyScene},
+		{"POST", "/:id/undo", operator, pr.UndoScene},
+		{"GET", "/:id/preview", viewer, pr.PreviewScene},
+		{"POST", "/:id/refresh", editor, pr.RefreshScene},
+		{"GET", "/:id/diff/:other", viewer, pr.DiffScenes},
+		{"GET", "/:id/revisions", viewer, pr.GetRevisions},
+		{"GET", "/:id/revisions/:revision", viewer, pr.GetRevision},
+		{"GET", "/:id/revisions/:revision/diff", viewer, pr.DiffRevision},
+		{"POST", "/:id/revisions/:revision/rollback", editor, pr.RollbackScene},
+		{"GET", "", viewer, pr.GetScenes},
+		{"POST", "", editor, pr.PutScene},
+		{"DELETE", "", editor, pr.DeleteScenes},
+	}
 }
 
 func (pr *PresetsRouter) Register(r martini.Router) {
-	r.Get("/:id", pr.GetScene)
-	r.Get("/prototype/site", pr.GetSitePrototype)
-	r.Get("/prototype/room/:roomID", pr.GetRoomPrototype)
-	r.Put("/:id", pr.PutScene)
-	r.Delete("/:id", pr.DeleteScene)
-	r.Post("/:id/apply", pr.ApplyScene)
-	r.Post("/:id/undo", pr.UndoScene)
-	r.Get("", pr.GetScenes)
-	r.Post("", pr.PutScene)
-	r.Delete("", pr.DeleteScenes)
+	pr.requests = pr.presets.Metrics.Counter("presets_rest_requests_total",
+		"The number of REST requests.", "method", "route", "status")
+	for _, rt := range pr.routes() {
+		addRoute(r, rt.method, rt.pattern, pr.count(rt.method, rt.pattern), pr.authorize(rt.role), rt.handler)
+	}
+}
+
+// answer a handler that counts the requests of a route by the status of the response
+func (pr *PresetsRouter) count(method string, pattern string) func(c martini.Context, w http.ResponseWriter) {
+	route := "/rest/v1/presets" + pattern
+	return func(c martini.Context, w http.ResponseWriter) {
+		c.Next()
+		status := w.(martini.ResponseWriter).Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		pr.requests.Inc(method, route, strconv.Itoa(status))
+	}
+}
+
+func addRoute(r martini.Router, method string, pattern string, handlers ...martini.Handler) {
+	switch method {
+	case "GET":
+		r.Get(pattern, handlers...)
+	case "POST":
+		r.Post(pattern, handlers...)
+	case "PUT":
+		r.Put(pattern, handlers...)
+	case "PATCH":
+		r.Patch(pattern, handlers...)
+	case "DELETE":
+		r.Delete(pattern, handlers...)
+	}
+}
+
+// answer a session that performs operations on behalf of the caller of the request
+func (pr *PresetsRouter) session(r *http.Request) *service.Session {
+	caller := model.Caller{
+		Transport:  model.TransportREST,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if key := pr.authenticate(r); key != nil {
+		caller.Key = key.Name
+	}
+	return service.NewSession(pr.presets, caller)
 }
 
 func writeResponse(code int, w http.ResponseWriter, response interface{}, err error) {
@@ -50,12 +179,60 @@ func query(r *http.Request) *model.Query {
 	if ids, ok := r.Form["id"]; ok {
 		result.ID = &ids[0]
 	}
+	if rooms, ok := r.Form["room"]; ok {
+		result.Room = &rooms[0]
+	}
 	if slots, ok := r.Form["slot"]; ok {
 		slot := 0
 		if n, err := fmt.Sscanf(slots[0], "%d", &slot); n == 1 && err == nil {
 			result.Slot = &slot
 		}
 	}
+	if labels, ok := r.Form["label"]; ok {
+		result.Label = &labels[0]
+	}
+	if regexes, ok := r.Form["labelRegex"]; ok {
+		result.LabelRegex = &regexes[0]
+	}
+	if things, ok := r.Form["thing"]; ok {
+		result.Thing = &things[0]
+	}
+	if channels, ok := r.Form["channel"]; ok {
+		result.Channel = &channels[0]
+	}
+	if tags, ok := r.Form["tag"]; ok {
+		result.Tags = tags
+	}
+	if descriptions, ok := r.Form["description"]; ok {
+		result.Description = &descriptions[0]
+	}
+	if icons, ok := r.Form["icon"]; ok {
+		result.Icon = &icons[0]
+	}
+	if colors, ok := r.Form["color"]; ok {
+		result.Color = &colors[0]
+	}
+	if favorites, ok := r.Form["favorite"]; ok {
+		favorite := favorites[0] == "true"
+		result.Favorite = &favorite
+	}
+	if properties, ok := r.Form["property"]; ok {
+		result.Property = &properties[0]
+	}
+	if times, ok := r.Form["modifiedSince"]; ok {
+		if since, err := time.Parse(time.RFC3339, times[0]); err == nil {
+			result.ModifiedSince = &since
+		}
+	}
+	if sorts, ok := r.Form["sort"]; ok {
+		result.Sort = sorts[0]
+	}
+	if offsets, ok := r.Form["offset"]; ok {
+		fmt.Sscanf(offsets[0], "%d", &result.Offset)
+	}
+	if limits, ok := r.Form["limit"]; ok {
+		fmt.Sscanf(limits[0], "%d", &result.Limit)
+	}
 	return result
 }
 
@@ -70,12 +247,19 @@ func (pr *PresetsRouter) GetScene(r *http.Request, w http.ResponseWriter, params
 }
 
 func (pr *PresetsRouter) ApplyScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
-	scene, err := pr.presets.ApplyScene(params["id"])
-	writeResponse(400, w, scene, err)
+	request := activateRequest(r)
+	request.ID = params["id"]
+	result, err := pr.session(r).ActivateScene(request)
+	writeActivateResponse(w, result, err)
 }
 
 func (pr *PresetsRouter) UndoScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
-	scene, err := pr.presets.UndoScene(params["id"])
+	scene, err := pr.session(r).UndoScene(params["id"])
+	writeSceneResponse(w, scene, err)
+}
+
+func (pr *PresetsRouter) PreviewScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scene, err := pr.presets.PreviewScene(params["id"])
 	writeResponse(400, w, scene, err)
 }
 
@@ -99,13 +283,212 @@ func (pr *PresetsRouter) PutScene(r *http.Request, w http.ResponseWriter, params
 	if labels, ok := r.Form["label"]; ok {
 		scene.Label = labels[0]
 	}
-	scene, err := pr.presets.StoreScene(scene)
+	scene, err := pr.session(r).StoreScene(scene)
+	writeStoreResponse(w, scene, err)
+}
+
+func (pr *PresetsRouter) CaptureScene(r *http.Request, w http.ResponseWriter) {
+	request := &model.CaptureRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	r.ParseForm()
+	if scopes, ok := r.Form["scope"]; ok {
+		request.Scope = scopes[0]
+	}
+	if slots, ok := r.Form["slot"]; ok {
+		fmt.Sscanf(slots[0], "%d", &request.Slot)
+	}
+	if labels, ok := r.Form["label"]; ok {
+		request.Label = labels[0]
+	}
+	if things, ok := r.Form["thing"]; ok {
+		request.Things = things
+	}
+	if schemas, ok := r.Form["schema"]; ok {
+		request.Schemas = schemas
+	}
+	if updates, ok := r.Form["update"]; ok {
+		request.Update = updates[0] == "true"
+	}
+	result, err := pr.session(r).CaptureScene(request)
+	writeStoreResponse(w, result, err)
+}
+
+// write the result of an operation that stores a scene, or 409 if the scene would replace
+// another scene in an occupied slot
+func writeStoreResponse(w http.ResponseWriter, result interface{}, err error) {
+	if _, ok := err.(*service.SlotConflictError); ok {
+		writeResponse(http.StatusConflict, w, nil, err)
+	} else {
+		writeResponse(400, w, result, err)
+	}
+}
+
+func (pr *PresetsRouter) RefreshScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	request := &model.RefreshRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	request.ID = params["id"]
+	r.ParseForm()
+	if addNews, ok := r.Form["addNew"]; ok {
+		request.AddNew = addNews[0] == "true"
+	}
+	if dryRuns, ok := r.Form["dryRun"]; ok {
+		request.DryRun = dryRuns[0] == "true"
+	}
+	result, err := pr.session(r).RefreshScene(request)
+	writeResponse(400, w, result, err)
+}
+
+// write a diff as JSON or, if format=text is requested, as a human-readable rendering
+func writeDiffResponse(r *http.Request, w http.ResponseWriter, diff *model.SceneDiff, err error) {
+	r.ParseForm()
+	if err == nil && r.Form.Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(diff.String()))
+		return
+	}
+	writeResponse(400, w, diff, err)
+}
+
+func (pr *PresetsRouter) DiffScenes(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	diff, err := pr.presets.DiffScenes(&model.DiffRequest{From: params["id"], To: params["other"]})
+	writeDiffResponse(r, w, diff, err)
+}
+
+func revisionRequest(r *http.Request, params martini.Params) *model.RevisionRequest {
+	result := &model.RevisionRequest{ID: params["id"]}
+	fmt.Sscanf(params["revision"], "%d", &result.Revision)
+	r.ParseForm()
+	if authors, ok := r.Form["author"]; ok {
+		result.Author = authors[0]
+	}
+	return result
+}
+
+func (pr *PresetsRouter) GetRevisions(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	revisions, err := pr.presets.FetchRevisions(params["id"])
+	writeResponse(400, w, revisions, err)
+}
+
+func (pr *PresetsRouter) GetRevision(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	revision, err := pr.presets.FetchRevision(revisionRequest(r, params))
+	writeResponse(400, w, revision, err)
+}
+
+// answers the differences between the specified revision and either the current scene or,
+// if to={revision} is specified, that revision
+func (pr *PresetsRouter) DiffRevision(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	request := &model.DiffRequest{From: params["id"], To: params["id"]}
+	fmt.Sscanf(params["revision"], "%d", &request.FromRevision)
+	r.ParseForm()
+	if tos, ok := r.Form["to"]; ok {
+		fmt.Sscanf(tos[0], "%d", &request.ToRevision)
+	}
+	diff, err := pr.presets.DiffScenes(request)
+	writeDiffResponse(r, w, diff, err)
+}
+
+func (pr *PresetsRouter) RollbackScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scene, err := pr.session(r).RollbackScene(revisionRequest(r, params))
+	writeResponse(400, w, scene, err)
+}
+
+func (pr *PresetsRouter) PatchScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	patch := &model.ScenePatch{}
+	json.NewDecoder(r.Body).Decode(patch)
+	patch.ID = params["id"]
+	scene, err := pr.session(r).PatchScene(patch)
 	writeResponse(400, w, scene, err)
 }
 
+func (pr *PresetsRouter) GetAudit(r *http.Request, w http.ResponseWriter) {
+	q := &model.AuditQuery{}
+	r.ParseForm()
+	if times, ok := r.Form["since"]; ok {
+		if since, err := time.Parse(time.RFC3339, times[0]); err == nil {
+			q.Since = &since
+		}
+	}
+	if times, ok := r.Form["until"]; ok {
+		if until, err := time.Parse(time.RFC3339, times[0]); err == nil {
+			q.Until = &until
+		}
+	}
+	if ops, ok := r.Form["op"]; ok {
+		q.Op = ops[0]
+	}
+	if scenes, ok := r.Form["scene"]; ok {
+		q.Scene = scenes[0]
+	}
+	if limits, ok := r.Form["limit"]; ok {
+		fmt.Sscanf(limits[0], "%d", &q.Limit)
+	}
+	entries, err := pr.presets.FetchAudit(q)
+	writeResponse(400, w, entries, err)
+}
+
+func (pr *PresetsRouter) GetKeys(r *http.Request, w http.ResponseWriter) {
+	keys, err := pr.session(r).FetchKeys()
+	writeResponse(400, w, keys, err)
+}
+
+func (pr *PresetsRouter) PostKey(r *http.Request, w http.ResponseWriter) {
+	request := &model.KeyRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	r.ParseForm()
+	if names, ok := r.Form["name"]; ok {
+		request.Name = names[0]
+	}
+	if roles, ok := r.Form["role"]; ok {
+		request.Role = roles[0]
+	}
+	grant, err := pr.session(r).CreateKey(request)
+	writeResponse(400, w, grant, err)
+}
+
+func (pr *PresetsRouter) DeleteKey(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	key, err := pr.session(r).DeleteKey(params["name"])
+	writeResponse(404, w, key, err)
+}
+
+func (pr *PresetsRouter) GetHealth(r *http.Request, w http.ResponseWriter) {
+	health, err := pr.presets.FetchHealth()
+	writeHealthResponse(w, health, err)
+}
+
+func (pr *PresetsRouter) GetReadiness(r *http.Request, w http.ResponseWriter) {
+	ready, err := pr.presets.FetchReadiness()
+	writeHealthResponse(w, ready, err)
+}
+
+// write the report, with 503 if the service is unavailable, so that probes need not parse the body
+func writeHealthResponse(w http.ResponseWriter, report *model.HealthReport, err error) {
+	if err == nil && report.Status != model.ServiceOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeResponse(503, w, report, err)
+}
+
+func (pr *PresetsRouter) GetStatus(r *http.Request, w http.ResponseWriter) {
+	status, err := pr.presets.FetchStatus()
+	writeResponse(500, w, status, err)
+}
+
+func (pr *PresetsRouter) GetMetrics(r *http.Request, w http.ResponseWriter) {
+	if pr.presets.Metrics == nil {
+		writeResponse(404, w, nil, fmt.Errorf("metrics are not enabled"))
+	} else {
+		pr.presets.Metrics.ServeHTTP(w, r)
+	}
+}
+
+func (pr *PresetsRouter) GetTags(r *http.Request, w http.ResponseWriter) {
+	tags, err := pr.presets.FetchTags()
+	writeResponse(400, w, tags, err)
+}
+
 func (pr *PresetsRouter) DeleteScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
 	id := params["id"]
-	scenes, err := pr.presets.DeleteScenes(&model.Query{ID: &id})
+	scenes, err := pr.session(r).DeleteScenes(&model.Query{ID: &id})
 	if scenes != nil && len(*scenes) == 1 {
 		writeResponse(400, w, (*scenes)[0], err)
 	} else {
@@ -115,7 +498,7 @@ func (pr *PresetsRouter) DeleteScene(r *http.Request, w http.ResponseWriter, par
 
 func (pr *PresetsRouter) DeleteScenes(r *http.Request, w http.ResponseWriter, params martini.Params) {
 	q := query(r)
-	scenes, err := pr.presets.DeleteScenes(q)
+	scenes, err := pr.session(r).DeleteScenes(q)
 	writeResponse(400, w, scenes, err)
 }
 
@@ -129,3 +512,339 @@ func (pr *PresetsRouter) GetRoomPrototype(r *http.Request, w http.ResponseWriter
 	prototype, err := pr.presets.FetchScenePrototype(fmt.Sprintf("room:%s", params["roomID"]))
 	writeResponse(400, w, prototype, err)
 }
+
+func orphanRequest(r *http.Request) *model.OrphanRequest {
+	q := query(r)
+	result := &model.OrphanRequest{
+		Scope: q.Scope,
+		ID:    q.ID,
+	}
+	if actions, ok := r.Form["action"]; ok {
+		result.Action = actions[0]
+	}
+	return result
+}
+
+func (pr *PresetsRouter) GetOrphans(r *http.Request, w http.ResponseWriter) {
+	req := orphanRequest(r)
+	req.Action = model.OrphanReport
+	scenes, err := pr.session(r).AuditOrphans(req)
+	writeResponse(400, w, scenes, err)
+}
+
+func (pr *PresetsRouter) PostOrphans(r *http.Request, w http.ResponseWriter) {
+	scenes, err := pr.session(r).AuditOrphans(orphanRequest(r))
+	writeResponse(400, w, scenes, err)
+}
+
+func (pr *PresetsRouter) GetZonePrototype(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	prototype, err := pr.presets.FetchScenePrototype(fmt.Sprintf("zone:%s", params["zoneID"]))
+	writeResponse(400, w, prototype, err)
+}
+
+func (pr *PresetsRouter) GetZones(r *http.Request, w http.ResponseWriter) {
+	zones, err := pr.presets.FetchZones()
+	writeResponse(400, w, zones, err)
+}
+
+func (pr *PresetsRouter) GetZone(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	zones, err := pr.presets.FetchZones()
+	if err == nil {
+		for _, z := range *zones {
+			if z.ID == params["zoneID"] {
+				writeResponse(400, w, z, nil)
+				return
+			}
+		}
+	}
+	writeResponse(404, w, nil, err)
+}
+
+func (pr *PresetsRouter) PutZone(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	zone := &model.Zone{}
+	json.NewDecoder(r.Body).Decode(zone)
+	if id, ok := params["zoneID"]; ok {
+		zone.ID = id
+	}
+	zone, err := pr.session(r).StoreZone(zone)
+	writeResponse(400, w, zone, err)
+}
+
+func (pr *PresetsRouter) DeleteZone(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	zone, err := pr.session(r).DeleteZone(params["zoneID"])
+	writeResponse(400, w, zone, err)
+}
+
+func (pr *PresetsRouter) GetSequences(r *http.Request, w http.ResponseWriter) {
+	sequences, err := pr.presets.FetchSequences()
+	writeResponse(400, w, sequences, err)
+}
+
+func (pr *PresetsRouter) GetSequence(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	sequence, err := pr.presets.FetchSequence(params["sequenceID"])
+	writeResponse(404, w, sequence, err)
+}
+
+func (pr *PresetsRouter) PutSequence(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	sequence := &model.Sequence{}
+	json.NewDecoder(r.Body).Decode(sequence)
+	if id, ok := params["sequenceID"]; ok {
+		sequence.ID = id
+	}
+	sequence, err := pr.session(r).StoreSequence(sequence)
+	writeResponse(400, w, sequence, err)
+}
+
+func (pr *PresetsRouter) DeleteSequence(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	sequence, err := pr.session(r).DeleteSequence(params["sequenceID"])
+	writeResponse(404, w, sequence, err)
+}
+
+func (pr *PresetsRouter) StartSequence(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	run, err := pr.session(r).StartSequence(params["sequenceID"])
+	writeResponse(404, w, run, err)
+}
+
+func (pr *PresetsRouter) SetChannels(r *http.Request, w http.ResponseWriter) {
+	request := &model.SetRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	result, err := pr.session(r).SetChannels(request)
+	writeSetResponse(400, w, result, err)
+}
+
+// write the result of a set of channels or, if the set was refused, 409 if a scope that contains
+// the channels is locked or the set was already undone, 429 if sets are rate limited and the
+// specified code otherwise
+func writeSetResponse(code int, w http.ResponseWriter, result *model.SetResult, err error) {
+	switch e := err.(type) {
+	case *service.ScopeLockedError, *service.SetUndoneError:
+		writeResponse(http.StatusConflict, w, nil, err)
+	case *service.RateLimitError:
+		writeRateLimited(w, e)
+	default:
+		writeResponse(code, w, result, err)
+	}
+}
+
+func (pr *PresetsRouter) GetChannelSets(r *http.Request, w http.ResponseWriter) {
+	sets, err := pr.presets.FetchChannelSets()
+	writeResponse(400, w, sets, err)
+}
+
+func (pr *PresetsRouter) UndoChannels(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	result, err := pr.session(r).UndoChannels(params["setID"])
+	writeSetResponse(404, w, result, err)
+}
+
+func (pr *PresetsRouter) ApplyGroup(r *http.Request, w http.ResponseWriter) {
+	request := &model.GroupRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	result, err := pr.session(r).ApplyGroup(request)
+	writeSetResponse(400, w, result, err)
+}
+
+func (pr *PresetsRouter) PreviewGroup(r *http.Request, w http.ResponseWriter) {
+	request := &model.GroupRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	scene, err := pr.presets.PreviewGroup(request)
+	writeResponse(400, w, scene, err)
+}
+
+func (pr *PresetsRouter) GetRuns(r *http.Request, w http.ResponseWriter) {
+	runs, err := pr.presets.FetchRuns()
+	writeResponse(400, w, runs, err)
+}
+
+func (pr *PresetsRouter) GetRun(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	run, err := pr.presets.FetchRun(params["runID"])
+	writeResponse(404, w, run, err)
+}
+
+func (pr *PresetsRouter) CancelRun(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	run, err := pr.session(r).CancelRun(params["runID"])
+	writeResponse(400, w, run, err)
+}
+
+func (pr *PresetsRouter) PauseRun(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	run, err := pr.session(r).PauseRun(params["runID"])
+	writeResponse(400, w, run, err)
+}
+
+func (pr *PresetsRouter) ResumeRun(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	run, err := pr.session(r).ResumeRun(params["runID"])
+	writeResponse(400, w, run, err)
+}
+
+func slotRequest(r *http.Request, params martini.Params) *model.SlotRequest {
+	result := &model.SlotRequest{Scope: params["scope"]}
+	r.ParseForm()
+	if ids, ok := r.Form["id"]; ok {
+		result.ID = ids[0]
+	}
+	if slots, ok := r.Form["slot"]; ok {
+		fmt.Sscanf(slots[0], "%d", &result.Slot)
+	}
+	if withs, ok := r.Form["with"]; ok {
+		fmt.Sscanf(withs[0], "%d", &result.With)
+	}
+	return result
+}
+
+func slotParams(params martini.Params) *model.SlotRequest {
+	result := &model.SlotRequest{Scope: params["scope"]}
+	fmt.Sscanf(params["slot"], "%d", &result.Slot)
+	return result
+}
+
+func (pr *PresetsRouter) MoveScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scenes, err := pr.session(r).MoveScene(slotRequest(r, params))
+	writeResponse(400, w, scenes, err)
+}
+
+func (pr *PresetsRouter) SwapSlots(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scenes, err := pr.session(r).SwapSlots(slotRequest(r, params))
+	writeResponse(400, w, scenes, err)
+}
+
+func (pr *PresetsRouter) InsertScene(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scenes, err := pr.session(r).InsertScene(slotRequest(r, params))
+	writeResponse(400, w, scenes, err)
+}
+
+func (pr *PresetsRouter) CompactSlots(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scenes, err := pr.session(r).CompactSlots(slotRequest(r, params))
+	writeResponse(400, w, scenes, err)
+}
+
+// write the response to an operation on a scene, or on the scene in a slot
+func writeSceneResponse(w http.ResponseWriter, scene *model.Scene, err error) {
+	if _, ok := err.(*service.EmptySlotError); ok {
+		writeResponse(404, w, nil, err)
+	} else if limited, ok := err.(*service.RateLimitError); ok {
+		writeRateLimited(w, limited)
+	} else {
+		writeResponse(400, w, scene, err)
+	}
+}
+
+func (pr *PresetsRouter) ApplySlot(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	slot := slotParams(params)
+	request := activateRequest(r)
+	request.Scope, request.Slot = slot.Scope, slot.Slot
+	result, err := pr.session(r).ActivateScene(request)
+	writeActivateResponse(w, result, err)
+}
+
+func (pr *PresetsRouter) UndoSlot(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scene, err := pr.session(r).UndoSlot(slotParams(params))
+	writeSceneResponse(w, scene, err)
+}
+
+func (pr *PresetsRouter) PreviewSlot(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	scene, err := pr.presets.PreviewSlot(slotParams(params))
+	writeSceneResponse(w, scene, err)
+}
+
+// answer a manual activation with the hold and defer parameters of the request
+func activateRequest(r *http.Request) *model.ActivateRequest {
+	request := &model.ActivateRequest{Manual: true}
+	r.ParseForm()
+	if holds, ok := r.Form["hold"]; ok {
+		hold := 0
+		fmt.Sscanf(holds[0], "%d", &hold)
+		request.Hold = &hold
+	}
+	request.Defer = r.Form.Get("defer") == "true"
+	return request
+}
+
+// write 429 with the time after which an operation that was rate limited may be retried
+func writeRateLimited(w http.ResponseWriter, limited *service.RateLimitError) {
+	seconds := (limited.RetryAfter + time.Second - 1) / time.Second
+	w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+	writeResponse(http.StatusTooManyRequests, w, nil, limited)
+}
+
+// write the scene that was applied or, if the activation was deferred, the result with 202
+func writeActivateResponse(w http.ResponseWriter, result *model.ActivateResult, err error) {
+	if locked, ok := err.(*service.ScopeLockedError); ok {
+		writeResponse(http.StatusConflict, w, nil, locked)
+	} else if err != nil {
+		writeSceneResponse(w, nil, err)
+	} else if result.Outcome == model.LockDeferred {
+		w.WriteHeader(http.StatusAccepted)
+		writeResponse(400, w, result, nil)
+	} else {
+		writeResponse(400, w, result.Scene, nil)
+	}
+}
+
+func (pr *PresetsRouter) GetLocks(r *http.Request, w http.ResponseWriter) {
+	locks, err := pr.presets.FetchLocks()
+	writeResponse(400, w, locks, err)
+}
+
+func (pr *PresetsRouter) LockScope(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	request := &model.LockRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	request.Scope = params["scope"]
+	r.ParseForm()
+	if ids, ok := r.Form["id"]; ok {
+		request.ID = ids[0]
+	}
+	if holds, ok := r.Form["hold"]; ok {
+		fmt.Sscanf(holds[0], "%d", &request.Hold)
+	}
+	if priorities, ok := r.Form["priority"]; ok {
+		priority := 0
+		fmt.Sscanf(priorities[0], "%d", &priority)
+		request.Priority = &priority
+	}
+	lock, err := pr.session(r).LockScope(request)
+	if _, ok := err.(*service.ScopeLockedError); ok {
+		writeResponse(http.StatusConflict, w, nil, err)
+	} else {
+		writeResponse(400, w, lock, err)
+	}
+}
+
+func (pr *PresetsRouter) ReleaseScope(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	lock, err := pr.session(r).ReleaseScope(&model.LockRequest{Scope: params["scope"]})
+	writeResponse(404, w, lock, err)
+}
+
+func (pr *PresetsRouter) GetSimulations(r *http.Request, w http.ResponseWriter) {
+	simulations, err := pr.presets.FetchSimulations()
+	writeResponse(400, w, simulations, err)
+}
+
+func (pr *PresetsRouter) GetSimulation(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	sim, err := pr.presets.FetchSimulation(params["scope"])
+	writeResponse(404, w, sim, err)
+}
+
+func (pr *PresetsRouter) PutSimulation(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	sim := &model.Simulation{}
+	json.NewDecoder(r.Body).Decode(sim)
+	sim.Scope = params["scope"]
+	sim, err := pr.session(r).StartSimulation(sim)
+	writeResponse(400, w, sim, err)
+}
+
+func (pr *PresetsRouter) DeleteSimulation(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	sim, err := pr.session(r).StopSimulation(params["scope"])
+	writeResponse(404, w, sim, err)
+}
+
+func (pr *PresetsRouter) GetSlotLimit(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	limit, err := pr.presets.FetchSlotLimit(params["scope"])
+	writeResponse(400, w, limit, err)
+}
+
+func (pr *PresetsRouter) PutSlotLimit(r *http.Request, w http.ResponseWriter, params martini.Params) {
+	limit := &model.SlotLimit{}
+	json.NewDecoder(r.Body).Decode(limit)
+	limit.Scope = params["scope"]
+	limit, err := pr.session(r).SetSlotLimit(limit)
+	writeResponse(400, w, limit, err)
+}
@@ -0,0 +1,34 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+	"github.com/ninjasphere/app-presets/metrics"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	pr := makeRouter()
+	pr.presets.Metrics = metrics.NewRegistry()
+	m := martini.Classic()
+	m.Group("/rest/v1/presets", pr.Register)
+
+	serve(m, "GET", "/rest/v1/presets/health", "")
+	serve(m, "GET", "/rest/v1/presets/health", "")
+	serve(m, "GET", "/rest/v1/presets/debug/status", "")
+
+	w := serve(m, "GET", "/rest/v1/presets/metrics", "viewer-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("code was %d but expected 200", w.Code)
+	}
+	for _, expected := range []string{
+		`presets_rest_requests_total{method="GET",route="/rest/v1/presets/health",status="200"} 2`,
+		`presets_rest_requests_total{method="GET",route="/rest/v1/presets/debug/status",status="401"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Fatalf("expected the metrics to contain '%s' but they were\n%s", expected, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// how often the certificate files are checked for changes
+const certificateCheckInterval = 10 * time.Second
+
+// certificates holds the server certificate loaded from a pair of PEM files and reloads it
+// whenever either file changes, so that certificates can be renewed without a restart.
+type certificates struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time // the latest modification time of the files when they were loaded
+	checked  time.Time // the time the files were last checked for changes
+}
+
+func loadCertificates(certFile string, keyFile string) (*certificates, error) {
+	c := &certificates{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// answer the latest modification time of the certificate and key files
+func (c *certificates) lastModified() (time.Time, error) {
+	var result time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return result, err
+		}
+		if info.ModTime().After(result) {
+			result = info.ModTime()
+		}
+	}
+	return result, nil
+}
+
+// load the certificate from the files. c.mutex must be held, unless c is not yet shared.
+func (c *certificates) load() error {
+	modified, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modified = modified
+	c.checked = time.Now()
+	return nil
+}
+
+// answer the current certificate, first reloading it if the files have changed. If the files
+// cannot be reloaded, e.g. because they are being replaced, the previous certificate is answered.
+func (c *certificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) >= certificateCheckInterval {
+		c.checked = time.Now()
+		if modified, err := c.lastModified(); err == nil && !modified.Equal(c.modified) {
+			c.load()
+		}
+	}
+	return c.cert, nil
+}
+
+// generate a self-signed certificate and key in the specified files, unless both already exist
+func ensureSelfSigned(certFile string, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"Ninja Sphere Presets"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost", "ninjasphere", "ninjasphere.local"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// answer the TLS configuration of the REST server, or nil if TLS is not enabled. If no certificate
+// and key files are configured, a self-signed certificate is generated on first use and kept in
+// the configured directory. If a client CA file is configured, clients may authenticate with
+// certificates issued by that CA.
+func (r *RestServer) tlsConfig() (*tls.Config, error) {
+	if !config.Bool(false, "app-presets.rest.tls.enabled") {
+		return nil, nil
+	}
+
+	certFile := config.String("", "app-presets.rest.tls.cert")
+	keyFile := config.String("", "app-presets.rest.tls.key")
+	if certFile == "" && keyFile == "" {
+		dir := config.String("tls", "app-presets.rest.tls.dir")
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile = filepath.Join(dir, "key.pem")
+		if err := ensureSelfSigned(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("failed to generate a self-signed certificate: %v", err)
+		}
+	} else if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("illegal configuration: both app-presets.rest.tls.cert and app-presets.rest.tls.key must be specified")
+	}
+
+	certs, err := loadCertificates(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	result := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if caFile := config.String("", "app-presets.rest.tls.clientCA"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		result.ClientCAs = pool
+		result.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return result, nil
+}
@@ -0,0 +1,82 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "tls", "cert.pem")
+	keyFile := filepath.Join(dir, "tls", "key.pem")
+
+	if err := ensureSelfSigned(certFile, keyFile); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	first, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the key to be private: %v, %v", info, err)
+	}
+
+	// an existing certificate is kept
+	if err := ensureSelfSigned(certFile, keyFile); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if second, _ := ioutil.ReadFile(certFile); string(second) != string(first) {
+		t.Fatalf("expected the existing certificate to be kept")
+	}
+
+	certs, err := loadCertificates(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	original, _ := certs.getCertificate(nil)
+	leaf, err := x509.ParseCertificate(original.Certificate[0])
+	if err != nil || leaf.NotAfter.Before(time.Now().Add(365*24*time.Hour)) {
+		t.Fatalf("unexpected certificate: %v, %v", leaf, err)
+	}
+
+	// a replaced certificate is reloaded once the files have been checked for changes
+	os.Remove(certFile)
+	os.Remove(keyFile)
+	if err := ensureSelfSigned(certFile, keyFile); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if unchanged, _ := certs.getCertificate(nil); unchanged != original {
+		t.Fatalf("expected the certificate not to be reloaded before the check interval")
+	}
+	certs.checked = time.Now().Add(-certificateCheckInterval)
+	if reloaded, _ := certs.getCertificate(nil); reloaded == original {
+		t.Fatalf("expected the certificate to be reloaded")
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	pr := makeRouter()
+	pr.clientRole = model.RoleOperator
+	req, _ := http.NewRequest("POST", "/rest/v1/presets/scene-id/apply", nil)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "hvac-controller"}}}},
+	}
+	if key := pr.authenticate(req); key == nil || key.Name != "cert:hvac-controller" || key.Role != model.RoleOperator {
+		t.Fatalf("unexpected key: %v", key)
+	}
+}
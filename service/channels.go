@@ -0,0 +1,362 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+	nmodel "github.com/ninjasphere/go-ninja/model"
+	"github.com/pborman/uuid"
+)
+
+// the number of channel sets that are retained so that they can be undone
+const retainedSets = 20
+
+// A SetUndoneError is answered when a set of channels that has already been undone is undone again.
+type SetUndoneError struct {
+	ID     string
+	Undone time.Time
+}
+
+func (e *SetUndoneError) Error() string {
+	return fmt.Sprintf("set %s was already undone at %s", e.ID, e.Undone.Format(time.RFC3339))
+}
+
+// the id of the pseudo scene whose rate limit applies to channel sets and their undos. Sets belong
+// to no scene, so they share one bucket, in the scope of the site.
+const channelSets = "channels"
+
+// answer the pseudo scene whose rate limit applies to channel sets
+func (ps *PresetsService) setScene() *model.Scene {
+	site := "site"
+	scope, _, _, _ := ps.parseScope(&site)
+	return &model.Scene{ID: channelSets, Scope: scope}
+}
+
+// answer a ScopeLockedError if a scope that contains any of the target things, i.e. the site, the
+// room of the thing or a zone that contains the room, is held by a lock with a priority higher than
+// 0, the priority of a set. The caller must hold the mutex.
+func (ps *PresetsService) checkSetLocks(targets []model.ThingState, things []*nmodel.Thing) error {
+	located := make(map[string]string)
+	for _, t := range things {
+		if t.Location != nil {
+			located[t.ID] = *t.Location
+		}
+	}
+	scopes := make(map[string]bool)
+	for _, t := range targets {
+		if room, ok := located[t.ID]; ok {
+			scopes["room:"+room] = true
+			for _, z := range ps.Model.Zones {
+				for _, r := range z.Rooms {
+					if r == room {
+						scopes["zone:"+z.ID] = true
+					}
+				}
+			}
+		}
+	}
+	ordered := []string{ps.setScene().Scope}
+	for scope := range scopes {
+		ordered = append(ordered, scope)
+	}
+	sort.Strings(ordered[1:])
+
+	now := ps.clock().Now()
+	for _, scope := range ordered {
+		if lock := ps.activeLock(scope, now); !permits(lock, "", 0) {
+			return &ScopeLockedError{
+				Lock:   lock,
+				Reason: fmt.Sprintf("scope %s is locked with priority %d, so the channels in it cannot be set", scope, lock.Priority),
+			}
+		}
+	}
+	return nil
+}
+
+// answer the undo states recorded by the sets that were performed within the coalescing window
+// before the specified time and have not been undone, keyed by thing and channel. The undo state of
+// the earliest such set is kept for each channel, since the later sets may have recorded the state
+// set by an earlier one. The caller must hold the mutex.
+func (ps *PresetsService) coalescedSets(now time.Time) map[string]interface{} {
+	result := make(map[string]interface{})
+	for i := len(ps.Model.Sets) - 1; i >= 0; i-- {
+		set := ps.Model.Sets[i]
+		if set.Report == nil || now.Sub(set.Report.Applied) >= ps.coalesce {
+			break
+		}
+		if set.Undone == nil {
+			for key, state := range undoStates(set.Things) {
+				result[key] = state
+			}
+		}
+	}
+	return result
+}
+
+// see: http://schema.ninjablocks.com/service/presets#setChannels
+func (ps *PresetsService) SetChannels(r *model.SetRequest) (*model.SetResult, error) {
+	return ps.rpcSession().SetChannels(r)
+}
+
+// set the channels in the same way as the channels of a scene are set when it is applied: subject to
+// the locks of the scopes that contain the things and, if limited, to the rate limit of sets,
+// keeping the undo states of sets performed moments ago and superseding any pending set of the same
+// channel. The previous states of the channels are recorded so that the set can be undone.
+func (ps *PresetsService) setChannels(r *model.SetRequest, holder string, limited bool) (*model.SetResult, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if len(r.Channels) == 0 {
+		return nil, fmt.Errorf("illegal argument: no channels were specified")
+	}
+
+	// group the channels by thing, in the order in which they were specified. a later state of a
+	// channel replaces an earlier one.
+	targets := make([]model.ThingState, 0, len(r.Channels))
+	index := make(map[string]int)
+	for i, c := range r.Channels {
+		if c.Thing == "" || c.Channel == "" || c.State == nil {
+			return nil, fmt.Errorf("illegal argument: channel %d: thing, channel and state must be specified", i)
+		}
+		t, ok := index[c.Thing]
+		if !ok {
+			t = len(targets)
+			index[c.Thing] = t
+			targets = append(targets, model.ThingState{ID: c.Thing, Channels: make([]model.ChannelState, 0, 1)})
+		}
+		replaced := false
+		for j := range targets[t].Channels {
+			if targets[t].Channels[j].ID == c.Channel {
+				targets[t].Channels[j].State = c.State
+				replaced = true
+			}
+		}
+		if !replaced {
+			targets[t].Channels = append(targets[t].Channels, model.ChannelState{ID: c.Channel, State: c.State})
+		}
+	}
+
+	// the locations of the things determine the locks that apply to the set
+	located, err := ps.fetchThingsInScope(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch things: %v", err)
+	}
+	report := &model.ApplyReport{Applied: time.Now()}
+	ps.mutex.Lock()
+	if err := ps.checkSetLocks(targets, located); err != nil {
+		ps.mutex.Unlock()
+		return nil, err
+	}
+	if err := ps.takeToken(ps.setScene(), limited); err != nil {
+		ps.mutex.Unlock()
+		return nil, err
+	}
+	kept := ps.coalescedSets(report.Applied)
+	ps.mutex.Unlock()
+
+	things := ps.prepareTargets(targets, kept, report)
+	if err := ps.enqueueStates(things); err != nil {
+		return nil, err
+	}
+	result := &model.SetResult{
+		ID:     uuid.NewUUID().String(),
+		Things: targets,
+		Report: report,
+		Holder: holder,
+	}
+	ps.metrics.operations.Inc("", "set")
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.Model.Sets = append(ps.Model.Sets, result)
+	if len(ps.Model.Sets) > retainedSets {
+		ps.Model.Sets = ps.Model.Sets[len(ps.Model.Sets)-retainedSets:]
+	}
+	ps.save()
+	return result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#undoChannels
+func (ps *PresetsService) UndoChannels(id string) (*model.SetResult, error) {
+	return ps.rpcSession().UndoChannels(id)
+}
+
+// restore the channels of the set to their previous states, unless they have been modified since.
+// A set can only be undone once.
+func (ps *PresetsService) undoChannels(id string) (*model.SetResult, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	x := -1
+	for i, s := range ps.Model.Sets {
+		if s.ID == id {
+			x = i
+		}
+	}
+	if x < 0 {
+		ps.mutex.Unlock()
+		return nil, fmt.Errorf("failed to find a matching set: %s", id)
+	}
+	set := ps.Model.Sets[x]
+	if set.Undone != nil {
+		ps.mutex.Unlock()
+		return nil, &SetUndoneError{ID: id, Undone: *set.Undone}
+	}
+	if err := ps.takeToken(ps.setScene(), true); err != nil {
+		ps.mutex.Unlock()
+		return nil, err
+	}
+
+	// the set is marked as undone, in a copy that replaces it, before its channels are restored so
+	// that concurrent requests cannot undo it twice
+	undone := *set
+	now := time.Now()
+	undone.Undone = &now
+	ps.Model.Sets[x] = &undone
+	ps.save()
+	ps.mutex.Unlock()
+
+	if err := ps.enqueueUndo(set.Things); err != nil {
+		return nil, err
+	}
+	ps.metrics.operations.Inc("", "undo")
+	return &undone, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchChannelSets
+func (ps *PresetsService) FetchChannelSets() (*[]*model.SetResult, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	result := make([]*model.SetResult, len(ps.Model.Sets))
+	copy(result, ps.Model.Sets)
+	return &result, nil
+}
+
+// answer the normalized scope of the selector and the selected channels, with the current state
+// of each channel as its undo state
+func (ps *PresetsService) selectChannels(sel *model.Selector) (string, []model.ThingState, error) {
+	if sel.Schema == "" {
+		return "", nil, fmt.Errorf("illegal argument: the selector must specify a schema")
+	}
+	tags := normalizeTags(sel.Tags)
+	scope := sel.Scope
+	if scope == "" {
+		scope = "site"
+	}
+	scope, rooms, _, err := ps.parseScope(&scope)
+	if err != nil {
+		return "", nil, err
+	}
+	things, err := ps.fetchThingsInScope(rooms)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the channels of the scenes that have every tag, keyed by thing and channel
+	var tagged map[string]bool
+	if len(tags) > 0 {
+		tagged = make(map[string]bool)
+		ps.mutex.Lock()
+	Scenes:
+		for _, scene := range ps.Model.Scenes {
+			for _, tag := range tags {
+				if !hasTag(scene, tag) {
+					continue Scenes
+				}
+			}
+			for _, t := range scene.Things {
+				for _, c := range t.Channels {
+					tagged[t.ID+"/"+c.ID] = true
+				}
+			}
+		}
+		ps.mutex.Unlock()
+	}
+
+	result := make([]model.ThingState, 0, len(things))
+	for _, t := range things {
+		if sel.Type != "" && t.Type != sel.Type {
+			continue
+		}
+		current := ps.createThingState(t)
+		if current == nil {
+			continue
+		}
+		schemas := make(map[string]string)
+		for _, c := range *t.Device.Channels {
+			schemas[c.ID] = c.Schema
+		}
+		selected := model.ThingState{ID: t.ID, Channels: make([]model.ChannelState, 0, len(current.Channels))}
+		for _, c := range current.Channels {
+			schema := schemas[c.ID]
+			if schema != sel.Schema && path.Base(schema) != sel.Schema {
+				continue
+			}
+			if tagged != nil && !tagged[t.ID+"/"+c.ID] {
+				continue
+			}
+			selected.Channels = append(selected.Channels, model.ChannelState{ID: c.ID, UndoState: c.State})
+		}
+		if len(selected.Channels) > 0 {
+			result = append(result, selected)
+		}
+	}
+	return scope, result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#previewGroup
+func (ps *PresetsService) PreviewGroup(r *model.GroupRequest) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if r.State == nil {
+		return nil, fmt.Errorf("illegal argument: state must be specified")
+	}
+	scope, things, err := ps.selectChannels(&r.Selector)
+	if err != nil {
+		return nil, err
+	}
+	for i := range things {
+		for j := range things[i].Channels {
+			things[i].Channels[j].State = r.State
+		}
+	}
+	return &model.Scene{Scope: scope, Things: things}, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#applyGroup
+func (ps *PresetsService) ApplyGroup(r *model.GroupRequest) (*model.SetResult, error) {
+	return ps.rpcSession().ApplyGroup(r)
+}
+
+// set every selected channel to the state of the request, in the same way as setChannels, so that
+// the result can be undone with undoChannels
+func (ps *PresetsService) applyGroup(r *model.GroupRequest, holder string) (*model.SetResult, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if r.State == nil {
+		return nil, fmt.Errorf("illegal argument: state must be specified")
+	}
+	_, things, err := ps.selectChannels(&r.Selector)
+	if err != nil {
+		return nil, err
+	}
+	request := &model.SetRequest{Channels: make([]model.ChannelSet, 0)}
+	for _, t := range things {
+		for _, c := range t.Channels {
+			request.Channels = append(request.Channels, model.ChannelSet{Thing: t.ID, Channel: c.ID, State: r.State})
+		}
+	}
+	if len(request.Channels) == 0 {
+		return nil, fmt.Errorf("no channels match the selector")
+	}
+	return ps.setChannels(request, holder, true)
+}
@@ -0,0 +1,33 @@
+package service
+
+import "time"
+
+// A Clock tells the time and runs functions once a duration has elapsed. The service uses the
+// system clock unless another clock is specified, e.g. a fake clock in tests.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is started by a Clock and can be stopped before it fires.
+type Timer interface {
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// answer the clock of the service
+func (ps *PresetsService) clock() Clock {
+	if ps.Clock == nil {
+		return systemClock{}
+	}
+	return ps.Clock
+}
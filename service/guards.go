@@ -0,0 +1,93 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/ninjasphere/app-presets/guard"
+	nmodel "github.com/ninjasphere/go-ninja/model"
+)
+
+// a guardEnvironment answers the live states of things to the guards evaluated during a single
+// apply. Things other than the guarded thing are fetched at most once per apply.
+type guardEnvironment struct {
+	client  serviceClient
+	things  map[string]*nmodel.Thing
+	thing   *nmodel.Thing
+	channel string
+}
+
+func newGuardEnvironment(client serviceClient) *guardEnvironment {
+	return &guardEnvironment{
+		client: client,
+		things: make(map[string]*nmodel.Thing),
+	}
+}
+
+// answer an error if the specified guard is not a valid expression
+func validateGuard(source string) error {
+	if source == "" {
+		return nil
+	}
+	if _, err := guard.Parse(source); err != nil {
+		return fmt.Errorf("illegal argument: bad guard '%s': %v", source, err)
+	}
+	return nil
+}
+
+// evaluate the specified guard of the specified thing, or of one of its channels if channel is not
+// empty. Answers true if the guard is empty or satisfied, otherwise false and the reason why not.
+func (e *guardEnvironment) check(source string, thing *nmodel.Thing, channel string) (bool, string) {
+	if source == "" {
+		return true, ""
+	}
+	expr, err := guard.Parse(source)
+	if err != nil {
+		return false, fmt.Sprintf("bad guard '%s': %v", source, err)
+	}
+	e.thing = thing
+	e.channel = channel
+	if ok, err := expr.Evaluate(e); err != nil {
+		return false, fmt.Sprintf("guard '%s' failed: %v", source, err)
+	} else if !ok {
+		return false, fmt.Sprintf("guard '%s' not satisfied", source)
+	}
+	return true, ""
+}
+
+func (e *guardEnvironment) State() (interface{}, error) {
+	if e.channel == "" {
+		return nil, fmt.Errorf("'state' cannot be used in the guard of a thing")
+	}
+	return channelState(e.thing, e.channel)
+}
+
+func (e *guardEnvironment) Channel(id string) (interface{}, error) {
+	return channelState(e.thing, id)
+}
+
+func (e *guardEnvironment) Thing(thingID string, channelID string) (interface{}, error) {
+	if thingID == e.thing.ID {
+		return channelState(e.thing, channelID)
+	}
+	thing, ok := e.things[thingID]
+	if !ok {
+		thing = &nmodel.Thing{}
+		if err := e.client.Call("fetch", []string{thingID}, &thing, defaultTimeout); err != nil {
+			return nil, fmt.Errorf("failed to obtain thing '%s': %v", thingID, err)
+		}
+		e.things[thingID] = thing
+	}
+	return channelState(thing, channelID)
+}
+
+// answer the last state of the specified channel of a thing
+func channelState(thing *nmodel.Thing, channelID string) (interface{}, error) {
+	if thing.Device != nil && thing.Device.Channels != nil {
+		for _, c := range *thing.Device.Channels {
+			if c.ID == channelID {
+				return copyState(c), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("thing '%s' has no channel '%s'", thing.ID, channelID)
+}
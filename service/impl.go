@@ -7,38 +7,108 @@ import (
 	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/logger"
 	nmodel "github.com/ninjasphere/go-ninja/model"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
+// the known ranges of numeric channels, keyed by the last element of the channel schema
+var channelRanges = map[string][2]float64{
+	"brightness": {0, 1},
+	"volume":     {0, 1},
+}
+
+// serviceClient is the subset of the *ninja.ServiceClient interface used by the service.
+type serviceClient interface {
+	Call(method string, args interface{}, reply interface{}, timeout time.Duration) error
+}
+
 type task struct {
-	topic   string
-	method  string
-	payload interface{}
+	thing     string // the id of the thing whose channel is called
+	topic     string
+	method    string
+	payload   interface{}
+	queued    time.Time
+	cancelled bool // true if the task has been superseded by a newer task for the same channel
 }
 
-func (ps *PresetsService) worker() {
-	for {
-		select {
-		case w := <-ps.queue:
-			if w == nil {
-				return
-			}
-			client := ps.Conn.GetServiceClient(w.topic)
-			if err := client.Call(w.method, w.payload, nil, defaultTimeout); err != nil {
-				ps.Log.Warningf("Call to %s of %s with %v failed: %v", w.method, w.topic, w.payload, err)
-			}
+// perform queued tasks until the queue is closed and drained
+func (ps *PresetsService) worker(queue chan *task) {
+	defer ps.workers.Done()
+	for w := range queue {
+		ps.metrics.queueWait.Since(w.queued)
+		if !ps.release(w) {
+			continue
 		}
+		client := ps.getServiceClient(w.topic)
+		start := time.Now()
+		err := client.Call(w.method, w.payload, nil, defaultTimeout)
+		ps.metrics.setLatency.Since(start, w.thing)
+		if err != nil {
+			ps.Log.Warningf("Call to %s of %s with %v failed: %v", w.method, w.topic, w.payload, err)
+			ps.metrics.setErrors.Inc(w.thing)
+			ps.recordFailure(w, err)
+		}
+	}
+}
+
+// queue a task for a worker, unless the service is being destroyed
+func (ps *PresetsService) enqueue(t *task) error {
+	ps.lifecycle.RLock()
+	defer ps.lifecycle.RUnlock()
+	if ps.stopping {
+		return fmt.Errorf("illegal state: the service is stopping")
+	}
+	t.queued = time.Now()
+	if t.method == "set" {
+		ps.supersede(t)
 	}
+	ps.queue <- t
+	return nil
 }
 
-// check that the service has been initialized
-func (ps *PresetsService) checkInit() {
+// answer a client for the specified service topic
+func (ps *PresetsService) getServiceClient(topic string) serviceClient {
+	if ps.client != nil {
+		return ps.client(topic)
+	}
+	return ps.Conn.GetServiceClient(topic)
+}
+
+// answer a client for the thing model service
+func (ps *PresetsService) thingModel() serviceClient {
+	return &timedClient{ps.getServiceClient("$home/services/ThingModel"), ps.metrics.thingLatency}
+}
+
+// send an event from the presets service
+func (ps *PresetsService) sendEvent(event string, payload interface{}) {
+	if ps.notify != nil {
+		ps.notify(event, payload)
+	} else if ps.exported != nil {
+		if err := ps.exported.SendEvent(event, payload); err != nil {
+			ps.Log.Warningf("failed to send %s event: %v", event, err)
+		}
+	}
+}
+
+// answer an error if the service has not been initialized, or has been destroyed
+func (ps *PresetsService) checkInit() error {
 	if ps.Log == nil {
 		ps.Log = logger.GetLogger("com.ninja.app-presets")
 	}
-	if !ps.initialized {
-		ps.Log.Fatalf("illegal state: the service is not initialized")
+	if !ps.isInitialized() {
+		return fmt.Errorf("illegal state: the service is not initialized")
 	}
+	return nil
+}
+
+// answer true if the service has been initialized and not destroyed since
+func (ps *PresetsService) isInitialized() bool {
+	ps.lifecycle.RLock()
+	defer ps.lifecycle.RUnlock()
+	return ps.initialized
 }
 
 // make a copy of the channel's state, or nil if there is no such state
@@ -53,27 +123,37 @@ func copyState(ch *nmodel.Channel) interface{} {
 	return nil
 }
 
-// parse a scope parameter and return the normalized form and the components
-func (ps *PresetsService) parseScope(scope *string) (string, string, string, error) {
+// parse a scope parameter and return the normalized form and the components. The rooms
+// of a site scope are nil, meaning all rooms.
+func (ps *PresetsService) parseScope(scope *string) (string, []string, string, error) {
 	var err error
-	room := ""
+	var rooms []string
 	siteID := ""
 	resultScope := ""
 
 	if scope == nil || *scope == "" {
-		return "", "", "", nil
+		return "", nil, "", nil
 	}
 	resultScope = *scope
 	parts := strings.Split(resultScope, ":")
 	if len(parts) > 2 {
 		err = fmt.Errorf("illegal argument: scope has too many parts")
 	} else {
-		if len(parts) == 0 {
-			parts = []string{"site"}
-		}
 		switch parts[0] {
 		case "room":
-			room = parts[1]
+			if len(parts) < 2 || parts[1] == "" {
+				err = fmt.Errorf("illegal argument: room scope has no room id")
+			} else {
+				rooms = []string{parts[1]}
+			}
+		case "zone":
+			if len(parts) < 2 || parts[1] == "" {
+				err = fmt.Errorf("illegal argument: zone scope has no zone id")
+			} else if zone := ps.lookupZone(parts[1]); zone == nil {
+				err = fmt.Errorf("illegal argument: no such zone: %s", parts[1])
+			} else {
+				rooms = append(make([]string, 0, len(zone.Rooms)), zone.Rooms...)
+			}
 		case "site":
 			siteID = config.MustString("siteId")
 			if len(parts) == 2 && parts[1] != siteID {
@@ -86,48 +166,284 @@ func (ps *PresetsService) parseScope(scope *string) (string, string, string, err
 		}
 	}
 	if err != nil {
-		ps.Log.Errorf("bad scope: %s: %v", scope, err)
+		ps.Log.Errorf("bad scope: %s: %v", *scope, err)
 	}
-	return resultScope, room, siteID, err
+	return resultScope, rooms, siteID, err
 
 }
 
 // find the indicies of all matching scenes
 func (ps *PresetsService) match(spec *model.Query) []int {
+	found, err := ps.filter(spec)
+	if err != nil {
+		ps.Log.Errorf("bad query: %v", err)
+		return []int{}
+	}
+	return found
+}
+
+// find the indicies of all the scenes that satisfy every criterion of the query, except for the room
+// criterion, which requires the thing model. Answers an error if the query is invalid.
+func (ps *PresetsService) filter(spec *model.Query) ([]int, error) {
 	found := make([]int, 0, len(ps.Model.Scenes))
 
 	if spec.Scope != nil && *spec.Scope == "" {
 		spec.Scope = nil
 	}
 
-	matchAll := spec.Scope == nil && spec.ID == nil && spec.Slot == nil
+	var label string
+	if spec.Label != nil {
+		label = strings.ToLower(*spec.Label)
+	}
+
+	var description string
+	if spec.Description != nil {
+		description = strings.ToLower(*spec.Description)
+	}
+
+	var labelRegex *regexp.Regexp
+	if spec.LabelRegex != nil {
+		var err error
+		if labelRegex, err = regexp.Compile(*spec.LabelRegex); err != nil {
+			return nil, fmt.Errorf("illegal argument: bad label regex: %v", err)
+		}
+	}
 
+Scenes:
 	for i, m := range ps.Model.Scenes {
+		switch {
+		case spec.Scope != nil && m.Scope != *spec.Scope,
+			spec.Slot != nil && m.Slot != *spec.Slot,
+			spec.ID != nil && m.ID != *spec.ID,
+			spec.Label != nil && !strings.Contains(strings.ToLower(m.Label), label),
+			labelRegex != nil && !labelRegex.MatchString(m.Label),
+			spec.Description != nil && !strings.Contains(strings.ToLower(m.Description), description),
+			spec.Icon != nil && m.Icon != *spec.Icon,
+			spec.Color != nil && !strings.EqualFold(m.Color, *spec.Color),
+			spec.Favorite != nil && m.Favorite != *spec.Favorite,
+			spec.Property != nil && !hasProperty(m, *spec.Property),
+			spec.ModifiedSince != nil && m.Modified.Before(*spec.ModifiedSince),
+			(spec.Thing != nil || spec.Channel != nil) && !containsChannel(m, spec.Thing, spec.Channel):
+			continue Scenes
+		}
+		for _, tag := range spec.Tags {
+			if !hasTag(m, tag) {
+				continue Scenes
+			}
+		}
+		found = append(found, i)
+	}
+	return found, nil
+}
 
-		if matchAll {
-			found = append(found, i)
-		} else {
-			// look for the index of all matching scenes
-
-			if spec.Scope != nil && m.Scope == *spec.Scope {
-				if spec.Slot != nil {
-					if m.Slot == *spec.Slot {
-						found = append(found, i)
-						continue
-					}
-				} else {
-					found = append(found, i)
-					continue
-				}
+// answer true if the scene contains the specified thing, or a channel with the specified id,
+// or both if both are specified
+func containsChannel(m *model.Scene, thingID *string, channelID *string) bool {
+	for _, t := range m.Things {
+		if thingID != nil && t.ID != *thingID {
+			continue
+		}
+		if channelID == nil {
+			return true
+		}
+		for _, ch := range t.Channels {
+			if ch.ID == *channelID {
+				return true
 			}
+		}
+	}
+	return false
+}
 
-			if spec.ID != nil && m.ID == *spec.ID {
-				found = append(found, i)
-				continue
+// answer true if the scene has the specified tag
+func hasTag(m *model.Scene, tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// answer true if the scene has the specified client property
+func hasProperty(m *model.Scene, name string) bool {
+	_, ok := m.Properties[name]
+	return ok
+}
+
+// answer the specified tags without surrounding white space, empty tags or duplicates
+func normalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	result := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t != "" && !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+var colorPattern = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// answer an error if the color is neither empty nor of the form #rrggbb
+func validateColor(color string) error {
+	if color != "" && !colorPattern.MatchString(color) {
+		return fmt.Errorf("illegal argument: color must be of the form #rrggbb: %s", color)
+	}
+	return nil
+}
+
+// sort the specified indicies of scenes by the specified key. A key prefixed with '-' sorts
+// in descending order. An empty key leaves the indicies in the order in which the scenes are stored.
+func (ps *PresetsService) sortScenes(selection []int, key string) error {
+	descending := strings.HasPrefix(key, "-")
+	key = strings.TrimPrefix(key, "-")
+
+	var less func(a, b *model.Scene) bool
+	switch key {
+	case "":
+		return nil
+	case "slot":
+		less = func(a, b *model.Scene) bool {
+			return a.Scope < b.Scope || (a.Scope == b.Scope && a.Slot < b.Slot)
+		}
+	case "label":
+		less = func(a, b *model.Scene) bool { return strings.ToLower(a.Label) < strings.ToLower(b.Label) }
+	case "modified":
+		less = func(a, b *model.Scene) bool { return a.Modified.Before(b.Modified) }
+	default:
+		return fmt.Errorf("illegal argument: unrecognized sort order: %s", key)
+	}
+
+	sort.Stable(&sceneSorter{
+		selection: selection,
+		less: func(i, j int) bool {
+			a, b := ps.Model.Scenes[selection[i]], ps.Model.Scenes[selection[j]]
+			if descending {
+				return less(b, a)
 			}
+			return less(a, b)
+		},
+	})
+	return nil
+}
+
+// orders tag counts by descending count, then by tag
+type byCount []*model.TagCount
+
+func (a byCount) Len() int      { return len(a) }
+func (a byCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byCount) Less(i, j int) bool {
+	return a[i].Count > a[j].Count || (a[i].Count == a[j].Count && a[i].Tag < a[j].Tag)
+}
+
+type sceneSorter struct {
+	selection []int
+	less      func(i, j int) bool
+}
+
+func (s *sceneSorter) Len() int           { return len(s.selection) }
+func (s *sceneSorter) Swap(i, j int)      { s.selection[i], s.selection[j] = s.selection[j], s.selection[i] }
+func (s *sceneSorter) Less(i, j int) bool { return s.less(i, j) }
+
+// answer the scene with the specified id, or nil if there is no such scene
+func (ps *PresetsService) lookupScene(id string) *model.Scene {
+	for _, m := range ps.Model.Scenes {
+		if m.ID == id {
+			return m
 		}
 	}
-	return found
+	return nil
+}
+
+// answer the zone with the specified id, or nil if there is no such zone
+func (ps *PresetsService) lookupZone(id string) *model.Zone {
+	for _, z := range ps.Model.Zones {
+		if z.ID == id {
+			return z
+		}
+	}
+	return nil
+}
+
+// answer the indicies of the scenes that match the query, sorted and paginated as
+// specified by the query
+func (ps *PresetsService) selectScenes(q *model.Query) ([]int, error) {
+	if q.Offset < 0 || q.Limit < 0 {
+		return nil, fmt.Errorf("illegal argument: offset and limit cannot be negative")
+	}
+
+	found, err := ps.filter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Room != nil {
+		if found, err = ps.filterByRoom(found, *q.Room); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ps.sortScenes(found, q.Sort); err != nil {
+		return nil, err
+	}
+
+	if q.Offset >= len(found) {
+		return []int{}, nil
+	}
+	found = found[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(found) {
+		found = found[:q.Limit]
+	}
+	return found, nil
+}
+
+// answer the subset of the selected scenes that touch the specified room
+func (ps *PresetsService) filterByRoom(found []int, room string) ([]int, error) {
+
+	things := make([]*nmodel.Thing, 0)
+	if err := ps.thingModel().Call("fetchAll", nil, &things, defaultTimeout); err != nil {
+		return nil, fmt.Errorf("failed to fetch things: %v", err)
+	}
+	locations := make(map[string]string)
+	for _, t := range things {
+		if t.Location != nil {
+			locations[t.ID] = *t.Location
+		}
+	}
+
+	result := make([]int, 0, len(found))
+	for _, x := range found {
+		if ps.touchesRoom(ps.Model.Scenes[x], room, locations) {
+			result = append(result, x)
+		}
+	}
+	return result, nil
+}
+
+// answer true if the scene is scoped to the specified room or if any of the scene's things, or
+// the things of the scenes it includes, are located in the room
+func (ps *PresetsService) touchesRoom(scene *model.Scene, room string, locations map[string]string) bool {
+	if scene.Scope == "room:"+room {
+		return true
+	}
+	things := scene.Things
+	if len(scene.Includes) > 0 {
+		if resolved, err := scene.Resolve(ps.lookupScene); err == nil {
+			things = resolved
+		}
+	}
+	for _, t := range things {
+		if locations[t.ID] == room {
+			return true
+		}
+	}
+	return false
 }
 
 // make a copy of the specified scenes
@@ -144,6 +460,8 @@ func (ps *PresetsService) deleteAll(selection []int) []*model.Scene {
 	// no two scenes can have the same slot,scope or id.
 	// delete the duplicates
 
+	selection = append(make([]int, 0, len(selection)), selection...)
+	sort.Ints(selection)
 	result := make([]*model.Scene, len(selection))
 
 	j := 0
@@ -165,25 +483,45 @@ func (ps *PresetsService) deleteAll(selection []int) []*model.Scene {
 
 // create a ThingState object from a thing.
 func (ps *PresetsService) createThingState(t *nmodel.Thing) *model.ThingState {
+	thingState, _ := ps.inspectThing(t, nil)
+	return thingState
+}
+
+// create a ThingState object from a thing, restricted to the channels with the specified schemas, if
+// any are specified. Answers the thing state, or nil if no channels are included, together with the
+// channels that were not included and the reasons why.
+func (ps *PresetsService) inspectThing(t *nmodel.Thing, schemas map[string]bool) (*model.ThingState, []model.SkippedChannel) {
+	skipped := make([]model.SkippedChannel, 0)
 	if t.Device == nil || t.Device.Channels == nil {
-		return nil
+		skipped = append(skipped, model.SkippedChannel{Thing: t.ID, Reason: "thing has no channels"})
+		return nil, skipped
 	}
 	thingState := model.ThingState{
 		ID:       t.ID,
 		Channels: make([]model.ChannelState, 0, len(*t.Device.Channels)),
 	}
+	skip := func(c *nmodel.Channel, reason string) {
+		skipped = append(skipped, model.SkippedChannel{Thing: t.ID, Channel: c.ID, Reason: reason})
+	}
 Channels:
 	for _, c := range *t.Device.Channels {
 
 		for _, x := range excludedChannels {
 			// don't include channels with excluded schema
 			if x == c.Schema {
+				skip(c, "channel schema is excluded")
 				continue Channels
 			}
 		}
 
+		if len(schemas) > 0 && !schemas[c.Schema] {
+			skip(c, "channel schema was not requested")
+			continue
+		}
+
 		if c.SupportedMethods == nil {
 			// don't include channels with no supported methods
+			skip(c, "channel has no supported methods")
 			continue
 		}
 
@@ -196,10 +534,12 @@ Channels:
 		}
 		if !found {
 			// don't include channels that do not support the set method
+			skip(c, "channel does not support set")
 			continue
 		}
 		state := copyState(c)
 		if state == nil {
+			skip(c, "channel has no state")
 			continue
 		}
 		channelState := model.ChannelState{
@@ -210,8 +550,186 @@ Channels:
 	}
 
 	if len(thingState.Channels) == 0 {
-		return nil
+		return nil, skipped
+	}
+
+	return &thingState, skipped
+}
+
+// fetch the promoted things located in any of the specified rooms, or in any room if rooms is nil
+func (ps *PresetsService) fetchThingsInScope(rooms []string) ([]*nmodel.Thing, error) {
+	things := make([]*nmodel.Thing, 0)
+	if err := ps.thingModel().Call("fetchAll", nil, &things, defaultTimeout); err != nil {
+		return nil, err
+	}
+
+	inScope := make(map[string]bool)
+	for _, r := range rooms {
+		inScope[r] = true
+	}
+
+	keptThings := make([]*nmodel.Thing, 0, len(things))
+	for _, t := range things {
+		if !t.Promoted ||
+			(rooms != nil && (t.Location == nil || !inScope[*t.Location])) {
+			continue
+		}
+		keptThings = append(keptThings, t)
+	}
+	return keptThings, nil
+}
+
+// prepare a thing state to be applied by evaluating its guards against the live states of things and
+// by computing the states of its relative channels from the undo states, which hold the current states
+// of the thing's channels. Answers the channel states to be set. The channels that are not to be set
+// are recorded in the report, together with the reason they were skipped.
+func (ps *PresetsService) prepareThingState(t *model.ThingState, thing *nmodel.Thing, env *guardEnvironment, report *model.ApplyReport) *model.ThingState {
+	result := &model.ThingState{
+		ID:       t.ID,
+		Channels: make([]model.ChannelState, 0, len(t.Channels)),
+	}
+	if ok, reason := env.check(t.Guard, thing, ""); !ok {
+		report.Skipped = append(report.Skipped, model.SkippedChannel{Thing: t.ID, Reason: reason})
+		return result
+	}
+	for i := range t.Channels {
+		ch := &t.Channels[i]
+		if ok, reason := env.check(ch.Guard, thing, ch.ID); !ok {
+			report.Skipped = append(report.Skipped, model.SkippedChannel{Thing: t.ID, Channel: ch.ID, Reason: reason})
+			continue
+		}
+		if ch.Adjust != nil {
+			min, max := channelRange(thing, ch.ID)
+			if state, err := adjust(ch.Adjust, ch.UndoState, min, max); err != nil {
+				ps.Log.Warningf("Cannot adjust thing ID, channelID: %s, %s: %v. Channel ignored.", t.ID, ch.ID, err)
+				report.Skipped = append(report.Skipped, model.SkippedChannel{
+					Thing:   t.ID,
+					Channel: ch.ID,
+					Reason:  fmt.Sprintf("cannot adjust state: %v", err),
+				})
+				continue
+			} else {
+				ch.State = state
+			}
+		}
+		result.Channels = append(result.Channels, *ch)
+	}
+	return result
+}
+
+// fetch the things of the target states and record their current states in the targets as undo
+// states, except those kept from an earlier apply, keyed by thing and channel. Relative states are
+// computed from the current states, even if undo states are kept, so that each apply adjusts the
+// channels again. Answers the channel states to be set. The things that cannot be fetched, and the
+// channels that are not to be set, are recorded in the report.
+func (ps *PresetsService) prepareTargets(targets []model.ThingState, kept map[string]interface{}, report *model.ApplyReport) []*model.ThingState {
+	thingClient := ps.thingModel()
+	env := newGuardEnvironment(thingClient)
+	things := make([]*model.ThingState, 0, len(targets))
+	for i, t := range targets {
+		thing := &nmodel.Thing{}
+		if err := thingClient.Call("fetch", []string{t.ID}, &thing, defaultTimeout); err != nil {
+			ps.Log.Errorf("failed to obtain thing '%s': %v", t.ID, err)
+			report.Skipped = append(report.Skipped, model.SkippedChannel{
+				Thing:  t.ID,
+				Reason: fmt.Sprintf("failed to obtain thing: %v", err),
+			})
+			continue
+		}
+		current := ps.createThingState(thing)
+		targets[i] = *t.MergeUndoState(current)
+		things = append(things, ps.prepareThingState(&targets[i], thing, env, report))
+		for j, c := range targets[i].Channels {
+			if undo, ok := kept[t.ID+"/"+c.ID]; ok {
+				targets[i].Channels[j].UndoState = undo
+			}
+		}
+	}
+	return things
+}
+
+// queue a task to set each channel of the thing states
+func (ps *PresetsService) enqueueStates(things []*model.ThingState) error {
+	for _, t := range things {
+		for _, c := range t.Channels {
+			if err := ps.enqueue(&task{
+				thing:   t.ID,
+				topic:   fmt.Sprintf("$thing/%s/channel/%s", t.ID, c.ID),
+				method:  "set",
+				payload: c.State,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// queue a task to restore the undo state of each channel of the applied thing states that has
+// not been modified since they were applied
+func (ps *PresetsService) enqueueUndo(applied []model.ThingState) error {
+	thingClient := ps.thingModel()
+	things := make([]*model.ThingState, 0, len(applied))
+	for _, t := range applied {
+
+		thing := &nmodel.Thing{}
+		if err := thingClient.Call("fetch", []string{t.ID}, &thing, defaultTimeout); err != nil {
+			ps.Log.Errorf("failed to obtain thing '%s': %v", t.ID, err)
+			continue
+		}
+		current := ps.createThingState(thing)
+
+		// only undo channels that have not been modified since the scene was applied.
+
+		matched := t.MatchState(current)
+		things = append(things, matched)
+	}
+
+	for _, t := range things {
+		for _, c := range t.Channels {
+			if c.UndoState != nil {
+				if err := ps.enqueue(&task{
+					thing:   t.ID,
+					topic:   fmt.Sprintf("$thing/%s/channel/%s", t.ID, c.ID),
+					method:  "set",
+					payload: c.UndoState,
+				}); err != nil {
+					return err
+				}
+			} else {
+				ps.Log.Warningf("No undo state found for thing ID, channelID: %s, %s. Channel undo ignored.", t.ID, c.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// answer the state that results from the adjustment of the current state of a channel with the
+// specified known range. The range of most channels is not known, so an adjustment that would
+// move the state of such a channel towards an unknown bound must specify that bound itself.
+func adjust(a *model.Adjustment, current interface{}, min *float64, max *float64) (interface{}, error) {
+	if a.Op == model.AdjustIncrease && max == nil && a.Max == nil {
+		return nil, fmt.Errorf("the range of the channel is not known, so max must be specified")
+	}
+	if a.Op == model.AdjustDecrease && min == nil && a.Min == nil {
+		return nil, fmt.Errorf("the range of the channel is not known, so min must be specified")
 	}
+	return a.Apply(current, min, max)
+}
 
-	return &thingState
+// answer the known range of the specified channel of a thing, or nil bounds if the range is not known
+func channelRange(thing *nmodel.Thing, channelID string) (*float64, *float64) {
+	name := channelID
+	if thing.Device != nil && thing.Device.Channels != nil {
+		for _, c := range *thing.Device.Channels {
+			if c.ID == channelID && c.Schema != "" {
+				name = path.Base(c.Schema)
+				break
+			}
+		}
+	}
+	if r, ok := channelRanges[name]; ok {
+		return &r[0], &r[1]
+	}
+	return nil, nil
 }
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+)
+
+// Authenticate answers the API key of the service that matches the specified key, or nil if
+// there is no such key.
+func Authenticate(ps *PresetsService, key string) *model.APIKey {
+	if key == "" {
+		return nil
+	}
+	hash := model.HashKey(key)
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for _, k := range ps.Model.Keys {
+		if k.Hash == hash {
+			result := *k
+			return &result
+		}
+	}
+	return nil
+}
+
+// BootstrapKey creates an API key named "bootstrap" with the admin role if the service has no
+// keys, and answers it, so that the first keys can be created. Only the hash of the key is saved,
+// so the key is answered only once. Answers "" if the service already has keys.
+func BootstrapKey(ps *PresetsService) (string, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if len(ps.Model.Keys) > 0 {
+		return "", nil
+	}
+	key, err := generateKey()
+	if err != nil {
+		return "", err
+	}
+	ps.Model.Keys = append(ps.Model.Keys, &model.APIKey{
+		Name:    "bootstrap",
+		Role:    model.RoleAdmin,
+		Hash:    model.HashKey(key),
+		Created: time.Now(),
+	})
+	ps.save()
+	return key, nil
+}
+
+// answer a new random key
+func generateKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// answer the index of the key with the specified name, or -1 if there is no such key.
+// ps.mutex must be held.
+func (ps *PresetsService) keyIndex(name string) int {
+	for i, k := range ps.Model.Keys {
+		if k.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+)
+
+// A RateLimitError is answered when a scene is applied or undone, or channels are set, more often
+// than the rate limit of the scene or of its scope permits.
+type RateLimitError struct {
+	ID         string
+	Scope      string // not empty if the limit of the scope was exceeded
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Scope != "" {
+		return fmt.Sprintf("too many scenes of scope %s have been applied: retry after %v", e.Scope, e.RetryAfter)
+	}
+	if e.ID == channelSets {
+		return fmt.Sprintf("channels have been set too often: retry after %v", e.RetryAfter)
+	}
+	return fmt.Sprintf("scene %s has been applied too often: retry after %v", e.ID, e.RetryAfter)
+}
+
+// rateLimiter limits the rate at which each scene, and the scenes of each scope, may be applied
+// or undone. Each scene and scope has a bucket of tokens that is refilled at the rate of its limit,
+// up to a burst of one second's worth of tokens. A rate of 0 means no limit. A full bucket is the
+// same as no bucket, so buckets that have refilled are evicted, including those of deleted scenes.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	sceneRate float64
+	scopeRate float64
+	buckets   map[string]*bucket // keyed by "scene:{id}" or "scope:{scope}"
+	swept     time.Time
+	now       func() time.Time
+}
+
+// the interval at which the buckets that have refilled are evicted
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	rate    float64
+	updated time.Time
+}
+
+func newRateLimiter(sceneRate float64, scopeRate float64) *rateLimiter {
+	return &rateLimiter{
+		sceneRate: sceneRate,
+		scopeRate: scopeRate,
+		buckets:   make(map[string]*bucket),
+		now:       time.Now,
+	}
+}
+
+// take a token for the scene and its scope, or answer a RateLimitError if either has none left.
+// No token is taken from either bucket unless both have one.
+func (l *rateLimiter) take(scene *model.Scene) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	sceneBucket := l.refill("scene:"+scene.ID, l.sceneRate, now)
+	scopeBucket := l.refill("scope:"+scene.Scope, l.scopeRate, now)
+	if sceneBucket != nil && sceneBucket.tokens < 1 {
+		return &RateLimitError{ID: scene.ID, RetryAfter: retryAfter(sceneBucket, l.sceneRate)}
+	}
+	if scopeBucket != nil && scopeBucket.tokens < 1 {
+		return &RateLimitError{ID: scene.ID, Scope: scene.Scope, RetryAfter: retryAfter(scopeBucket, l.scopeRate)}
+	}
+	if sceneBucket != nil {
+		sceneBucket.tokens--
+	}
+	if scopeBucket != nil {
+		scopeBucket.tokens--
+	}
+	return nil
+}
+
+// answer the bucket with the specified key, refilled at the specified rate, or nil if the rate
+// is unlimited. The caller must hold the mutex.
+func (l *rateLimiter) refill(key string, rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, rate)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, rate: rate, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	return b
+}
+
+// evict the buckets that have refilled, unless they were swept within the sweep interval. The
+// caller must hold the mutex.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.rate >= math.Max(1, b.rate) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// answer the time until the bucket will hold a token
+func retryAfter(b *bucket, rate float64) time.Duration {
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// take a token for the scene from the rate limiter, unless the operation is not limited
+func (ps *PresetsService) takeToken(scene *model.Scene, limited bool) error {
+	if !limited {
+		return nil
+	}
+	err := ps.limiter.take(scene)
+	if err != nil {
+		ps.metrics.limited.Inc(scene.Scope)
+	}
+	return err
+}
+
+// record a set task as the pending task of its channel, cancelling any task it supersedes
+func (ps *PresetsService) supersede(t *task) {
+	ps.pendingLock.Lock()
+	defer ps.pendingLock.Unlock()
+	if previous, ok := ps.pending[t.topic]; ok {
+		previous.cancelled = true
+		ps.metrics.cancelled.Inc()
+	}
+	ps.pending[t.topic] = t
+}
+
+// answer true if the task has not been cancelled and, if so, release it as the pending task of its
+// channel, so that it is performed
+func (ps *PresetsService) release(t *task) bool {
+	ps.pendingLock.Lock()
+	defer ps.pendingLock.Unlock()
+	if t.cancelled {
+		return false
+	}
+	if ps.pending[t.topic] == t {
+		delete(ps.pending, t.topic)
+	}
+	return true
+}
+
+// answer the undo states recorded by the specified thing states, keyed by thing and channel
+func undoStates(things []model.ThingState) map[string]interface{} {
+	result := make(map[string]interface{})
+	for _, t := range things {
+		for _, c := range t.Channels {
+			if c.UndoState != nil {
+				result[t.ID+"/"+c.ID] = c.UndoState
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+)
+
+// deferredActivation is an activation deferred until the lock of its scope is released, which
+// is then performed on behalf of the caller that requested it
+type deferredActivation struct {
+	request *model.ActivateRequest
+	caller  model.Caller
+}
+
+// A ScopeLockedError is answered when a scene cannot be applied, or a scope cannot be locked,
+// because the scope is held by a scene of a higher priority.
+type ScopeLockedError struct {
+	Lock   *model.ScopeLock
+	Reason string
+}
+
+func (e *ScopeLockedError) Error() string {
+	return e.Reason
+}
+
+// answer the reason an activation of the specified scene conflicts with the lock
+func lockReason(lock *model.ScopeLock, id string, priority int) string {
+	holder := "a lock"
+	if lock.Scene != "" {
+		holder = fmt.Sprintf("scene %s", lock.Scene)
+	}
+	until := "until it is released"
+	if lock.Expires != nil {
+		until = fmt.Sprintf("until %s", lock.Expires.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("scope %s is held by %s with priority %d, which is higher than the priority %d of scene %s, %s",
+		lock.Scope, holder, lock.Priority, priority, id, until)
+}
+
+// answer the lock of the scope, or nil if the scope is not locked or its lock has expired. The
+// caller must hold the mutex.
+func (ps *PresetsService) activeLock(scope string, now time.Time) *model.ScopeLock {
+	lock, ok := ps.Model.Locks[scope]
+	if !ok || lock.Expires != nil && !now.Before(*lock.Expires) {
+		return nil
+	}
+	return lock
+}
+
+// answer true if the lock, if any, permits the specified scene to be applied at the specified priority
+func permits(lock *model.ScopeLock, id string, priority int) bool {
+	return lock == nil || (id != "" && lock.Scene == id) || lock.Priority <= priority
+}
+
+// lock the scope on behalf of the scene for the specified number of seconds, or until it is
+// released if hold is negative, replacing any existing lock. The caller must hold the mutex.
+func (ps *PresetsService) acquireLock(scope string, id string, priority int, holder string, hold int, now time.Time) *model.ScopeLock {
+	lock := &model.ScopeLock{
+		Scope:    scope,
+		Scene:    id,
+		Priority: priority,
+		Holder:   holder,
+		Acquired: now,
+	}
+	if hold > 0 {
+		expires := now.Add(time.Duration(hold) * time.Second)
+		lock.Expires = &expires
+	}
+	if ps.Model.Locks == nil {
+		ps.Model.Locks = make(map[string]*model.ScopeLock)
+	}
+	ps.Model.Locks[scope] = lock
+	ps.armLock(lock, now)
+	ps.save()
+	ps.sendEvent("lock", &model.LockEvent{Scope: scope, Outcome: model.LockAcquired, Scene: id, Lock: lock})
+	return lock
+}
+
+// start a timer that expires the lock, if it has an expiry. The caller must hold the mutex.
+func (ps *PresetsService) armLock(lock *model.ScopeLock, now time.Time) {
+	if timer, ok := ps.timers[lock.Scope]; ok {
+		timer.Stop()
+		delete(ps.timers, lock.Scope)
+	}
+	if lock.Expires != nil {
+		ps.timers[lock.Scope] = ps.clock().AfterFunc(lock.Expires.Sub(now), func() {
+			ps.endLock(lock, model.LockExpired)
+		})
+	}
+}
+
+// remove the lock, if it is still the lock of its scope, and then perform the activation, if
+// any, that was deferred until the scope was released
+func (ps *PresetsService) endLock(lock *model.ScopeLock, outcome string) {
+	ps.mutex.Lock()
+	if !ps.isInitialized() || ps.Model.Locks[lock.Scope] != lock {
+		ps.mutex.Unlock()
+		return
+	}
+	delete(ps.Model.Locks, lock.Scope)
+	if timer, ok := ps.timers[lock.Scope]; ok {
+		timer.Stop()
+		delete(ps.timers, lock.Scope)
+	}
+	deferred := ps.deferred[lock.Scope]
+	delete(ps.deferred, lock.Scope)
+	ps.save()
+	ps.sendEvent("lock", &model.LockEvent{Scope: lock.Scope, Outcome: outcome, Scene: lock.Scene, Lock: lock})
+	ps.mutex.Unlock()
+
+	if deferred != nil {
+		session := NewSession(ps, deferred.caller)
+		if _, err := session.ActivateScene(deferred.request); err != nil {
+			ps.Log.Warningf("failed to apply deferred scene %s: %v", deferred.request.ID, err)
+		}
+	}
+}
+
+// see: http://schema.ninjablocks.com/service/presets#activateScene
+func (ps *PresetsService) ActivateScene(r *model.ActivateRequest) (*model.ActivateResult, error) {
+	return ps.rpcSession().ActivateScene(r)
+}
+
+// apply the scene of the request, unless its scope is held by a scene of a higher priority, and
+// hold its scope as requested, on behalf of the caller
+func (ps *PresetsService) activateScene(r *model.ActivateRequest, caller model.Caller) (*model.ActivateResult, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if r.ID == "" {
+		id, err := ps.sceneInSlot(&model.SlotRequest{Scope: r.Scope, Slot: r.Slot})
+		if err != nil {
+			return nil, err
+		}
+		r.ID = id
+	}
+	if r.Hold != nil && *r.Hold < -1 {
+		return nil, fmt.Errorf("illegal argument: hold must be -1 or more: %d", *r.Hold)
+	}
+
+	ps.mutex.Lock()
+	scene := ps.lookupScene(r.ID)
+	if scene == nil {
+		ps.mutex.Unlock()
+		return nil, fmt.Errorf("failed to find a matching scene: %s", r.ID)
+	}
+	scope := scene.Scope
+	priority := scene.Priority
+	if r.Manual && ps.manualPriority > priority {
+		priority = ps.manualPriority
+	}
+	hold := scene.Hold
+	if r.Hold != nil {
+		hold = *r.Hold
+	} else if hold == 0 && r.Manual {
+		hold = ps.manualHold
+	}
+
+	now := ps.clock().Now()
+	lock := ps.activeLock(scope, now)
+	if !permits(lock, scene.ID, priority) {
+		reason := lockReason(lock, scene.ID, priority)
+		event := &model.LockEvent{Scope: scope, Outcome: model.LockRejected, Scene: scene.ID, Reason: reason, Lock: lock}
+		if r.Defer {
+			if previous, ok := ps.deferred[scope]; ok && previous.request.ID != r.ID {
+				ps.Log.Infof("deferred activation of scene %s superseded by scene %s", previous.request.ID, r.ID)
+			}
+			deferred := *r
+			ps.deferred[scope] = &deferredActivation{request: &deferred, caller: caller}
+			event.Outcome = model.LockDeferred
+		}
+		ps.sendEvent("lock", event)
+		ps.mutex.Unlock()
+		if r.Defer {
+			return &model.ActivateResult{Scene: scene, Outcome: model.LockDeferred, Reason: reason, Lock: lock}, nil
+		}
+		return nil, &ScopeLockedError{Lock: lock, Reason: reason}
+	}
+
+	// the scope is locked before the scene is applied, so that no activation of a lower priority
+	// can be permitted while it is being applied
+	replaced := lock
+	if hold != 0 {
+		lock = ps.acquireLock(scope, scene.ID, priority, r.Holder, hold, now)
+	}
+	ps.mutex.Unlock()
+
+	applied, err := ps.applyStates(r.ID, rateLimited(caller))
+	if err != nil {
+		if hold != 0 {
+			ps.revertLock(lock, replaced)
+		}
+		return nil, err
+	}
+	return &model.ActivateResult{Scene: applied, Outcome: model.LockApplied, Lock: lock}, nil
+}
+
+// release the lock acquired by an activation whose scene failed to apply, if it is still the lock
+// of its scope, restoring the lock it replaced unless that lock has since expired
+func (ps *PresetsService) revertLock(acquired *model.ScopeLock, replaced *model.ScopeLock) {
+	ps.mutex.Lock()
+	now := ps.clock().Now()
+	if replaced == nil || ps.Model.Locks[acquired.Scope] != acquired ||
+		replaced.Expires != nil && !now.Before(*replaced.Expires) {
+		ps.mutex.Unlock()
+		ps.endLock(acquired, model.LockReleased)
+		return
+	}
+	defer ps.mutex.Unlock()
+	if !ps.isInitialized() {
+		return
+	}
+	ps.Model.Locks[acquired.Scope] = replaced
+	ps.armLock(replaced, now)
+	ps.save()
+	ps.sendEvent("lock", &model.LockEvent{Scope: acquired.Scope, Outcome: model.LockReleased, Scene: acquired.Scene, Lock: acquired})
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchLocks
+func (ps *PresetsService) FetchLocks() (*[]*model.ScopeLock, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	now := ps.clock().Now()
+	result := make([]*model.ScopeLock, 0, len(ps.Model.Locks))
+	for scope := range ps.Model.Locks {
+		if lock := ps.activeLock(scope, now); lock != nil {
+			result = append(result, lock)
+		}
+	}
+	sort.Sort(locksByScope(result))
+	return &result, nil
+}
+
+type locksByScope []*model.ScopeLock
+
+func (l locksByScope) Len() int           { return len(l) }
+func (l locksByScope) Less(i, j int) bool { return l[i].Scope < l[j].Scope }
+func (l locksByScope) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// see: http://schema.ninjablocks.com/service/presets#lockScope
+func (ps *PresetsService) LockScope(r *model.LockRequest) (*model.ScopeLock, error) {
+	return ps.rpcSession().LockScope(r)
+}
+
+func (ps *PresetsService) lockScope(r *model.LockRequest) (*model.ScopeLock, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	priority := 0
+	if r.ID != "" {
+		scene := ps.lookupScene(r.ID)
+		if scene == nil {
+			return nil, fmt.Errorf("failed to find a matching scene: %s", r.ID)
+		}
+		if r.Scope == "" {
+			r.Scope = scene.Scope
+		}
+		priority = scene.Priority
+	}
+	if r.Priority != nil {
+		priority = *r.Priority
+	}
+	if r.Hold < -1 {
+		return nil, fmt.Errorf("illegal argument: hold must be -1 or more: %d", r.Hold)
+	}
+	scope, err := ps.slotScope(&model.SlotRequest{Scope: r.Scope})
+	if err != nil {
+		return nil, err
+	}
+
+	now := ps.clock().Now()
+	if lock := ps.activeLock(scope, now); !permits(lock, r.ID, priority) {
+		return nil, &ScopeLockedError{Lock: lock, Reason: lockReason(lock, r.ID, priority)}
+	}
+	return ps.acquireLock(scope, r.ID, priority, r.Holder, r.Hold, now), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#releaseScope
+func (ps *PresetsService) ReleaseScope(r *model.LockRequest) (*model.ScopeLock, error) {
+	return ps.rpcSession().ReleaseScope(r)
+}
+
+func (ps *PresetsService) releaseScope(r *model.LockRequest) (*model.ScopeLock, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	scope, err := ps.slotScope(&model.SlotRequest{Scope: r.Scope})
+	if err != nil {
+		ps.mutex.Unlock()
+		return nil, err
+	}
+	lock := ps.activeLock(scope, ps.clock().Now())
+	ps.mutex.Unlock()
+	if lock == nil {
+		return nil, fmt.Errorf("scope %s is not locked", scope)
+	}
+	ps.endLock(lock, model.LockReleased)
+	return lock, nil
+}
+
+// start the timers of the persisted locks and discard those that have expired. The caller must
+// hold the mutex.
+func (ps *PresetsService) restoreLocks(now time.Time) {
+	for scope, lock := range ps.Model.Locks {
+		if ps.activeLock(scope, now) == nil {
+			delete(ps.Model.Locks, scope)
+		} else {
+			ps.armLock(lock, now)
+		}
+	}
+}
+
+// stop the timers of the locks. The caller must hold the mutex.
+func (ps *PresetsService) stopLocks() {
+	for scope, timer := range ps.timers {
+		timer.Stop()
+		delete(ps.timers, scope)
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"time"
+
+	"github.com/ninjasphere/app-presets/metrics"
+)
+
+// instruments holds the metrics recorded by the service. Each metric is nil, and records nothing,
+// unless the service has a registry.
+type instruments struct {
+	operations   *metrics.Counter   // the scenes applied or undone, by scope and operation
+	setLatency   *metrics.Histogram // the latency of calls to set a channel, by thing
+	setErrors    *metrics.Counter   // the calls to set a channel that failed, by thing
+	queueWait    *metrics.Histogram // the time tasks wait in the queue before a worker performs them
+	thingLatency *metrics.Histogram // the latency of calls to the thing model, by method
+	cancelled    *metrics.Counter   // the queued tasks cancelled by a newer task for the same channel
+	limited      *metrics.Counter   // the applies and undos refused by the rate limiter, by scope
+}
+
+func newInstruments(r *metrics.Registry) instruments {
+	return instruments{
+		operations: r.Counter("presets_scene_operations_total",
+			"The number of scenes applied or undone.", "scope", "operation"),
+		setLatency: r.Histogram("presets_channel_set_duration_seconds",
+			"The latency of calls to set the state of a channel.", metrics.DefaultBuckets, "thing"),
+		setErrors: r.Counter("presets_channel_set_errors_total",
+			"The number of calls to set the state of a channel that failed.", "thing"),
+		queueWait: r.Histogram("presets_queue_wait_seconds",
+			"The time tasks wait in the queue before they are performed.", metrics.DefaultBuckets),
+		thingLatency: r.Histogram("presets_thingmodel_call_duration_seconds",
+			"The latency of calls to the thing model.", metrics.DefaultBuckets, "method"),
+		cancelled: r.Counter("presets_tasks_cancelled_total",
+			"The number of queued calls cancelled by a newer call to the same channel."),
+		limited: r.Counter("presets_rate_limited_total",
+			"The number of applies and undos refused by the rate limit.", "scope"),
+	}
+}
+
+// timedClient records the latency of the calls made with a client
+type timedClient struct {
+	client  serviceClient
+	latency *metrics.Histogram
+}
+
+func (c *timedClient) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	start := time.Now()
+	defer c.latency.Since(start, method)
+	return c.client.Call(method, args, reply, timeout)
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+	nmodel "github.com/ninjasphere/go-ninja/model"
+)
+
+// periodically audit all scenes for orphans until the stop channel is closed
+func (ps *PresetsService) orphanAuditor(interval time.Duration, action string, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_, pruned, err := ps.auditOrphans(&model.Query{}, action, "")
+			if err != nil {
+				ps.Log.Warningf("periodic orphan audit failed: %v", err)
+			}
+			if action == model.OrphanPrune && (err != nil || len(pruned) > 0) {
+				auditor := NewSession(ps, model.Caller{Transport: model.TransportAuditor})
+				auditor.record(model.AuditPrune, &model.OrphanRequest{Action: action}, pruned, err)
+			}
+		}
+	}
+}
+
+// audit the scenes selected by the query for references to things and channels that
+// no longer exist in the thing model, update the health of each scene and then apply
+// the specified action. A revision of each pruned scene is recorded with the specified author, if
+// known. Each audited scene is replaced by a copy with its new health. Answers the audited scenes
+// and the ids of the pruned scenes.
+func (ps *PresetsService) auditOrphans(q *model.Query, action string, author string) ([]*model.Scene, []string, error) {
+	things := make([]*nmodel.Thing, 0)
+	if err := ps.thingModel().Call("fetchAll", nil, &things, defaultTimeout); err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch things: %v", err)
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	known := make(map[string]*nmodel.Thing)
+	for _, t := range things {
+		known[t.ID] = t
+	}
+
+	now := time.Now()
+	changed := false
+	selection := ps.match(q)
+	result := make([]*model.Scene, 0, len(selection))
+	pruned := make([]string, 0)
+	for _, x := range selection {
+		scene := ps.Model.Scenes[x]
+		orphans := findOrphans(scene, known)
+
+		status := model.HealthOK
+		if len(orphans) > 0 {
+			switch {
+			case action == model.OrphanPrune:
+				scene = scene.Prune(orphans)
+				scene.Modified = now
+				scene.ModifiedBy = author
+				ps.Model.Scenes[x] = scene
+				ps.recordRevision(scene, model.RevisionPrune, 0)
+				ps.Log.Infof("pruned %d orphans from scene '%s'", len(orphans), scene.ID)
+				pruned = append(pruned, scene.ID)
+				orphans = nil
+				changed = true
+			case action == model.OrphanMarkStale,
+				scene.Health != nil && scene.Health.Status == model.HealthStale:
+				status = model.HealthStale
+			default:
+				status = model.HealthOrphaned
+			}
+		}
+
+		if !sameHealth(scene.Health, status, orphans) {
+			changed = true
+		}
+		copied := *scene
+		copied.Health = &model.SceneHealth{
+			Status:  status,
+			Orphans: orphans,
+			Checked: now,
+		}
+		ps.Model.Scenes[x] = &copied
+		result = append(result, &copied)
+	}
+
+	if changed {
+		ps.save()
+	}
+	return result, pruned, nil
+}
+
+// answer the things and channels of the scene that do not exist in the specified set of known things
+func findOrphans(scene *model.Scene, known map[string]*nmodel.Thing) []model.Orphan {
+	orphans := make([]model.Orphan, 0)
+	for _, t := range scene.Things {
+		thing, ok := known[t.ID]
+		if !ok {
+			orphans = append(orphans, model.Orphan{Thing: t.ID})
+			continue
+		}
+
+		channels := make(map[string]bool)
+		if thing.Device != nil && thing.Device.Channels != nil {
+			for _, c := range *thing.Device.Channels {
+				channels[c.ID] = true
+			}
+		}
+		for _, c := range t.Channels {
+			if !channels[c.ID] {
+				orphans = append(orphans, model.Orphan{Thing: t.ID, Channel: c.ID})
+			}
+		}
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	return orphans
+}
+
+// answer true if the existing health record already reports the specified status and orphans
+func sameHealth(h *model.SceneHealth, status string, orphans []model.Orphan) bool {
+	if h == nil || h.Status != status || len(h.Orphans) != len(orphans) {
+		return false
+	}
+	for i, o := range orphans {
+		if h.Orphans[i] != o {
+			return false
+		}
+	}
+	return true
+}
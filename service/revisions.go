@@ -0,0 +1,158 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// record a new revision of the specified scene, which has just been stored, and discard any
+// revisions beyond the configured retention limits. ps.mutex must be held.
+func (ps *PresetsService) recordRevision(scene *model.Scene, action string, rollback int) *model.Revision {
+	if ps.Model.Revisions == nil {
+		ps.Model.Revisions = make(map[string][]*model.Revision)
+	}
+	revisions := ps.Model.Revisions[scene.ID]
+
+	previous := &model.Scene{ID: scene.ID}
+	number := 1
+	if len(revisions) > 0 {
+		last := revisions[len(revisions)-1]
+		previous = last.Scene
+		number = last.Revision + 1
+	}
+
+	snapshot := snapshotScene(scene)
+	revision := &model.Revision{
+		Revision: number,
+		Modified: scene.Modified,
+		Author:   scene.ModifiedBy,
+		Action:   action,
+		Changed:  changedFields(previous, snapshot),
+		Diff:     previous.Diff(snapshot),
+		Scene:    snapshot,
+		Rollback: rollback,
+	}
+	ps.Model.Revisions[scene.ID] = ps.retainRevisions(append(revisions, revision))
+	return revision
+}
+
+// answer the revisions that are retained according to the configured limits on the number
+// and the age of the revisions of a scene. The latest revision is always retained.
+func (ps *PresetsService) retainRevisions(revisions []*model.Revision) []*model.Revision {
+	max := config.Int(20, "app-presets.service.revisions.max")
+	days := config.Int(0, "app-presets.service.revisions.days")
+
+	first := 0
+	if max > 0 && len(revisions) > max {
+		first = len(revisions) - max
+	}
+	if days > 0 {
+		cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+		for first < len(revisions)-1 && revisions[first].Modified.Before(cutoff) {
+			first++
+		}
+	}
+	return append(make([]*model.Revision, 0, len(revisions)-first), revisions[first:]...)
+}
+
+// discard the revisions of the specified scenes, except those of the scene with the specified id.
+// ps.mutex must be held.
+func (ps *PresetsService) discardRevisions(scenes []*model.Scene, except string) {
+	for _, s := range scenes {
+		if s.ID != except {
+			delete(ps.Model.Revisions, s.ID)
+		}
+	}
+}
+
+// answer the specified revision of the scene with the specified id. ps.mutex must be held.
+func (ps *PresetsService) lookupRevision(id string, revision int) (*model.Revision, error) {
+	for _, r := range ps.Model.Revisions[id] {
+		if r.Revision == revision {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find revision %d of scene: %s", revision, id)
+}
+
+// answer the scene with the specified id or, if revision is not 0, the scene as of that revision.
+// ps.mutex must be held.
+func (ps *PresetsService) sceneAsOf(id string, revision int) (*model.Scene, error) {
+	if revision != 0 {
+		r, err := ps.lookupRevision(id, revision)
+		if err != nil {
+			return nil, err
+		}
+		return r.Scene, nil
+	}
+	if scene := ps.lookupScene(id); scene != nil {
+		return scene, nil
+	}
+	return nil, fmt.Errorf("failed to find a matching scene: %s", id)
+}
+
+// answer a copy of the stored state of a scene that shares nothing mutable with the scene
+func snapshotScene(m *model.Scene) *model.Scene {
+	result := *m
+	result.Applied = nil
+	result.Health = nil
+	result.Report = nil
+	result.Things = copyThings(m.Things)
+	if m.Includes != nil {
+		result.Includes = append([]string{}, m.Includes...)
+	}
+	if m.Tags != nil {
+		result.Tags = append([]string{}, m.Tags...)
+	}
+	if m.Properties != nil {
+		result.Properties = make(map[string]interface{})
+		for k, v := range m.Properties {
+			result.Properties[k] = v
+		}
+	}
+	return &result
+}
+
+func copyThings(things []model.ThingState) []model.ThingState {
+	if things == nil {
+		return nil
+	}
+	result := make([]model.ThingState, len(things))
+	for i, t := range things {
+		result[i] = t
+		result[i].Channels = append([]model.ChannelState{}, t.Channels...)
+	}
+	return result
+}
+
+// answer the names of the stored fields that differ between the specified scenes
+func changedFields(a *model.Scene, b *model.Scene) []string {
+	result := make([]string, 0)
+	fields := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"slot", a.Slot, b.Slot},
+		{"label", a.Label, b.Label},
+		{"scope", a.Scope, b.Scope},
+		{"things", a.Things, b.Things},
+		{"includes", a.Includes, b.Includes},
+		{"tags", a.Tags, b.Tags},
+		{"description", a.Description, b.Description},
+		{"icon", a.Icon, b.Icon},
+		{"color", a.Color, b.Color},
+		{"favorite", a.Favorite, b.Favorite},
+		{"properties", a.Properties, b.Properties},
+		{"priority", a.Priority, b.Priority},
+		{"hold", a.Hold, b.Hold},
+	}
+	for _, f := range fields {
+		if !model.SameState(f.a, f.b) {
+			result = append(result, f.name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,508 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+	"github.com/pborman/uuid"
+)
+
+// the number of finished runs that are retained
+const retainedRuns = 20
+
+// runState holds the runtime state of a run that has not finished
+type runState struct {
+	timer  Timer // fires when the wait step in progress ends
+	active bool  // true while a goroutine is performing the steps of the run
+}
+
+// validate the sequence. The caller must hold the mutex.
+func (ps *PresetsService) validateSequence(s *model.Sequence) error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("illegal argument: the sequence has no steps")
+	}
+	switch s.Restart {
+	case "", model.RestartResume, model.RestartAbort:
+	default:
+		return fmt.Errorf("illegal argument: restart must be '%s' or '%s': '%s'", model.RestartResume, model.RestartAbort, s.Restart)
+	}
+	for i, step := range s.Steps {
+		switch step.Action {
+		case model.StepApply, model.StepUndo:
+			if ps.lookupScene(step.Scene) == nil {
+				return fmt.Errorf("illegal argument: step %d: failed to find a matching scene: %s", i, step.Scene)
+			}
+		case model.StepSet:
+			if step.Thing == "" || step.Channel == "" || step.State == nil {
+				return fmt.Errorf("illegal argument: step %d: thing, channel and state must be specified", i)
+			}
+		case model.StepWait:
+			if step.Seconds <= 0 {
+				return fmt.Errorf("illegal argument: step %d: seconds must be greater than 0", i)
+			}
+		default:
+			return fmt.Errorf("illegal argument: step %d: unrecognized action: '%s'", i, step.Action)
+		}
+	}
+	return nil
+}
+
+// answer the sequence with the specified id, or nil. The caller must hold the mutex.
+func (ps *PresetsService) lookupSequence(id string) *model.Sequence {
+	for _, s := range ps.Model.Sequences {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// answer the run with the specified id, or nil. The caller must hold the mutex.
+func (ps *PresetsService) lookupRun(id string) *model.SequenceRun {
+	for _, r := range ps.Model.Runs {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchSequences
+func (ps *PresetsService) FetchSequences() (*[]*model.Sequence, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	result := make([]*model.Sequence, len(ps.Model.Sequences))
+	copy(result, ps.Model.Sequences)
+	return &result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchSequence
+func (ps *PresetsService) FetchSequence(id string) (*model.Sequence, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if s := ps.lookupSequence(id); s != nil {
+		return s, nil
+	}
+	return nil, fmt.Errorf("failed to find a matching sequence: %s", id)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#storeSequence
+func (ps *PresetsService) StoreSequence(s *model.Sequence) (*model.Sequence, error) {
+	return ps.rpcSession().StoreSequence(s)
+}
+
+func (ps *PresetsService) storeSequence(s *model.Sequence) (*model.Sequence, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if s.ID == "" {
+		s.ID = uuid.NewUUID().String()
+	} else if strings.Contains(s.ID, ":") {
+		return nil, fmt.Errorf("illegal argument: sequence id cannot contain ':'")
+	}
+	if s.Label == "" {
+		s.Label = s.ID
+	}
+	if err := ps.validateSequence(s); err != nil {
+		return nil, err
+	}
+
+	for i, e := range ps.Model.Sequences {
+		if e.ID == s.ID {
+			ps.Model.Sequences[i] = s
+			ps.save()
+			return s, nil
+		}
+	}
+	ps.Model.Sequences = append(ps.Model.Sequences, s)
+	ps.save()
+	return s, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#deleteSequence
+func (ps *PresetsService) DeleteSequence(id string) (*model.Sequence, error) {
+	return ps.rpcSession().DeleteSequence(id)
+}
+
+// delete the sequence and cancel its unfinished runs
+func (ps *PresetsService) deleteSequence(id string) (*model.Sequence, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for i, s := range ps.Model.Sequences {
+		if s.ID == id {
+			for _, run := range ps.Model.Runs {
+				if run.Sequence == id && !finished(run) {
+					ps.finishRun(run, model.RunCancelled, "the sequence was deleted")
+				}
+			}
+			ps.Model.Sequences = append(ps.Model.Sequences[:i], ps.Model.Sequences[i+1:]...)
+			ps.save()
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find a matching sequence: %s", id)
+}
+
+// answer true if the run has finished
+func finished(run *model.SequenceRun) bool {
+	return run.Status != model.RunRunning && run.Status != model.RunPaused
+}
+
+// answer a copy of the run, which may be read without holding the mutex
+func snapshot(run *model.SequenceRun) *model.SequenceRun {
+	result := *run
+	return &result
+}
+
+// send an event that reports the progress of the run. The caller must hold the mutex.
+func (ps *PresetsService) reportRun(run *model.SequenceRun) {
+	ps.sendEvent("sequence", snapshot(run))
+}
+
+// finish the run with the specified status and discard the oldest finished runs beyond those that
+// are retained. The caller must hold the mutex.
+func (ps *PresetsService) finishRun(run *model.SequenceRun, status string, reason string) {
+	if state, ok := ps.runs[run.ID]; ok {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		delete(ps.runs, run.ID)
+	}
+	now := ps.clock().Now()
+	run.Status = status
+	run.Error = reason
+	run.Finished = &now
+	run.Due = nil
+	run.Remaining = 0
+
+	count := 0
+	for _, r := range ps.Model.Runs {
+		if finished(r) {
+			count++
+		}
+	}
+	runs := make([]*model.SequenceRun, 0, len(ps.Model.Runs))
+	for _, r := range ps.Model.Runs {
+		if finished(r) && count > retainedRuns {
+			count--
+			continue
+		}
+		runs = append(runs, r)
+	}
+	ps.Model.Runs = runs
+	ps.save()
+	ps.reportRun(run)
+}
+
+// start the timer that ends the wait step of the run after the specified duration. The caller must
+// hold the mutex.
+func (ps *PresetsService) armRun(run *model.SequenceRun, d time.Duration) {
+	due := ps.clock().Now().Add(d)
+	run.Due = &due
+	run.Remaining = 0
+	state := ps.runs[run.ID]
+	state.timer = ps.clock().AfterFunc(d, func() {
+		ps.mutex.Lock()
+		if !ps.isInitialized() || ps.runs[run.ID] != state || run.Status != model.RunRunning || run.Due == nil {
+			ps.mutex.Unlock()
+			return
+		}
+		state.timer = nil
+		run.Due = nil
+		run.Step++
+		ps.save()
+		ps.reportRun(run)
+		ps.mutex.Unlock()
+		ps.continueRun(run)
+	})
+}
+
+// perform the steps of the run until it finishes, is paused or cancelled, or reaches a wait step
+func (ps *PresetsService) continueRun(run *model.SequenceRun) {
+	ps.mutex.Lock()
+	state, ok := ps.runs[run.ID]
+	if !ok || state.active {
+		ps.mutex.Unlock()
+		return
+	}
+	state.active = true
+	for {
+		if !ps.isInitialized() || ps.runs[run.ID] != state || run.Status != model.RunRunning {
+			break
+		}
+		sequence := ps.lookupSequence(run.Sequence)
+		if sequence == nil {
+			ps.finishRun(run, model.RunFailed, fmt.Sprintf("failed to find a matching sequence: %s", run.Sequence))
+			break
+		}
+		if run.Step >= len(sequence.Steps) {
+			ps.finishRun(run, model.RunCompleted, "")
+			break
+		}
+		step := sequence.Steps[run.Step]
+		if step.Action == model.StepWait {
+			ps.armRun(run, time.Duration(step.Seconds*float64(time.Second)))
+			ps.save()
+			ps.reportRun(run)
+			break
+		}
+
+		ps.mutex.Unlock()
+		err := ps.performStep(run, step)
+		ps.mutex.Lock()
+
+		if ps.runs[run.ID] != state {
+			break
+		}
+		if err != nil {
+			ps.finishRun(run, model.RunFailed, fmt.Sprintf("step %d failed: %v", run.Step, err))
+			break
+		}
+		run.Step++
+		ps.save()
+		ps.reportRun(run)
+	}
+	state.active = false
+	ps.mutex.Unlock()
+}
+
+// perform a step of the run other than a wait
+func (ps *PresetsService) performStep(run *model.SequenceRun, step model.SequenceStep) error {
+	session := NewSession(ps, model.Caller{Transport: model.TransportSequence, Key: run.Holder})
+	var err error
+	switch step.Action {
+	case model.StepApply:
+		_, err = session.ApplyScene(step.Scene)
+	case model.StepUndo:
+		_, err = session.UndoScene(step.Scene)
+	case model.StepSet:
+		_, err = session.SetChannels(&model.SetRequest{
+			Channels: []model.ChannelSet{{Thing: step.Thing, Channel: step.Channel, State: step.State}},
+		})
+	default:
+		err = fmt.Errorf("unrecognized action: '%s'", step.Action)
+	}
+	return err
+}
+
+// see: http://schema.ninjablocks.com/service/presets#startSequence
+func (ps *PresetsService) StartSequence(id string) (*model.SequenceRun, error) {
+	return ps.rpcSession().StartSequence(id)
+}
+
+func (ps *PresetsService) startSequence(id string, holder string) (*model.SequenceRun, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	sequence := ps.lookupSequence(id)
+	if sequence == nil {
+		ps.mutex.Unlock()
+		return nil, fmt.Errorf("failed to find a matching sequence: %s", id)
+	}
+	run := &model.SequenceRun{
+		ID:       uuid.NewUUID().String(),
+		Sequence: id,
+		Status:   model.RunRunning,
+		Steps:    len(sequence.Steps),
+		Started:  ps.clock().Now(),
+		Holder:   holder,
+	}
+	ps.Model.Runs = append(ps.Model.Runs, run)
+	ps.runs[run.ID] = &runState{}
+	ps.save()
+	ps.reportRun(run)
+	result := snapshot(run)
+	ps.mutex.Unlock()
+
+	go ps.continueRun(run)
+	return result, nil
+}
+
+// answer the unfinished run with the specified id. The caller must hold the mutex.
+func (ps *PresetsService) unfinishedRun(id string) (*model.SequenceRun, error) {
+	run := ps.lookupRun(id)
+	if run == nil {
+		return nil, fmt.Errorf("failed to find a matching run: %s", id)
+	}
+	if finished(run) {
+		return nil, fmt.Errorf("illegal state: run %s has already finished: %s", id, run.Status)
+	}
+	return run, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#cancelRun
+func (ps *PresetsService) CancelRun(id string) (*model.SequenceRun, error) {
+	return ps.rpcSession().CancelRun(id)
+}
+
+func (ps *PresetsService) cancelRun(id string) (*model.SequenceRun, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	run, err := ps.unfinishedRun(id)
+	if err != nil {
+		return nil, err
+	}
+	ps.finishRun(run, model.RunCancelled, "")
+	return snapshot(run), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#pauseRun
+func (ps *PresetsService) PauseRun(id string) (*model.SequenceRun, error) {
+	return ps.rpcSession().PauseRun(id)
+}
+
+// pause the run. A step that is being performed is completed, but no further step is started and
+// a wait in progress is suspended until the run is resumed.
+func (ps *PresetsService) pauseRun(id string) (*model.SequenceRun, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	run, err := ps.unfinishedRun(id)
+	if err != nil {
+		return nil, err
+	}
+	if run.Status == model.RunPaused {
+		return nil, fmt.Errorf("illegal state: run %s is already paused", id)
+	}
+	state := ps.runs[run.ID]
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	if run.Due != nil {
+		if remaining := run.Due.Sub(ps.clock().Now()); remaining > 0 {
+			run.Remaining = remaining.Seconds()
+		}
+		run.Due = nil
+	}
+	run.Status = model.RunPaused
+	ps.save()
+	ps.reportRun(run)
+	return snapshot(run), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#resumeRun
+func (ps *PresetsService) ResumeRun(id string) (*model.SequenceRun, error) {
+	return ps.rpcSession().ResumeRun(id)
+}
+
+func (ps *PresetsService) resumeRun(id string) (*model.SequenceRun, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	run, err := ps.unfinishedRun(id)
+	if err != nil {
+		return nil, err
+	}
+	if run.Status != model.RunPaused {
+		return nil, fmt.Errorf("illegal state: run %s is not paused", id)
+	}
+	run.Status = model.RunRunning
+	ps.continueSteps(run)
+	ps.save()
+	ps.reportRun(run)
+	return snapshot(run), nil
+}
+
+// continue the run from its current step, completing the remainder of a suspended wait first.
+// The caller must hold the mutex.
+func (ps *PresetsService) continueSteps(run *model.SequenceRun) {
+	if run.Remaining > 0 {
+		ps.armRun(run, time.Duration(run.Remaining*float64(time.Second)))
+	} else {
+		go ps.continueRun(run)
+	}
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchRuns
+func (ps *PresetsService) FetchRuns() (*[]*model.SequenceRun, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	result := make([]*model.SequenceRun, len(ps.Model.Runs))
+	for i, run := range ps.Model.Runs {
+		result[i] = snapshot(run)
+	}
+	return &result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchRun
+func (ps *PresetsService) FetchRun(id string) (*model.SequenceRun, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if run := ps.lookupRun(id); run != nil {
+		return snapshot(run), nil
+	}
+	return nil, fmt.Errorf("failed to find a matching run: %s", id)
+}
+
+// resume or abort, according to the restart policy of their sequence, the runs that were
+// interrupted when the service stopped, and answer the runs that are to continue once the service
+// has been initialized. Paused runs that are resumed remain paused. The caller must hold the mutex.
+func (ps *PresetsService) restoreRuns(now time.Time, policy string) []*model.SequenceRun {
+	resumed := make([]*model.SequenceRun, 0)
+	for _, run := range ps.Model.Runs {
+		if finished(run) {
+			continue
+		}
+		restart := policy
+		if sequence := ps.lookupSequence(run.Sequence); sequence != nil && sequence.Restart != "" {
+			restart = sequence.Restart
+		}
+		ps.runs[run.ID] = &runState{}
+		if restart != model.RestartResume {
+			ps.finishRun(run, model.RunAborted, "the run was interrupted when the service stopped")
+			continue
+		}
+		if run.Due != nil {
+			if remaining := run.Due.Sub(now); remaining > 0 {
+				run.Remaining = remaining.Seconds()
+			} else {
+				run.Step++
+			}
+			run.Due = nil
+		}
+		if run.Status == model.RunRunning {
+			resumed = append(resumed, run)
+		}
+	}
+	return resumed
+}
+
+// stop the timers of the runs. The caller must hold the mutex.
+func (ps *PresetsService) stopRuns() {
+	for id, state := range ps.runs {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		delete(ps.runs, id)
+	}
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"fmt"
+	"github.com/ninjasphere/app-presets/audit"
+	"github.com/ninjasphere/app-presets/metrics"
 	"github.com/ninjasphere/app-presets/model"
 	"github.com/pborman/uuid"
 
@@ -10,6 +12,10 @@ import (
 	"github.com/ninjasphere/go-ninja/logger"
 	nmodel "github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/go-ninja/rpc"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,12 +29,43 @@ type Connection interface {
 }
 
 type PresetsService struct {
-	Model       *model.Presets
-	Save        func(*model.Presets)
-	Conn        Connection
-	Log         *logger.Logger
-	initialized bool
-	queue       chan *task
+	Model            *model.Presets
+	Save             func(*model.Presets)
+	Conn             Connection
+	Log              *logger.Logger
+	Audit            *audit.Log        // if not nil, records the operations that change or apply scenes
+	Clock            Clock             // if not nil, used instead of the system clock by locks and simulations
+	Metrics          *metrics.Registry // if not nil, records the metrics of the service
+	initialized      bool              // guarded by lifecycle
+	queue            chan *task
+	stop             chan struct{}
+	mutex            sync.Mutex     // serializes changes to the model
+	lifecycle        sync.RWMutex   // held for reading while a task is queued, for writing while starting or stopping
+	stopping         bool           // true once Destroy has been called, until the next Init
+	workers          sync.WaitGroup // the running workers
+	numWorkers       int
+	started          time.Time  // guarded by lifecycle
+	generation       uint64     // incremented each time the model is saved
+	diagnostics      sync.Mutex // guards the apply failures
+	failures         []model.ApplyFailure
+	failed           int
+	metrics          instruments
+	limiter          *rateLimiter
+	timers           map[string]Timer               // the timers that expire the locks, by scope
+	deferred         map[string]*deferredActivation // the activations deferred until a scope is released
+	manualPriority   int
+	manualHold       int
+	simulations      map[string]*simulationTimers // the timers of the running simulations, by scope
+	presenceInterval time.Duration                // the interval at which simulations check for presence
+	random           *rand.Rand                   // used by simulations, with the mutex held
+	runs             map[string]*runState         // the runtime state of the unfinished runs of sequences, by id
+	coalesce         time.Duration                // the time within which the undo states of a reapplied scene are kept
+	pendingLock      sync.Mutex                   // guards the pending tasks
+	pending          map[string]*task             // the queued set tasks that have not yet been performed, by topic
+	exported         *rpc.ExportedService
+	announced        bool                                    // true once the service has been exported; guarded by lifecycle
+	client           func(topic string) serviceClient        // if not nil, used instead of Conn.GetServiceClient
+	notify           func(event string, payload interface{}) // if not nil, used instead of exported.SendEvent
 }
 
 func (ps *PresetsService) Init() error {
@@ -45,38 +82,137 @@ func (ps *PresetsService) Init() error {
 		return fmt.Errorf("illegal state: Conn is nil")
 	}
 
-	var err error
-	siteID := config.MustString("siteId")
-	topic := fmt.Sprintf("$site/%s/service/%s", siteID, "presets")
-	announcement := &nmodel.ServiceAnnouncement{
-		Schema: "http://schema.ninjablocks.com/service/presets",
+	if ps.isInitialized() {
+		return fmt.Errorf("illegal state: the service is already initialized")
 	}
-	if _, err = ps.Conn.ExportService(ps, topic, announcement); err != nil {
-		return err
+
+	// the service is only exported once, so that it can be destroyed and initialized again
+	if !ps.announced {
+		var err error
+		siteID := config.MustString("siteId")
+		topic := fmt.Sprintf("$site/%s/service/%s", siteID, "presets")
+		announcement := &nmodel.ServiceAnnouncement{
+			Schema: "http://schema.ninjablocks.com/service/presets",
+		}
+		if ps.exported, err = ps.Conn.ExportService(ps, topic, announcement); err != nil {
+			return err
+		}
+		ps.lifecycle.Lock()
+		ps.announced = true
+		ps.lifecycle.Unlock()
 	}
 	numWorkers := config.Int(10, "app-presets.service.workers")
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	ps.metrics = newInstruments(ps.Metrics)
+	ps.limiter = newRateLimiter(
+		float64(config.Int(2, "app-presets.service.rateLimit.scene")),
+		float64(config.Int(5, "app-presets.service.rateLimit.scope")))
+	ps.coalesce = time.Duration(config.Int(2000, "app-presets.service.coalesceMillis")) * time.Millisecond
+	ps.pending = make(map[string]*task)
+	ps.manualPriority = config.Int(10, "app-presets.service.locks.manualPriority")
+	ps.manualHold = config.Int(0, "app-presets.service.locks.manualHold")
+	ps.deferred = make(map[string]*deferredActivation)
+	ps.timers = make(map[string]Timer)
+	ps.simulations = make(map[string]*simulationTimers)
+	ps.runs = make(map[string]*runState)
+	ps.presenceInterval = time.Duration(config.Int(60, "app-presets.service.simulation.presenceSeconds")) * time.Second
+	if ps.random == nil {
+		ps.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	entries := ps.restoreEntries(ps.clock().Now())
+	ps.mutex.Lock()
+	ps.restoreLocks(ps.clock().Now())
+	ps.restoreSimulations(ps.clock().Now(), entries)
+	resumed := ps.restoreRuns(ps.clock().Now(), config.String(model.RestartAbort, "app-presets.service.sequences.restart"))
+	ps.mutex.Unlock()
+	ps.lifecycle.Lock()
 	ps.queue = make(chan *task, numWorkers)
-	for i := 0; i <= numWorkers; i++ {
-		go ps.worker()
+	ps.numWorkers = numWorkers
+	ps.stopping = false
+	ps.lifecycle.Unlock()
+	ps.workers.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go ps.worker(ps.queue)
+	}
+	ps.stop = make(chan struct{})
+	if minutes := config.Int(60, "app-presets.service.orphans.minutes"); minutes > 0 {
+		action := config.String(model.OrphanReport, "app-presets.service.orphans.action")
+		go ps.orphanAuditor(time.Duration(minutes)*time.Minute, action, ps.stop)
 	}
+	ps.diagnostics.Lock()
+	ps.failures = nil
+	ps.failed = 0
+	ps.diagnostics.Unlock()
+	ps.lifecycle.Lock()
+	ps.started = time.Now()
 	ps.initialized = true
+	ps.lifecycle.Unlock()
+	ps.mutex.Lock()
+	for _, run := range resumed {
+		ps.continueSteps(run)
+	}
+	ps.mutex.Unlock()
 	return nil
 }
 
+// Destroy stops the service. Tasks that are already queued are completed, but no new tasks are
+// accepted. Destroy waits for the queued tasks to complete for at most the time specified by the
+// app-presets.service.shutdownSeconds configuration key and answers an error if they do not.
+// The service may be initialized again once it has been destroyed.
 func (ps *PresetsService) Destroy() error {
-	close(ps.queue)
+	ps.lifecycle.Lock()
+	if !ps.initialized {
+		ps.lifecycle.Unlock()
+		return fmt.Errorf("illegal state: the service is not initialized")
+	}
 	ps.initialized = false
-	return nil
+	ps.lifecycle.Unlock()
+	ps.mutex.Lock()
+	ps.stopLocks()
+	ps.stopSimulations()
+	ps.stopRuns()
+	ps.mutex.Unlock()
+
+	ps.lifecycle.Lock()
+	ps.stopping = true
+	ps.lifecycle.Unlock()
+
+	// no task can be queued once stopping is true, so the queue can be closed safely. the workers
+	// exit once they have drained it.
+	close(ps.stop)
+	close(ps.queue)
+
+	drained := make(chan struct{})
+	go func() {
+		ps.workers.Wait()
+		close(drained)
+	}()
+	timeout := time.Duration(config.Int(10, "app-presets.service.shutdownSeconds")) * time.Second
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v waiting for %d queued tasks to complete", timeout, len(ps.queue))
+	}
 }
 
 // see: http://schema.ninjablocks.com/service/presets#fetchScenes
 func (ps *PresetsService) FetchScenes(q *model.Query) (*[]*model.Scene, error) {
-	ps.checkInit()
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
 	if scope, _, _, err := ps.parseScope(q.Scope); err != nil {
 		return nil, err
 	} else {
 		q.Scope = &scope
-		found := ps.match(q)
+		found, err := ps.selectScenes(q)
+		if err != nil {
+			return nil, err
+		}
 		result := ps.copyScenes(found)
 		return &result, nil
 	}
@@ -84,44 +220,49 @@ func (ps *PresetsService) FetchScenes(q *model.Query) (*[]*model.Scene, error) {
 
 // see: http://schema.ninjablocks.com/service/presets#deleteScenes
 func (ps *PresetsService) DeleteScenes(q *model.Query) (*[]*model.Scene, error) {
-	ps.checkInit()
+	return ps.rpcSession().DeleteScenes(q)
+}
+
+func (ps *PresetsService) deleteScenes(q *model.Query) (*[]*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
 
 	if scope, _, _, err := ps.parseScope(q.Scope); err != nil {
 		return nil, err
 	} else {
 		q.Scope = &scope
-		result := ps.deleteAll(ps.match(q))
+		found, err := ps.selectScenes(q)
+		if err != nil {
+			return nil, err
+		}
+		result := ps.deleteAll(found)
+		ps.discardRevisions(result, "")
 		return &result, nil
 	}
 }
 
 // see: http://schema.ninjablocks.com/service/presets#fetchScenePrototype
 func (ps *PresetsService) FetchScenePrototype(scope string) (*model.Scene, error) {
-	ps.checkInit()
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
 
 	if scope == "" {
 		scope = "site"
 	}
 
-	if scope, room, _, err := ps.parseScope(&scope); err != nil {
+	if scope, rooms, _, err := ps.parseScope(&scope); err != nil {
 		return nil, err
 	} else {
 
-		thingClient := ps.Conn.GetServiceClient("$home/services/ThingModel")
-		things := make([]*nmodel.Thing, 0)
-		keptThings := make([]*nmodel.Thing, 0, len(things))
-		if err := thingClient.Call("fetchAll", nil, &things, defaultTimeout); err != nil {
+		keptThings, err := ps.fetchThingsInScope(rooms)
+		if err != nil {
 			return nil, err
 		}
 
-		for _, t := range things {
-			if !t.Promoted ||
-				(room != "" && (t.Location == nil || *t.Location != room)) {
-				continue
-			}
-			keptThings = append(keptThings, t)
-		}
-
 		result := &model.Scene{
 			Scope:  scope,
 			Things: make([]model.ThingState, 0, len(keptThings)),
@@ -138,8 +279,22 @@ func (ps *PresetsService) FetchScenePrototype(scope string) (*model.Scene, error
 
 // see: http://schema.ninjablocks.com/service/presets#storeScene
 func (ps *PresetsService) StoreScene(m *model.Scene) (*model.Scene, error) {
-	ps.checkInit()
+	return ps.rpcSession().StoreScene(m)
+}
 
+// lock the model, then validate and store the specified scene
+func (ps *PresetsService) store(m *model.Scene) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.storeScene(m, model.RevisionStore, 0)
+}
+
+// validate and store the specified scene, recording a revision with the specified action.
+// ps.mutex must be held.
+func (ps *PresetsService) storeScene(m *model.Scene, action string, rollback int) (*model.Scene, error) {
 	if m.Scope == "" {
 		m.Scope = "site"
 	}
@@ -154,118 +309,1056 @@ func (ps *PresetsService) StoreScene(m *model.Scene) (*model.Scene, error) {
 		m.ID = uuid.NewUUID().String()
 	}
 
+	// a scene stored without a slot keeps its slot or, if it is new to the scope, takes the first
+	// free slot. It never replaces another scene in the same scope and slot.
+	existing := ps.match(&model.Query{ID: &m.ID})
+	if m.Slot <= 0 && len(existing) > 0 && ps.Model.Scenes[existing[0]].Scope == m.Scope {
+		m.Slot = ps.Model.Scenes[existing[0]].Slot
+	}
 	if m.Slot <= 0 {
-		m.Slot = 1
+		slot, err := ps.freeSlot(m.Scope)
+		if err != nil {
+			return nil, err
+		}
+		m.Slot = slot
+	}
+	if x := ps.sceneAt(m.Scope, m.Slot); x >= 0 && ps.Model.Scenes[x].ID != m.ID {
+		return nil, &SlotConflictError{Scope: m.Scope, Slot: m.Slot, ID: ps.Model.Scenes[x].ID}
 	}
 
 	if m.Label == "" {
 		m.Label = fmt.Sprintf("Preset %d", m.Slot)
 	}
 
-	found := ps.match(&model.Query{
-		ID:    &m.ID,
-		Scope: &m.Scope,
-		Slot:  &m.Slot,
-	})
+	if err := ps.checkSlot(m.Scope, m.Slot); err != nil {
+		return nil, err
+	}
+
+	if err := validateColor(m.Color); err != nil {
+		return nil, err
+	}
+	if m.Hold < -1 {
+		return nil, fmt.Errorf("illegal argument: hold must be -1 or more: %d", m.Hold)
+	}
+	m.Tags = normalizeTags(m.Tags)
+
+	for _, t := range m.Things {
+		if err := validateGuard(t.Guard); err != nil {
+			return nil, err
+		}
+		for _, ch := range t.Channels {
+			if ch.Adjust != nil {
+				if err := ch.Adjust.Validate(); err != nil {
+					return nil, err
+				}
+			}
+			if err := validateGuard(ch.Guard); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	if len(found) > 1 {
-		ps.deleteAll(found[1:])
+	if len(m.Includes) > 0 {
+		lookup := func(id string) *model.Scene {
+			if id == m.ID {
+				return m
+			}
+			return ps.lookupScene(id)
+		}
+		if _, err := m.Resolve(lookup); err != nil {
+			return nil, err
+		}
 	}
 
-	if len(found) < 1 {
+	m.Modified = time.Now()
+
+	// the scene replaces the scene with the same id, if any
+	if len(existing) < 1 {
 		ps.Model.Scenes = append(ps.Model.Scenes, m)
 	} else {
-		ps.Model.Scenes[found[0]] = m
+		ps.Model.Scenes[existing[0]] = m
 	}
+	ps.recordRevision(m, action, rollback)
 
-	ps.Save(ps.Model)
+	ps.save()
 	return m, nil
 }
 
+// see: http://schema.ninjablocks.com/service/presets#patchScene
+func (ps *PresetsService) PatchScene(p *model.ScenePatch) (*model.Scene, error) {
+	return ps.rpcSession().PatchScene(p)
+}
+
+func (ps *PresetsService) patchScene(p *model.ScenePatch) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if p.ID == "" {
+		return nil, fmt.Errorf("illegal argument: id is empty")
+	}
+	x := -1
+	for i, m := range ps.Model.Scenes {
+		if m.ID == p.ID {
+			x = i
+			break
+		}
+	}
+	if x < 0 {
+		return nil, fmt.Errorf("failed to find a matching scene: %s", p.ID)
+	}
+	if p.Color != nil {
+		if err := validateColor(*p.Color); err != nil {
+			return nil, err
+		}
+	}
+	if p.Hold != nil && *p.Hold < -1 {
+		return nil, fmt.Errorf("illegal argument: hold must be -1 or more: %d", *p.Hold)
+	}
+
+	// the stored scene may be being read by callers that fetched it, so a patched copy replaces it
+	stored := ps.Model.Scenes[x]
+	copied := *stored
+	scene := &copied
+	if stored.Properties != nil {
+		scene.Properties = make(map[string]interface{}, len(stored.Properties))
+		for k, v := range stored.Properties {
+			scene.Properties[k] = v
+		}
+	}
+	if p.Label != nil {
+		scene.Label = *p.Label
+	}
+	if p.Tags != nil {
+		scene.Tags = normalizeTags(*p.Tags)
+	}
+	if p.Description != nil {
+		scene.Description = *p.Description
+	}
+	if p.Icon != nil {
+		scene.Icon = *p.Icon
+	}
+	if p.Color != nil {
+		scene.Color = *p.Color
+	}
+	if p.Favorite != nil {
+		scene.Favorite = *p.Favorite
+	}
+	if p.Priority != nil {
+		scene.Priority = *p.Priority
+	}
+	if p.Hold != nil {
+		scene.Hold = *p.Hold
+	}
+	for k, v := range p.Properties {
+		if v == nil {
+			delete(scene.Properties, k)
+		} else {
+			if scene.Properties == nil {
+				scene.Properties = make(map[string]interface{})
+			}
+			scene.Properties[k] = v
+		}
+	}
+	scene.Modified = time.Now()
+	scene.ModifiedBy = p.ModifiedBy
+	ps.Model.Scenes[x] = scene
+	ps.recordRevision(scene, model.RevisionPatch, 0)
+
+	ps.save()
+	return scene, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchTags
+func (ps *PresetsService) FetchTags() (*[]*model.TagCount, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	counts := make(map[string]*model.TagCount)
+	result := make([]*model.TagCount, 0)
+	for _, m := range ps.Model.Scenes {
+		for _, t := range m.Tags {
+			if c, ok := counts[t]; ok {
+				c.Count++
+			} else {
+				counts[t] = &model.TagCount{Tag: t, Count: 1}
+				result = append(result, counts[t])
+			}
+		}
+	}
+	sort.Sort(byCount(result))
+	return &result, nil
+}
+
 // see: http://schema.ninjablocks.com/service/presets#applyScene
 func (ps *PresetsService) ApplyScene(id string) (*model.Scene, error) {
-	ps.checkInit()
+	return ps.rpcSession().ApplyScene(id)
+}
+
+// apply the scene on behalf of the caller, unless its scope is held by a scene of a higher priority
+func (ps *PresetsService) applyScene(id string, caller model.Caller) (*model.Scene, error) {
 	if id == "" {
 		return nil, fmt.Errorf("illegal argument: id is empty")
 	}
-	if scenes, err := ps.FetchScenes(&model.Query{ID: &id}); err != nil || scenes == nil {
+	result, err := ps.activateScene(&model.ActivateRequest{ID: id}, caller)
+	if err != nil {
 		return nil, err
-	} else {
-		thingClient := ps.Conn.GetServiceClient("$home/services/ThingModel")
-		for _, scene := range *scenes {
-			things := make([]*model.ThingState, 0, len(scene.Things))
-
-			for i, t := range scene.Things {
-				thing := &nmodel.Thing{}
-				if err := thingClient.Call("fetch", []string{t.ID}, &thing, defaultTimeout); err != nil {
-					ps.Log.Errorf("failed to obtain thing '%s': %v", id, err)
-					continue
-				}
-				current := ps.createThingState(thing)
-				t = *t.MergeUndoState(current)
-				scene.Things[i] = t
-				things = append(things, &scene.Things[i])
-			}
+	}
+	return result.Scene, nil
+}
 
-			for _, t := range things {
-				for _, c := range t.Channels {
-					ps.queue <- &task{
-						topic:   fmt.Sprintf("$thing/%s/channel/%s", t.ID, c.ID),
-						method:  "set",
-						payload: c.State,
-					}
-				}
-			}
-			ps.Save(ps.Model)
-			return scene, nil
-		}
+// apply the states of the scene to its things, regardless of the lock of its scope. The states are
+// prepared from a snapshot of the scene taken with the mutex held, and the undo states and report
+// of the apply are recorded in a copy of the scene that replaces it, so that a scene is never
+// modified by an apply once it has been answered to a caller. If limited, the apply is subject to
+// the rate limiter.
+func (ps *PresetsService) applyStates(id string, limited bool) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("illegal argument: id is empty")
+	}
+
+	ps.mutex.Lock()
+	scene := ps.lookupScene(id)
+	if scene == nil {
+		ps.mutex.Unlock()
 		return nil, fmt.Errorf("failed to find a matching scene: %s", id)
 	}
+	if err := ps.takeToken(scene, limited); err != nil {
+		ps.mutex.Unlock()
+		return nil, err
+	}
+	snapshot := *scene
+
+	// preparing the targets replaces their elements, so the stored states are copied
+	targets := append([]model.ThingState(nil), scene.Things...)
+	previous := scene.Things
+	if len(scene.Includes) > 0 {
+		previous = scene.Applied
+		var err error
+		if targets, err = scene.Resolve(ps.lookupScene); err != nil {
+			ps.mutex.Unlock()
+			return nil, err
+		}
+	}
+	report := &model.ApplyReport{Applied: time.Now()}
+
+	// if the scene was applied moments ago, the things may already be in the state of
+	// the scene, or about to be, so the undo states recorded then are kept.
+	var kept map[string]interface{}
+	if scene.Report != nil && report.Applied.Sub(scene.Report.Applied) < ps.coalesce {
+		kept = undoStates(previous)
+	}
+	ps.mutex.Unlock()
+
+	things := ps.prepareTargets(targets, kept, report)
+	if err := ps.enqueueStates(things); err != nil {
+		return nil, err
+	}
+	ps.metrics.operations.Inc(snapshot.Scope, "apply")
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.commitApply(&snapshot, targets, report), nil
+}
+
+// record the undo states and report of an apply of the snapshot in a copy of the scene that
+// replaces it, and answer the copy. The undo states are discarded if the states of the scene were
+// replaced while it was being applied. The caller must hold the mutex.
+func (ps *PresetsService) commitApply(snapshot *model.Scene, targets []model.ThingState, report *model.ApplyReport) *model.Scene {
+	result := *snapshot
+	for i, scene := range ps.Model.Scenes {
+		if scene.ID != snapshot.ID {
+			continue
+		}
+		if len(scene.Includes) == 0 && !sameStates(scene.Things, snapshot.Things) {
+			ps.Log.Infof("scene %s was replaced while it was being applied: its undo states were not recorded", scene.ID)
+			break
+		}
+		result = *scene
+		result.Report = report
+		if len(result.Includes) > 0 {
+			result.Applied = targets
+		} else {
+			result.Things = targets
+		}
+		ps.Model.Scenes[i] = &result
+		ps.save()
+		return &result
+	}
+	result.Report = report
+	if len(result.Includes) > 0 {
+		result.Applied = targets
+	} else {
+		result.Things = targets
+	}
+	return &result
+}
+
+// answer true if the thing states are the same slice, i.e. neither has replaced the other
+func sameStates(a []model.ThingState, b []model.ThingState) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
 
 // see: http://schema.ninjablocks.com/service/presets#undoScene
 func (ps *PresetsService) UndoScene(id string) (*model.Scene, error) {
-	ps.checkInit()
+	return ps.rpcSession().UndoScene(id)
+}
+
+// restore the undo states of the scene. If limited, the undo is subject to the rate limiter.
+func (ps *PresetsService) undoScene(id string, limited bool) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("illegal argument: id is empty")
+	}
+
+	ps.mutex.Lock()
+	scene := ps.lookupScene(id)
+	if scene == nil {
+		ps.mutex.Unlock()
+		return nil, fmt.Errorf("failed to find a matching scene: %s", id)
+	}
+	if err := ps.takeToken(scene, limited); err != nil {
+		ps.mutex.Unlock()
+		return nil, err
+	}
+	snapshot := *scene
+	ps.mutex.Unlock()
+
+	// the states of a stored scene are replaced, never modified, so they may be read without the mutex
+	applied := snapshot.Things
+	if len(snapshot.Includes) > 0 {
+		applied = snapshot.Applied
+	}
+	if err := ps.enqueueUndo(applied); err != nil {
+		return nil, err
+	}
+	ps.metrics.operations.Inc(snapshot.Scope, "undo")
+	return &snapshot, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#previewScene
+func (ps *PresetsService) PreviewScene(id string) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
 	if id == "" {
 		return nil, fmt.Errorf("illegal argument: id is empty")
 	}
-	if scenes, err := ps.FetchScenes(&model.Query{ID: &id}); err != nil || scenes == nil {
+	scene := ps.lookupScene(id)
+	if scene == nil {
+		return nil, fmt.Errorf("failed to find a matching scene: %s", id)
+	}
+	things, err := scene.Resolve(ps.lookupScene)
+	if err != nil {
 		return nil, err
+	}
+	result := &model.Scene{
+		ID:     scene.ID,
+		Slot:   scene.Slot,
+		Label:  scene.Label,
+		Scope:  scene.Scope,
+		Things: make([]model.ThingState, len(things)),
+	}
+	for i, t := range things {
+		result.Things[i] = *t.MergeUndoState(nil)
+	}
+	return result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#auditOrphans
+func (ps *PresetsService) AuditOrphans(r *model.OrphanRequest) (*[]*model.Scene, error) {
+	return ps.rpcSession().AuditOrphans(r)
+}
+
+// audit the scenes selected by the request for orphans and apply the action of the request.
+// Answers the audited scenes and the ids of the pruned scenes.
+func (ps *PresetsService) checkOrphans(r *model.OrphanRequest) (*[]*model.Scene, []string, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, nil, err
+	}
+
+	switch r.Action {
+	case "":
+		r.Action = model.OrphanReport
+	case model.OrphanReport, model.OrphanPrune, model.OrphanMarkStale:
+	default:
+		return nil, nil, fmt.Errorf("illegal argument: unrecognized orphan action: %s", r.Action)
+	}
+
+	if scope, _, _, err := ps.parseScope(r.Scope); err != nil {
+		return nil, nil, err
 	} else {
-		thingClient := ps.Conn.GetServiceClient("$home/services/ThingModel")
-		for _, scene := range *scenes {
-			things := make([]*model.ThingState, 0, len(scene.Things))
-			for _, t := range scene.Things {
-
-				thing := &nmodel.Thing{}
-				if err := thingClient.Call("fetch", []string{t.ID}, &thing, defaultTimeout); err != nil {
-					ps.Log.Errorf("failed to obtain thing '%s': %v", id, err)
-					continue
-				}
-				current := ps.createThingState(thing)
+		result, pruned, err := ps.auditOrphans(&model.Query{Scope: &scope, ID: r.ID}, r.Action, r.Author)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &result, pruned, nil
+	}
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchZones
+func (ps *PresetsService) FetchZones() (*[]*model.Zone, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	result := make([]*model.Zone, len(ps.Model.Zones))
+	copy(result, ps.Model.Zones)
+	return &result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#storeZone
+func (ps *PresetsService) StoreZone(z *model.Zone) (*model.Zone, error) {
+	return ps.rpcSession().StoreZone(z)
+}
+
+// store the zone, replacing any zone with the same id
+func (ps *PresetsService) storeZone(z *model.Zone) (*model.Zone, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if z.ID == "" {
+		z.ID = uuid.NewUUID().String()
+	} else if strings.Contains(z.ID, ":") {
+		return nil, fmt.Errorf("illegal argument: zone id cannot contain ':'")
+	}
+
+	if z.Label == "" {
+		z.Label = z.ID
+	}
 
-				// only undo channels that have not been modified since the scene was applied.
+	if z.Rooms == nil {
+		z.Rooms = []string{}
+	}
+
+	for i, e := range ps.Model.Zones {
+		if e.ID == z.ID {
+			ps.Model.Zones[i] = z
+			ps.save()
+			return z, nil
+		}
+	}
+	ps.Model.Zones = append(ps.Model.Zones, z)
+	ps.save()
+	return z, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#deleteZone
+func (ps *PresetsService) DeleteZone(id string) (*model.Zone, error) {
+	return ps.rpcSession().DeleteZone(id)
+}
+
+// delete the zone, unless it is the scope of any scene
+func (ps *PresetsService) deleteZone(id string) (*model.Zone, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scope := "zone:" + id
+	if used := ps.match(&model.Query{Scope: &scope}); len(used) > 0 {
+		return nil, fmt.Errorf("cannot delete zone '%s': it is the scope of %d scenes", id, len(used))
+	}
+
+	for i, z := range ps.Model.Zones {
+		if z.ID == id {
+			ps.Model.Zones = append(ps.Model.Zones[:i], ps.Model.Zones[i+1:]...)
+			ps.save()
+			return z, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find a matching zone: %s", id)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#moveScene
+func (ps *PresetsService) MoveScene(r *model.SlotRequest) (*[]*model.Scene, error) {
+	return ps.rpcSession().MoveScene(r)
+}
+
+// move the scene to an empty slot of its scope. Answers the scenes of the scope and the ids of
+// the moved scenes.
+func (ps *PresetsService) moveScene(r *model.SlotRequest) (*[]*model.Scene, []string, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
 
-				matched := t.MatchState(current)
-				things = append(things, matched)
+	scope, err := ps.slotScope(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	x, err := ps.sceneIn(scope, r.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if y := ps.sceneAt(scope, r.Slot); y >= 0 && y != x {
+		return nil, nil, fmt.Errorf("illegal argument: slot %d of scope %s is occupied by scene '%s'", r.Slot, scope, ps.Model.Scenes[y].ID)
+	}
+	return ps.applySlotPlan(scope, model.RevisionMove, map[int]int{x: r.Slot}, r.Author)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#swapSlots
+func (ps *PresetsService) SwapSlots(r *model.SlotRequest) (*[]*model.Scene, error) {
+	return ps.rpcSession().SwapSlots(r)
+}
+
+// swap the scenes, if any, in two slots of the scope. Answers the scenes of the scope and the
+// ids of the moved scenes.
+func (ps *PresetsService) swapSlots(r *model.SlotRequest) (*[]*model.Scene, []string, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scope, err := ps.slotScope(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, slot := range []int{r.Slot, r.With} {
+		if err := ps.checkSlot(scope, slot); err != nil {
+			return nil, nil, err
+		}
+	}
+	plan := make(map[int]int)
+	if x := ps.sceneAt(scope, r.Slot); x >= 0 {
+		plan[x] = r.With
+	}
+	if y := ps.sceneAt(scope, r.With); y >= 0 {
+		plan[y] = r.Slot
+	}
+	return ps.applySlotPlan(scope, model.RevisionSwap, plan, r.Author)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#insertScene
+func (ps *PresetsService) InsertScene(r *model.SlotRequest) (*[]*model.Scene, error) {
+	return ps.rpcSession().InsertScene(r)
+}
+
+// move the scene to a slot of its scope, shifting the scenes from that slot onwards down.
+// Answers the scenes of the scope and the ids of the moved scenes.
+func (ps *PresetsService) insertScene(r *model.SlotRequest) (*[]*model.Scene, []string, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scope, err := ps.slotScope(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	x, err := ps.sceneIn(scope, r.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// shift the contiguous run of occupied slots that starts at the target slot down by one
+	plan := map[int]int{x: r.Slot}
+	for slot := r.Slot; ; slot++ {
+		y := ps.sceneAt(scope, slot)
+		if y < 0 || y == x {
+			break
+		}
+		plan[y] = slot + 1
+	}
+	return ps.applySlotPlan(scope, model.RevisionInsert, plan, r.Author)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#compactSlots
+func (ps *PresetsService) CompactSlots(r *model.SlotRequest) (*[]*model.Scene, error) {
+	return ps.rpcSession().CompactSlots(r)
+}
+
+// renumber the scenes of the scope from slot 1, without gaps, in the order of their slots.
+// Answers the scenes of the scope and the ids of the moved scenes.
+func (ps *PresetsService) compactSlots(r *model.SlotRequest) (*[]*model.Scene, []string, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scope, err := ps.slotScope(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan := make(map[int]int)
+	for i, x := range ps.scopeScenes(scope) {
+		plan[x] = i + 1
+	}
+	return ps.applySlotPlan(scope, model.RevisionCompact, plan, r.Author)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#setSlotLimit
+func (ps *PresetsService) SetSlotLimit(l *model.SlotLimit) (*model.SlotLimit, error) {
+	return ps.rpcSession().SetSlotLimit(l)
+}
+
+// limit the slots of the scope, unless a scene of the scope occupies a slot beyond the limit
+func (ps *PresetsService) setSlotLimit(l *model.SlotLimit) (*model.SlotLimit, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scope, err := ps.slotScope(&model.SlotRequest{Scope: l.Scope})
+	if err != nil {
+		return nil, err
+	}
+	if l.Max < 0 {
+		return nil, fmt.Errorf("illegal argument: max cannot be negative: %d", l.Max)
+	}
+	for _, x := range ps.scopeScenes(scope) {
+		if m := ps.Model.Scenes[x]; l.Max > 0 && m.Slot > l.Max {
+			return nil, fmt.Errorf("illegal state: scene '%s' occupies slot %d of scope %s, which exceeds %d", m.ID, m.Slot, scope, l.Max)
+		}
+	}
+
+	if ps.Model.SlotLimits == nil {
+		ps.Model.SlotLimits = make(map[string]int)
+	}
+	ps.Model.SlotLimits[scope] = l.Max
+	ps.save()
+	return &model.SlotLimit{Scope: scope, Max: l.Max}, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchSlotLimit
+func (ps *PresetsService) FetchSlotLimit(scope string) (*model.SlotLimit, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	normalized, err := ps.slotScope(&model.SlotRequest{Scope: scope})
+	if err != nil {
+		return nil, err
+	}
+	return &model.SlotLimit{Scope: normalized, Max: ps.slotLimit(normalized)}, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#applySlot
+func (ps *PresetsService) ApplySlot(r *model.SlotRequest) (*model.Scene, error) {
+	return ps.rpcSession().ApplySlot(r)
+}
+
+func (ps *PresetsService) applySlot(r *model.SlotRequest, caller model.Caller) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if id, err := ps.sceneInSlot(r); err != nil {
+		return nil, err
+	} else {
+		return ps.applyScene(id, caller)
+	}
+}
+
+// see: http://schema.ninjablocks.com/service/presets#undoSlot
+func (ps *PresetsService) UndoSlot(r *model.SlotRequest) (*model.Scene, error) {
+	return ps.rpcSession().UndoSlot(r)
+}
+
+func (ps *PresetsService) undoSlot(r *model.SlotRequest, caller model.Caller) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if id, err := ps.sceneInSlot(r); err != nil {
+		return nil, err
+	} else {
+		return ps.undoScene(id, rateLimited(caller))
+	}
+}
+
+// see: http://schema.ninjablocks.com/service/presets#previewSlot
+func (ps *PresetsService) PreviewSlot(r *model.SlotRequest) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if id, err := ps.sceneInSlot(r); err != nil {
+		return nil, err
+	} else {
+		return ps.PreviewScene(id)
+	}
+}
+
+// see: http://schema.ninjablocks.com/service/presets#captureScene
+func (ps *PresetsService) CaptureScene(r *model.CaptureRequest) (*model.CaptureResult, error) {
+	return ps.rpcSession().CaptureScene(r)
+}
+
+func (ps *PresetsService) captureScene(r *model.CaptureRequest) (*model.CaptureResult, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+
+	if r.Scope == "" {
+		r.Scope = "site"
+	}
+	scope, rooms, _, err := ps.parseScope(&r.Scope)
+	if err != nil {
+		return nil, err
+	}
+	if r.Update && r.ID == "" && r.Slot <= 0 {
+		return nil, fmt.Errorf("illegal argument: an update must specify the id or slot of the scene")
+	}
+
+	things, err := ps.fetchThingsInScope(rooms)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &model.CaptureResult{
+		Captured: make([]model.ChannelRef, 0),
+		Skipped:  make([]model.SkippedChannel, 0),
+	}
+
+	requested := make(map[string]bool)
+	for _, id := range r.Things {
+		requested[id] = true
+	}
+	schemas := make(map[string]bool)
+	for _, schema := range r.Schemas {
+		schemas[schema] = true
+	}
+
+	scene := &model.Scene{
+		Scope:  scope,
+		Slot:   r.Slot,
+		Label:  r.Label,
+		Things: make([]model.ThingState, 0, len(things)),
+	}
+	if r.Update {
+		if existing := ps.sceneToUpdate(r, scope); existing != nil {
+			copied := *existing
+			scene = &copied
+			scene.Things = make([]model.ThingState, 0, len(things))
+			if r.Label != "" {
+				scene.Label = r.Label
 			}
+		}
+	}
+	if scene.ID == "" {
+		if err := ps.captureSlot(scene); err != nil {
+			return nil, err
+		}
+	}
 
-			for _, t := range things {
-				for _, c := range t.Channels {
-					if c.UndoState != nil {
-						ps.queue <- &task{
-							topic:   fmt.Sprintf("$thing/%s/channel/%s", t.ID, c.ID),
-							method:  "set",
-							payload: c.UndoState,
-						}
-					} else {
-						ps.Log.Warningf("No undo state found for thing ID, channelID: %s, %s. Channel undo ignored.", t.ID, c.ID)
-					}
-				}
+	for _, t := range things {
+		if len(requested) > 0 {
+			if !requested[t.ID] {
+				continue
+			}
+			delete(requested, t.ID)
+		}
+		ts, skipped := ps.inspectThing(t, schemas)
+		result.Skipped = append(result.Skipped, skipped...)
+		if ts != nil {
+			scene.Things = append(scene.Things, *ts)
+			for _, ch := range ts.Channels {
+				result.Captured = append(result.Captured, model.ChannelRef{Thing: ts.ID, Channel: ch.ID})
+			}
+		}
+	}
+	for _, id := range r.Things {
+		if requested[id] {
+			result.Skipped = append(result.Skipped, model.SkippedChannel{
+				Thing:  id,
+				Reason: fmt.Sprintf("thing is not a promoted thing in scope %s", scope),
+			})
+		}
+	}
+
+	scene.ModifiedBy = r.Author
+	if result.Scene, err = ps.store(scene); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#refreshScene
+func (ps *PresetsService) RefreshScene(r *model.RefreshRequest) (*model.RefreshResult, error) {
+	return ps.rpcSession().RefreshScene(r)
+}
+
+func (ps *PresetsService) refreshScene(r *model.RefreshRequest) (*model.RefreshResult, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+
+	if r.ID == "" {
+		return nil, fmt.Errorf("illegal argument: id is empty")
+	}
+
+	ps.mutex.Lock()
+	scene := ps.lookupScene(r.ID)
+	var copied model.Scene
+	if scene != nil {
+		copied = *scene
+	}
+	ps.mutex.Unlock()
+	if scene == nil {
+		return nil, fmt.Errorf("failed to find a matching scene: %s", r.ID)
+	}
+
+	_, rooms, _, err := ps.parseScope(&copied.Scope)
+	if err != nil {
+		return nil, err
+	}
+	things, err := ps.fetchThingsInScope(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	inRooms := make(map[string]bool)
+	for _, room := range rooms {
+		inRooms[room] = true
+	}
+
+	current := make(map[string]*model.ThingState)
+	inScope := make([]*model.ThingState, 0, len(things))
+	for _, t := range things {
+		if ts := ps.createThingState(t); ts != nil {
+			current[t.ID] = ts
+			if rooms == nil || (t.Location != nil && inRooms[*t.Location]) {
+				inScope = append(inScope, ts)
 			}
-			ps.Save(ps.Model)
-			return scene, nil
 		}
+	}
+
+	result := &model.RefreshResult{
+		Skipped: make([]model.SkippedChannel, 0),
+	}
+	refreshed := copied
+	refreshed.ModifiedBy = r.Author
+	refreshed.Things = make([]model.ThingState, 0, len(copied.Things))
+	present := make(map[string]bool)
+	for _, t := range copied.Things {
+		present[t.ID] = true
+		ts := model.ThingState{
+			ID:       t.ID,
+			Channels: make([]model.ChannelState, len(t.Channels)),
+			Guard:    t.Guard,
+		}
+		copy(ts.Channels, t.Channels)
+
+		c, ok := current[t.ID]
+		if !ok {
+			result.Skipped = append(result.Skipped, model.SkippedChannel{Thing: t.ID, Reason: "thing is not a presetable thing"})
+			refreshed.Things = append(refreshed.Things, ts)
+			continue
+		}
+		states := make(map[string]interface{})
+		for _, ch := range c.Channels {
+			states[ch.ID] = ch.State
+		}
+		for i := range ts.Channels {
+			if state, ok := states[ts.Channels[i].ID]; ok {
+				ts.Channels[i].State = state
+			} else {
+				result.Skipped = append(result.Skipped, model.SkippedChannel{Thing: t.ID, Channel: ts.Channels[i].ID, Reason: "channel is not a presetable channel"})
+			}
+		}
+		refreshed.Things = append(refreshed.Things, ts)
+	}
+
+	if r.AddNew {
+		for _, ts := range inScope {
+			if !present[ts.ID] {
+				refreshed.Things = append(refreshed.Things, *ts)
+			}
+		}
+	}
+
+	result.Diff = copied.Diff(&refreshed)
+	result.Scene = &refreshed
+	if !r.DryRun {
+		if result.Scene, err = ps.store(&refreshed); err != nil {
+			return nil, err
+		}
+		result.Stored = true
+	}
+	return result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#diffScenes
+func (ps *PresetsService) DiffScenes(r *model.DiffRequest) (*model.SceneDiff, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if r.From == "" || r.To == "" {
+		return nil, fmt.Errorf("illegal argument: both from and to must be specified")
+	}
+	from, err := ps.sceneAsOf(r.From, r.FromRevision)
+	if err != nil {
+		return nil, err
+	}
+	to, err := ps.sceneAsOf(r.To, r.ToRevision)
+	if err != nil {
+		return nil, err
+	}
+	return from.Diff(to), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchRevisions
+func (ps *PresetsService) FetchRevisions(id string) (*[]*model.Revision, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.lookupScene(id) == nil {
 		return nil, fmt.Errorf("failed to find a matching scene: %s", id)
 	}
+	result := append(make([]*model.Revision, 0), ps.Model.Revisions[id]...)
+	return &result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchRevision
+func (ps *PresetsService) FetchRevision(r *model.RevisionRequest) (*model.Revision, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.lookupRevision(r.ID, r.Revision)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#rollbackScene
+func (ps *PresetsService) RollbackScene(r *model.RevisionRequest) (*model.Scene, error) {
+	return ps.rpcSession().RollbackScene(r)
+}
+
+func (ps *PresetsService) rollbackScene(r *model.RevisionRequest) (*model.Scene, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	current := ps.lookupScene(r.ID)
+	if current == nil {
+		return nil, fmt.Errorf("failed to find a matching scene: %s", r.ID)
+	}
+	revision, err := ps.lookupRevision(r.ID, r.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// the scene keeps its current position; only its contents are rolled back
+	restored := snapshotScene(revision.Scene)
+	restored.Scope = current.Scope
+	restored.Slot = current.Slot
+	restored.ModifiedBy = r.Author
+	return ps.storeScene(restored, model.RevisionRollback, revision.Revision)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchAudit
+func (ps *PresetsService) FetchAudit(q *model.AuditQuery) (*[]*model.AuditEntry, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	if ps.Audit == nil {
+		return nil, fmt.Errorf("illegal state: the audit log is not enabled")
+	}
+	entries, err := ps.Audit.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	return &entries, nil
+}
+
+// answer the API keys, without their hashes
+func (ps *PresetsService) fetchKeys() (*[]*model.APIKey, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	result := make([]*model.APIKey, len(ps.Model.Keys))
+	for i, k := range ps.Model.Keys {
+		copied := *k
+		copied.Hash = ""
+		result[i] = &copied
+	}
+	return &result, nil
+}
+
+// create an API key with the requested name and role. Answers the key, which is not stored.
+func (ps *PresetsService) createKey(r *model.KeyRequest) (*model.KeyGrant, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if r.Name == "" {
+		return nil, fmt.Errorf("illegal argument: name is empty")
+	}
+	if model.RoleLevel(r.Role) == 0 {
+		return nil, fmt.Errorf("illegal argument: unknown role: %s", r.Role)
+	}
+	if ps.keyIndex(r.Name) >= 0 {
+		return nil, fmt.Errorf("illegal argument: a key named %s already exists", r.Name)
+	}
+
+	key, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	created := time.Now()
+	ps.Model.Keys = append(ps.Model.Keys, &model.APIKey{
+		Name:    r.Name,
+		Role:    r.Role,
+		Hash:    model.HashKey(key),
+		Created: created,
+	})
+	ps.save()
+	return &model.KeyGrant{
+		Name:    r.Name,
+		Role:    r.Role,
+		Key:     key,
+		Created: created,
+	}, nil
+}
+
+// delete the API key with the specified name
+func (ps *PresetsService) deleteKey(name string) (*model.APIKey, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	x := ps.keyIndex(name)
+	if x < 0 {
+		return nil, fmt.Errorf("failed to find a matching key: %s", name)
+	}
+	deleted := *ps.Model.Keys[x]
+	deleted.Hash = ""
+	ps.Model.Keys = append(ps.Model.Keys[:x], ps.Model.Keys[x+1:]...)
+	ps.save()
+	return &deleted, nil
 }
@@ -1,12 +1,24 @@
 package service
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ninjasphere/app-presets/audit"
+	"github.com/ninjasphere/app-presets/metrics"
 	"github.com/ninjasphere/app-presets/model"
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/logger"
 	nmodel "github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/go-ninja/rpc"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var saved = make([]*model.Presets, 0)
@@ -22,6 +34,99 @@ func (*mockConnection) GetServiceClient(serviceTopic string) *ninja.ServiceClien
 	return nil
 }
 
+// mockThingModel answers fetch and fetchAll calls from a fixed set of things and
+// records the set calls made to thing channels.
+type mockThingModel struct {
+	sync.Mutex
+	things []*nmodel.Thing
+	sets   map[string]interface{}
+	delay  time.Duration // the time taken by each set call
+}
+
+type mockClient struct {
+	topic string
+	tm    *mockThingModel
+}
+
+func (c *mockClient) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	switch method {
+	case "fetchAll":
+		return roundTrip(c.tm.things, reply)
+	case "fetch":
+		id := args.([]string)[0]
+		for _, t := range c.tm.things {
+			if t.ID == id {
+				return roundTrip(t, reply)
+			}
+		}
+		return fmt.Errorf("no such thing: %s", id)
+	case "set":
+		time.Sleep(c.tm.delay)
+		if c.tm.sets == nil {
+			c.tm.sets = make(map[string]interface{})
+		}
+		c.tm.sets[c.topic] = args
+		return nil
+	}
+	return fmt.Errorf("unsupported method: %s", method)
+}
+
+func roundTrip(in interface{}, out interface{}) error {
+	if b, err := json.Marshal(in); err != nil {
+		return err
+	} else {
+		return json.Unmarshal(b, out)
+	}
+}
+
+// make a promoted thing in the specified room with settable channels in the specified states
+func makeThing(id string, room string, states map[string]interface{}) *nmodel.Thing {
+	channels := make([]*nmodel.Channel, 0, len(states))
+	for ch, state := range states {
+		channels = append(channels, &nmodel.Channel{
+			ID:               ch,
+			SupportedMethods: &[]string{"set"},
+			LastState:        map[string]interface{}{"payload": state},
+		})
+	}
+	return &nmodel.Thing{
+		ID:       id,
+		Promoted: true,
+		Location: &room,
+		Device: &nmodel.Device{
+			Channels: &channels,
+		},
+	}
+}
+
+// wait until the specified number of channels have been set
+func (tm *mockThingModel) waitForSets(n int) map[string]interface{} {
+	for i := 0; i < 100; i++ {
+		tm.Lock()
+		if len(tm.sets) >= n {
+			result := tm.sets
+			tm.sets = nil
+			tm.Unlock()
+			return result
+		}
+		tm.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// make a service whose thing model contains the specified things
+func makeServiceWithThings(things ...*nmodel.Thing) (error, *PresetsService, *mockThingModel) {
+	tm := &mockThingModel{things: things}
+	err, s := makeService()
+	s.client = func(topic string) serviceClient {
+		return &mockClient{topic: topic, tm: tm}
+	}
+	return err, s, tm
+}
+
 func makeService() (error, *PresetsService) {
 	service := &PresetsService{
 		Model: &model.Presets{
@@ -115,3 +220,2180 @@ func TestStoreScene(t *testing.T) {
 		}
 	}
 }
+
+func TestStoreSceneSlotCollision(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	first, err := s.StoreScene(&model.Scene{Scope: "room:lounge", Slot: 2, Label: "first"})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	if _, err := s.StoreScene(&model.Scene{Scope: "room:lounge", Slot: 2, Label: "second"}); err == nil {
+		t.Fatalf("expected an error when storing into an occupied slot")
+	} else if conflict, ok := err.(*SlotConflictError); !ok || conflict.ID != first.ID || conflict.Slot != 2 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if scene := s.lookupScene(first.ID); scene == nil || scene.Label != "first" {
+		t.Fatalf("expected the scene in the slot to be retained: %+v", scene)
+	}
+
+	// a scene without a slot takes the first free slot, and a stored scene keeps its slot
+	second, err := s.StoreScene(&model.Scene{Scope: "room:lounge", Label: "second"})
+	if err != nil || second.Slot != 1 {
+		t.Fatalf("unexpected scene: %+v, %v", second, err)
+	}
+	if third, err := s.StoreScene(&model.Scene{Scope: "room:lounge", Label: "third"}); err != nil || third.Slot != 3 {
+		t.Fatalf("unexpected scene: %+v, %v", third, err)
+	}
+	if updated, err := s.StoreScene(&model.Scene{ID: first.ID, Scope: "room:lounge", Label: "updated"}); err != nil || updated.Slot != 2 {
+		t.Fatalf("unexpected scene: %+v, %v", updated, err)
+	}
+	scope := "room:lounge"
+	if scenes, _ := s.FetchScenes(&model.Query{Scope: &scope}); len(*scenes) != 3 {
+		t.Fatalf("expected 3 scenes, found %d", len(*scenes))
+	}
+}
+
+func TestAuditOrphans(t *testing.T) {
+	err, s, _ := makeServiceWithThings(makeThing("thing-1", "room-1", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.Model.Scenes[0].Things = []model.ThingState{
+		{ID: "thing-1", Channels: []model.ChannelState{{ID: "on-off", State: false}, {ID: "brightness", State: 0.5}}},
+		{ID: "thing-2", Channels: []model.ChannelState{{ID: "on-off", State: false}}},
+	}
+
+	scenes, err := s.AuditOrphans(&model.OrphanRequest{})
+	if err != nil || scenes == nil || len(*scenes) != 1 {
+		t.Fatalf("unexpected audit result: %v, %v", scenes, err)
+	}
+	health := (*scenes)[0].Health
+	if health == nil || health.Status != model.HealthOrphaned || len(health.Orphans) != 2 {
+		t.Fatalf("unexpected health: %+v", health)
+	}
+	if health.Orphans[0] != (model.Orphan{Thing: "thing-1", Channel: "brightness"}) ||
+		health.Orphans[1] != (model.Orphan{Thing: "thing-2"}) {
+		t.Fatalf("unexpected orphans: %+v", health.Orphans)
+	}
+	if len(s.Model.Scenes[0].Things) != 2 {
+		t.Fatalf("report must not modify the scene")
+	}
+
+	reported := s.Model.Scenes[0]
+	if _, err := s.AuditOrphans(&model.OrphanRequest{Action: model.OrphanMarkStale}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	} else if s.Model.Scenes[0].Health.Status != model.HealthStale {
+		t.Fatalf("status was %s but expected %s", s.Model.Scenes[0].Health.Status, model.HealthStale)
+	}
+	if reported.Health.Status != model.HealthOrphaned {
+		t.Fatalf("expected the audited scene to be replaced rather than modified: %+v", reported.Health)
+	}
+
+	if _, err := s.AuditOrphans(&model.OrphanRequest{Action: model.OrphanPrune}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	scene := s.Model.Scenes[0]
+	if scene.Health.Status != model.HealthOK || len(scene.Things) != 1 || len(scene.Things[0].Channels) != 1 {
+		t.Fatalf("unexpected scene after prune: %+v", scene)
+	}
+}
+
+func TestAuditOrphansBadAction(t *testing.T) {
+	err, s, _ := makeServiceWithThings()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.AuditOrphans(&model.OrphanRequest{Action: "explode"}); err == nil || !strings.Contains(err.Error(), "unrecognized") {
+		t.Fatalf("err was %v but expected an unrecognized action error", err)
+	}
+}
+
+func TestApplyCompositeScene(t *testing.T) {
+	err, s, tm := makeServiceWithThings(
+		makeThing("lamp", "room-1", map[string]interface{}{"on-off": false, "brightness": 1.0}),
+		makeThing("kitchen", "room-2", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	for _, m := range []*model.Scene{
+		{ID: "dim", Scope: "site", Slot: 2, Things: []model.ThingState{
+			{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: true}, {ID: "brightness", State: 0.2}}},
+		}},
+		{ID: "off", Scope: "site", Slot: 3, Things: []model.ThingState{
+			{ID: "kitchen", Channels: []model.ChannelState{{ID: "on-off", State: false}}},
+		}},
+		{ID: "movie", Scope: "site", Slot: 4, Includes: []string{"dim", "off"}, Things: []model.ThingState{
+			{ID: "lamp", Channels: []model.ChannelState{{ID: "brightness", State: 0.1}}},
+		}},
+	} {
+		if _, err := s.StoreScene(m); err != nil {
+			t.Fatalf("failed to store %s: %v", m.ID, err)
+		}
+	}
+
+	if _, err := s.StoreScene(&model.Scene{ID: "dim", Slot: 2, Includes: []string{"movie"}}); err == nil {
+		t.Fatalf("expected storing a cyclic include to fail")
+	}
+
+	if preview, err := s.PreviewScene("movie"); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	} else if len(preview.Things) != 2 || preview.Things[0].Channels[1].State != 0.1 {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	if _, err := s.ApplyScene("movie"); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	sets := tm.waitForSets(3)
+	if sets["$thing/lamp/channel/brightness"] != 0.1 || sets["$thing/kitchen/channel/on-off"] != false {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	if applied := s.lookupScene("movie").Applied; len(applied) != 2 || applied[0].Channels[1].UndoState != 1.0 {
+		t.Fatalf("unexpected applied state: %+v", applied)
+	}
+
+	off := "off"
+	s.DeleteScenes(&model.Query{ID: &off})
+	if _, err := s.ApplyScene("movie"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("err was %v but expected a missing scene error", err)
+	}
+}
+
+func TestApplyRelativeScene(t *testing.T) {
+	err, s, tm := makeServiceWithThings(makeThing("lamp", "room-1", map[string]interface{}{"on-off": true, "brightness": 0.5}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	scene, err := s.StoreScene(&model.Scene{Slot: 2, Things: []model.ThingState{
+		{ID: "lamp", Channels: []model.ChannelState{
+			{ID: "on-off", Adjust: &model.Adjustment{Op: model.AdjustToggle}},
+			{ID: "brightness", Adjust: &model.Adjustment{Op: model.AdjustIncrease, By: 80, Percent: true}},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	if _, err := s.ApplyScene(scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	sets := tm.waitForSets(2)
+	if sets["$thing/lamp/channel/on-off"] != false || sets["$thing/lamp/channel/brightness"] != 1.0 {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	ch := s.lookupScene(scene.ID).Things[0].Channels[1]
+	if ch.State != 1.0 || ch.UndoState != 0.5 {
+		t.Fatalf("unexpected channel state after apply: %+v", ch)
+	}
+
+	// a relative scene applied again within the coalescing window adjusts the current states again,
+	// but keeps the undo states of the first apply
+	s.limiter = newRateLimiter(0, 0)
+	tm.Lock()
+	for _, c := range *tm.things[0].Device.Channels {
+		c.LastState = map[string]interface{}{"payload": map[string]interface{}{"on-off": false, "brightness": 0.0}[c.ID]}
+	}
+	tm.Unlock()
+	if _, err := s.ApplyScene(scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	sets = tm.waitForSets(2)
+	if sets["$thing/lamp/channel/on-off"] != true || sets["$thing/lamp/channel/brightness"] != 0.8 {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	if ch := s.lookupScene(scene.ID).Things[0].Channels[0]; ch.UndoState != true {
+		t.Fatalf("unexpected channel state after reapply: %+v", ch)
+	}
+
+	if _, err := s.StoreScene(&model.Scene{Slot: 3, Things: []model.ThingState{
+		{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", Adjust: &model.Adjustment{Op: "flip"}}}},
+	}}); err == nil {
+		t.Fatalf("expected an unrecognized adjustment to be rejected")
+	}
+}
+
+func TestApplyRelativeTemperature(t *testing.T) {
+	err, s, tm := makeServiceWithThings(makeThing("heater", "room-1", map[string]interface{}{"temperature": 18.0, "humidity": 40.0}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.limiter = newRateLimiter(0, 0)
+
+	// the range of a temperature is not known, so an adjustment must specify its bound
+	min, max := 38.0, 20.0
+	scene, err := s.StoreScene(&model.Scene{Slot: 2, Things: []model.ThingState{
+		{ID: "heater", Channels: []model.ChannelState{
+			{ID: "temperature", Adjust: &model.Adjustment{Op: model.AdjustIncrease, By: 5}},
+			{ID: "humidity", Adjust: &model.Adjustment{Op: model.AdjustDecrease, By: 5, Min: &min}},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	applied, err := s.ApplyScene(scene.ID)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if sets := tm.waitForSets(1); len(sets) != 1 || sets["$thing/heater/channel/humidity"] != 38.0 {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	if skipped := applied.Report.Skipped; len(skipped) != 1 || skipped[0].Channel != "temperature" || !strings.Contains(skipped[0].Reason, "max must be specified") {
+		t.Fatalf("unexpected skipped channels: %+v", skipped)
+	}
+
+	// and is clamped to it
+	if _, err := s.StoreScene(&model.Scene{ID: scene.ID, Slot: 2, Things: []model.ThingState{
+		{ID: "heater", Channels: []model.ChannelState{
+			{ID: "temperature", Adjust: &model.Adjustment{Op: model.AdjustIncrease, By: 5, Max: &max}},
+		}},
+	}}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.ApplyScene(scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if sets := tm.waitForSets(1); sets["$thing/heater/channel/temperature"] != 20.0 {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+}
+
+func TestApplyGuardedScene(t *testing.T) {
+	err, s, tm := makeServiceWithThings(
+		makeThing("heater", "room-1", map[string]interface{}{"on-off": false, "temperature": 18.0}),
+		makeThing("lamp", "room-1", map[string]interface{}{"on-off": false, "brightness": 0.5}),
+		makeThing("lux", "room-1", map[string]interface{}{"illuminance": 42.0}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	scene, err := s.StoreScene(&model.Scene{Slot: 2, Things: []model.ThingState{
+		{ID: "heater", Guard: `channel("on-off") == true`, Channels: []model.ChannelState{{ID: "temperature", State: 21.0}}},
+		{ID: "lamp", Channels: []model.ChannelState{
+			{ID: "on-off", State: true, Guard: `thing("lux", "illuminance") < 50`},
+			{ID: "brightness", State: 1.0, Guard: `state < 0.25`},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	applied, err := s.ApplyScene(scene.ID)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	sets := tm.waitForSets(1)
+	if len(sets) != 1 || sets["$thing/lamp/channel/on-off"] != true {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	skipped := applied.Report.Skipped
+	if len(skipped) != 2 ||
+		skipped[0].Thing != "heater" || skipped[0].Channel != "" ||
+		skipped[1].Thing != "lamp" || skipped[1].Channel != "brightness" ||
+		!strings.Contains(skipped[1].Reason, "not satisfied") {
+		t.Fatalf("unexpected skipped channels: %+v", skipped)
+	}
+
+	if _, err := s.StoreScene(&model.Scene{Slot: 3, Things: []model.ThingState{
+		{ID: "lamp", Guard: `state ==`, Channels: []model.ChannelState{{ID: "on-off", State: true}}},
+	}}); err == nil {
+		t.Fatalf("expected a bad guard to be rejected")
+	}
+}
+
+func TestZones(t *testing.T) {
+	err, s, _ := makeServiceWithThings(
+		makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}),
+		makeThing("kettle", "kitchen", map[string]interface{}{"on-off": false}),
+		makeThing("heater", "bedroom", map[string]interface{}{"on-off": false}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	if _, err := s.StoreZone(&model.Zone{ID: "downstairs", Rooms: []string{"lounge", "kitchen"}}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if zones, err := s.FetchZones(); err != nil || len(*zones) != 1 || (*zones)[0].Label != "downstairs" {
+		t.Fatalf("unexpected zones: %v, %v", zones, err)
+	}
+
+	prototype, err := s.FetchScenePrototype("zone:downstairs")
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	} else if prototype.Scope != "zone:downstairs" || len(prototype.Things) != 2 {
+		t.Fatalf("unexpected prototype: %+v", prototype)
+	}
+
+	prototype.Slot = 1
+	if _, err := s.StoreScene(prototype); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.StoreScene(&model.Scene{Scope: "room:bedroom", Slot: 1}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if len(s.Model.Scenes) != 3 {
+		t.Fatalf("zone slots must be numbered independently of other scopes: %d scenes", len(s.Model.Scenes))
+	}
+
+	room := "kitchen"
+	if scenes, err := s.FetchScenes(&model.Query{Room: &room}); err != nil || len(*scenes) != 1 || (*scenes)[0].Scope != "zone:downstairs" {
+		t.Fatalf("unexpected scenes touching the kitchen: %v, %v", scenes, err)
+	}
+	room = "bedroom"
+	if scenes, err := s.FetchScenes(&model.Query{Room: &room}); err != nil || len(*scenes) != 1 || (*scenes)[0].Scope != "room:bedroom" {
+		t.Fatalf("unexpected scenes touching the bedroom: %v, %v", scenes, err)
+	}
+
+	if _, err := s.DeleteZone("downstairs"); err == nil {
+		t.Fatalf("expected deleting a zone in use to fail")
+	}
+	scope := "zone:downstairs"
+	s.DeleteScenes(&model.Query{Scope: &scope})
+	if _, err := s.DeleteZone("downstairs"); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.FetchScenePrototype("zone:downstairs"); err == nil {
+		t.Fatalf("expected an unknown zone to be rejected")
+	}
+	if _, err := s.FetchScenePrototype("room"); err == nil {
+		t.Fatalf("expected a room scope without a room id to be rejected")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	start := time.Now()
+	for _, m := range []*model.Scene{
+		{Slot: 3, Label: "Evening", Tags: []string{"evening", "lights"}, Things: []model.ThingState{
+			{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: true}}},
+		}},
+		{Slot: 2, Label: "Movie night", Tags: []string{"evening"}, Things: []model.ThingState{
+			{ID: "tv", Channels: []model.ChannelState{{ID: "on-off", State: true}}},
+		}},
+		{Slot: 4, Label: "Away", Scope: "room:lounge", Things: []model.ThingState{
+			{ID: "lamp", Channels: []model.ChannelState{{ID: "brightness", State: 0.0}}},
+		}},
+	} {
+		if _, err := s.StoreScene(m); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+
+	ids := func(q *model.Query) string {
+		scenes, err := s.FetchScenes(q)
+		if err != nil {
+			return err.Error()
+		}
+		labels := make([]string, 0)
+		for _, m := range *scenes {
+			labels = append(labels, m.Label)
+		}
+		return strings.Join(labels, ",")
+	}
+	str := func(s string) *string { return &s }
+	slot := 2
+
+	cases := []struct {
+		query    *model.Query
+		expected string
+	}{
+		{&model.Query{Label: str("NIGHT")}, "Movie night"},
+		{&model.Query{LabelRegex: str("^(Away|Evening)$"), Sort: "label"}, "Away,Evening"},
+		{&model.Query{Thing: str("lamp")}, "Evening,Away"},
+		{&model.Query{Thing: str("lamp"), Channel: str("on-off")}, "Evening"},
+		{&model.Query{Channel: str("on-off"), Sort: "-slot"}, "Evening,Movie night"},
+		{&model.Query{Tags: []string{"evening", "lights"}}, "Evening"},
+		{&model.Query{Scope: str("site"), Slot: &slot}, "Movie night"},
+		{&model.Query{ID: str("existing-uuid"), Scope: str("room:lounge")}, ""},
+		{&model.Query{ModifiedSince: &start, Sort: "slot", Offset: 1, Limit: 1}, "Movie night"},
+		{&model.Query{ModifiedSince: &start, Offset: 5}, ""},
+	}
+	for _, c := range cases {
+		if result := ids(c.query); result != c.expected {
+			t.Fatalf("query %+v answered '%s' but expected '%s'", c.query, result, c.expected)
+		}
+	}
+
+	for _, q := range []*model.Query{{LabelRegex: str("(")}, {Sort: "colour"}, {Limit: -1}} {
+		if _, err := s.FetchScenes(q); err == nil {
+			t.Fatalf("expected query %+v to be rejected", q)
+		}
+	}
+}
+
+func TestPatchSceneAndTags(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	first, err := s.StoreScene(&model.Scene{Slot: 2, Tags: []string{" evening ", "lights", "evening", ""}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	} else if strings.Join(first.Tags, ",") != "evening,lights" {
+		t.Fatalf("tags were not normalized: %v", first.Tags)
+	}
+	second, err := s.StoreScene(&model.Scene{Slot: 3, Tags: []string{"evening"}, Properties: map[string]interface{}{"order": 1.0}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	favorite, icon, color := true, "moon", "#ff8800"
+	patched, err := s.PatchScene(&model.ScenePatch{
+		ID:         second.ID,
+		Favorite:   &favorite,
+		Icon:       &icon,
+		Color:      &color,
+		Properties: map[string]interface{}{"order": nil, "page": "home"},
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if !patched.Favorite || patched.Icon != "moon" || patched.Color != "#ff8800" ||
+		len(patched.Properties) != 1 || patched.Properties["page"] != "home" || patched.Tags[0] != "evening" {
+		t.Fatalf("unexpected patched scene: %+v", patched)
+	}
+	if second.Favorite || len(second.Properties) != 1 || second.Properties["order"] != 1.0 {
+		t.Fatalf("expected the stored scene to be replaced rather than modified: %+v", second)
+	}
+
+	if scenes, err := s.FetchScenes(&model.Query{Favorite: &favorite}); err != nil || len(*scenes) != 1 || (*scenes)[0].ID != second.ID {
+		t.Fatalf("unexpected favorites: %v, %v", scenes, err)
+	}
+	page := "page"
+	if scenes, err := s.FetchScenes(&model.Query{Property: &page}); err != nil || len(*scenes) != 1 {
+		t.Fatalf("unexpected scenes with property: %v, %v", scenes, err)
+	}
+
+	bad := "orange"
+	if _, err := s.PatchScene(&model.ScenePatch{ID: second.ID, Color: &bad}); err == nil {
+		t.Fatalf("expected a bad color to be rejected")
+	}
+
+	tags, err := s.FetchTags()
+	if err != nil || len(*tags) != 2 || *(*tags)[0] != (model.TagCount{Tag: "evening", Count: 2}) || *(*tags)[1] != (model.TagCount{Tag: "lights", Count: 1}) {
+		t.Fatalf("unexpected tags: %v, %v", tags, err)
+	}
+}
+
+func TestSlotOperations(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	events := make([]*model.SlotEvent, 0)
+	s.notify = func(event string, payload interface{}) {
+		if event == "slots" {
+			events = append(events, payload.(*model.SlotEvent))
+		}
+	}
+	s.Model.Scenes = []*model.Scene{}
+	for _, slot := range []int{1, 2, 3, 5} {
+		if _, err := s.StoreScene(&model.Scene{ID: fmt.Sprintf("s%d", slot), Scope: "room:lounge", Slot: slot}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+	layout := func(scenes *[]*model.Scene) string {
+		parts := make([]string, 0)
+		for _, m := range *scenes {
+			parts = append(parts, fmt.Sprintf("%s@%d", m.ID, m.Slot))
+		}
+		return strings.Join(parts, ",")
+	}
+
+	scope := "room:lounge"
+	cases := []struct {
+		op       func(*model.SlotRequest) (*[]*model.Scene, error)
+		request  *model.SlotRequest
+		expected string
+	}{
+		{s.MoveScene, &model.SlotRequest{Scope: scope, ID: "s5", Slot: 4}, "s1@1,s2@2,s3@3,s5@4"},
+		{s.SwapSlots, &model.SlotRequest{Scope: scope, Slot: 1, With: 6}, "s2@2,s3@3,s5@4,s1@6"},
+		{s.InsertScene, &model.SlotRequest{Scope: scope, ID: "s1", Slot: 2}, "s1@2,s2@3,s3@4,s5@5"},
+		{s.CompactSlots, &model.SlotRequest{Scope: scope}, "s1@1,s2@2,s3@3,s5@4"},
+	}
+	for _, c := range cases {
+		if scenes, err := c.op(c.request); err != nil {
+			t.Fatalf("%+v: err was %v but expected nil", c.request, err)
+		} else if result := layout(scenes); result != c.expected {
+			t.Fatalf("%+v: layout was %s but expected %s", c.request, result, c.expected)
+		}
+	}
+	if len(events) != 4 || events[2].Op != "insert" || len(events[2].Changes) != 4 {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	// a revision is recorded for each scene that is moved, with the action and author
+	if _, err := NewSession(s, model.Caller{Transport: model.TransportREST, Key: "alice"}).SwapSlots(&model.SlotRequest{Scope: scope, Slot: 1, With: 2}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	for _, id := range []string{"s1", "s2"} {
+		revisions, _ := s.FetchRevisions(id)
+		last := (*revisions)[len(*revisions)-1]
+		if last.Action != model.RevisionSwap || last.Author != "alice" || last.Scene.Slot != map[string]int{"s1": 2, "s2": 1}[id] {
+			t.Fatalf("unexpected revision of %s: %+v", id, last)
+		}
+	}
+	if revisions, _ := s.FetchRevisions("s3"); (*revisions)[len(*revisions)-1].Action != model.RevisionCompact {
+		t.Fatalf("unexpected revisions of s3: %+v", revisions)
+	}
+	if _, err := s.SwapSlots(&model.SlotRequest{Scope: scope, Slot: 1, With: 2}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	if _, err := s.MoveScene(&model.SlotRequest{Scope: scope, ID: "s1", Slot: 2}); err == nil {
+		t.Fatalf("expected a move to an occupied slot to fail")
+	}
+	if _, err := s.SetSlotLimit(&model.SlotLimit{Scope: scope, Max: 3}); err == nil {
+		t.Fatalf("expected a limit below an occupied slot to fail")
+	}
+	if _, err := s.SetSlotLimit(&model.SlotLimit{Scope: scope, Max: 4}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.InsertScene(&model.SlotRequest{Scope: scope, ID: "s5", Slot: 1}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if scenes, err := s.SwapSlots(&model.SlotRequest{Scope: scope, Slot: 4, With: 5}); err == nil {
+		t.Fatalf("expected a swap beyond the limit to fail: %s", layout(scenes))
+	}
+	if _, err := s.StoreScene(&model.Scene{Scope: scope, Slot: 5}); err == nil {
+		t.Fatalf("expected a store beyond the limit to fail")
+	}
+}
+
+func TestApplySlot(t *testing.T) {
+	err, s, tm := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": false}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.StoreScene(&model.Scene{Scope: "room:lounge", Slot: 2, Things: []model.ThingState{
+		{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: true}}},
+	}}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	if scene, err := s.PreviewSlot(&model.SlotRequest{Scope: "room:lounge", Slot: 2}); err != nil || len(scene.Things) != 1 {
+		t.Fatalf("unexpected preview: %v, %v", scene, err)
+	}
+	if _, err := s.ApplySlot(&model.SlotRequest{Scope: "room:lounge", Slot: 2}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if sets := tm.waitForSets(1); sets["$thing/lamp/channel/on-off"] != true {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	if _, err := s.UndoSlot(&model.SlotRequest{Scope: "room:lounge", Slot: 2}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	_, err = s.ApplySlot(&model.SlotRequest{Scope: "room:lounge", Slot: 3})
+	if e, ok := err.(*EmptySlotError); !ok || e.Scope != "room:lounge" || e.Slot != 3 {
+		t.Fatalf("err was %v but expected an empty slot error", err)
+	}
+	if _, err := s.ApplySlot(&model.SlotRequest{Scope: "site", Slot: 1}); err == nil {
+		t.Fatalf("expected an empty site slot to fail")
+	}
+}
+
+func TestCaptureScene(t *testing.T) {
+	lamp := makeThing("lamp", "lounge", map[string]interface{}{"on-off": true, "brightness": 0.5})
+	for _, c := range *lamp.Device.Channels {
+		c.Schema = "http://schema.ninjablocks.com/protocol/" + c.ID
+	}
+	err, s, _ := makeServiceWithThings(
+		lamp,
+		makeThing("kettle", "kitchen", map[string]interface{}{"on-off": false}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	result, err := s.CaptureScene(&model.CaptureRequest{Scope: "room:lounge", Slot: 1, Label: "evening"})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if result.Scene.Scope != "room:lounge" || result.Scene.Label != "evening" || len(result.Scene.Things) != 1 || len(result.Captured) != 2 {
+		t.Fatalf("unexpected capture: %+v", result)
+	}
+	id := result.Scene.ID
+
+	if _, err := s.PatchScene(&model.ScenePatch{ID: id, Tags: &[]string{"cosy"}}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	result, err = s.CaptureScene(&model.CaptureRequest{
+		Scope:   "room:lounge",
+		Slot:    1,
+		Things:  []string{"lamp", "kettle"},
+		Schemas: []string{"http://schema.ninjablocks.com/protocol/on-off"},
+		Update:  true,
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if result.Scene.ID != id || result.Scene.Label != "evening" || len(result.Scene.Tags) != 1 {
+		t.Fatalf("expected the existing scene to be updated in place: %+v", result.Scene)
+	}
+	if len(result.Captured) != 1 || result.Captured[0].Channel != "on-off" || len(result.Skipped) != 2 {
+		t.Fatalf("unexpected capture: %+v", result)
+	}
+	scope := "room:lounge"
+	if scenes, _ := s.FetchScenes(&model.Query{Scope: &scope}); len(*scenes) != 1 {
+		t.Fatalf("expected 1 scene, found %d", len(*scenes))
+	}
+
+	// a new scene never replaces the scene in an occupied slot, and is captured into the first
+	// free slot if no slot is requested
+	if _, err := s.CaptureScene(&model.CaptureRequest{Scope: "room:lounge", Slot: 1}); err == nil {
+		t.Fatalf("expected an error when capturing into an occupied slot")
+	} else if conflict, ok := err.(*SlotConflictError); !ok || conflict.ID != id {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.CaptureScene(&model.CaptureRequest{Scope: "room:lounge", Update: true}); err == nil {
+		t.Fatalf("expected an error when updating without an id or slot")
+	}
+	if result, err := s.CaptureScene(&model.CaptureRequest{Scope: "room:lounge"}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	} else if result.Scene.Slot != 2 || result.Scene.ID == id {
+		t.Fatalf("expected a new scene in slot 2: %+v", result.Scene)
+	}
+	if scenes, _ := s.FetchScenes(&model.Query{Scope: &scope}); len(*scenes) != 2 || (*scenes)[0].ID != id {
+		t.Fatalf("unexpected scenes: %+v", scenes)
+	}
+}
+
+func TestRefreshScene(t *testing.T) {
+	err, s, tm := makeServiceWithThings(
+		makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}),
+		makeThing("tv", "lounge", map[string]interface{}{"on-off": false}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	scene, err := s.StoreScene(&model.Scene{
+		Scope: "room:lounge",
+		Slot:  2,
+		Label: "evening",
+		Things: []model.ThingState{
+			{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}},
+			{ID: "gone", Channels: []model.ChannelState{{ID: "on-off", State: false}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	result, err := s.RefreshScene(&model.RefreshRequest{ID: scene.ID, DryRun: true})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if result.Stored || len(result.Diff.Changes) != 1 || result.Diff.Changes[0].Change != model.ChangeState ||
+		result.Diff.Changes[0].To != true || len(result.Skipped) != 1 || result.Skipped[0].Thing != "gone" {
+		t.Fatalf("unexpected dry run: %+v", result)
+	}
+	if stored, _ := s.PreviewScene(scene.ID); stored.Things[0].Channels[0].State != false {
+		t.Fatalf("dry run should not have stored the scene")
+	}
+
+	tm.Lock()
+	tm.things = append(tm.things, makeThing("heater", "bedroom", map[string]interface{}{"on-off": true}))
+	tm.Unlock()
+
+	result, err = s.RefreshScene(&model.RefreshRequest{ID: scene.ID, AddNew: true})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if !result.Stored || result.Scene.ID != scene.ID || result.Scene.Label != "evening" || len(result.Scene.Things) != 3 || len(result.Diff.Changes) != 2 {
+		t.Fatalf("unexpected refresh: %+v", result)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	scene, err := s.StoreScene(&model.Scene{
+		Slot:       3,
+		Label:      "first",
+		ModifiedBy: "alice",
+		Things:     []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}}},
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	id := scene.ID
+
+	if _, err := s.StoreScene(&model.Scene{
+		ID:     id,
+		Slot:   3,
+		Label:  "first",
+		Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: true}}}},
+	}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	label := "second"
+	if _, err := s.PatchScene(&model.ScenePatch{ID: id, Label: &label, ModifiedBy: "bob"}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	revisions, err := s.FetchRevisions(id)
+	if err != nil || len(*revisions) != 3 {
+		t.Fatalf("unexpected revisions: %v, %v", revisions, err)
+	}
+	if r := (*revisions)[0]; r.Revision != 1 || r.Author != "alice" || r.Action != model.RevisionStore {
+		t.Fatalf("unexpected first revision: %+v", r)
+	}
+	if r := (*revisions)[1]; len(r.Changed) != 1 || r.Changed[0] != "things" || len(r.Diff.Changes) != 1 {
+		t.Fatalf("unexpected second revision: %+v", r)
+	}
+	if r := (*revisions)[2]; r.Author != "bob" || r.Action != model.RevisionPatch || len(r.Changed) != 1 || r.Changed[0] != "label" {
+		t.Fatalf("unexpected third revision: %+v", r)
+	}
+
+	diff, err := s.DiffScenes(&model.DiffRequest{From: id, FromRevision: 1, To: id})
+	if err != nil || len(diff.Changes) != 1 || diff.Changes[0].To != true {
+		t.Fatalf("unexpected diff: %+v, %v", diff, err)
+	}
+
+	restored, err := s.RollbackScene(&model.RevisionRequest{ID: id, Revision: 1, Author: "carol"})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if restored.Label != "first" || restored.Things[0].Channels[0].State != false {
+		t.Fatalf("unexpected rollback: %+v", restored)
+	}
+	revisions, _ = s.FetchRevisions(id)
+	if r := (*revisions)[len(*revisions)-1]; r.Revision != 4 || r.Action != model.RevisionRollback || r.Rollback != 1 || r.Author != "carol" {
+		t.Fatalf("unexpected rollback revision: %+v", r)
+	}
+
+	if _, err := s.RollbackScene(&model.RevisionRequest{ID: id, Revision: 99}); err == nil {
+		t.Fatalf("expected an error for a missing revision")
+	}
+
+	s.DeleteScenes(&model.Query{ID: &id})
+	if _, ok := s.Model.Revisions[id]; ok {
+		t.Fatalf("expected the revisions of a deleted scene to be discarded")
+	}
+}
+
+func TestRetainRevisions(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	scene := &model.Scene{ID: "retained", Slot: 4}
+	for i := 0; i < 25; i++ {
+		copied := *scene
+		copied.Label = fmt.Sprintf("label %d", i)
+		if _, err := s.StoreScene(&copied); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+	revisions := s.Model.Revisions["retained"]
+	if len(revisions) != 20 || revisions[0].Revision != 6 || revisions[19].Revision != 25 {
+		t.Fatalf("unexpected retained revisions: %d, %d..%d", len(revisions), revisions[0].Revision, revisions[len(revisions)-1].Revision)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	err, s, _ := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.FetchAudit(&model.AuditQuery{}); err == nil {
+		t.Fatalf("expected an error when the audit log is not enabled")
+	}
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if s.Audit, err = audit.Open(dir, 1024*1024, 2); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	defer s.Audit.Close()
+
+	scene, err := s.StoreScene(&model.Scene{
+		Slot:   2,
+		Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}}},
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	session := NewSession(s, model.Caller{Transport: model.TransportREST, RemoteAddr: "10.0.0.2:5000", Key: "kitchen-panel"})
+	if _, err := session.ApplyScene(scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	session.ApplyScene("missing")
+	id := scene.ID
+	session.DeleteScenes(&model.Query{ID: &id})
+
+	entries, err := s.FetchAudit(&model.AuditQuery{})
+	if err != nil || len(*entries) != 4 {
+		t.Fatalf("unexpected entries: %v, %v", entries, err)
+	}
+	if e := (*entries)[3]; e.Op != model.AuditStore || e.Caller.Transport != model.TransportRPC || e.Scenes[0] != id {
+		t.Fatalf("unexpected store entry: %+v", e)
+	}
+	if e := (*entries)[2]; e.Op != model.AuditApply || e.Caller.Key != "kitchen-panel" || e.Caller.RemoteAddr != "10.0.0.2:5000" || e.Outcome != "ok" {
+		t.Fatalf("unexpected apply entry: %+v", e)
+	}
+	if e := (*entries)[1]; e.Outcome != "error" || e.Error == "" {
+		t.Fatalf("unexpected failed apply entry: %+v", e)
+	}
+	if e := (*entries)[0]; e.Op != model.AuditDelete || len(e.Scenes) != 1 || e.Scenes[0] != id {
+		t.Fatalf("unexpected delete entry: %+v", e)
+	}
+
+	if entries, _ := s.FetchAudit(&model.AuditQuery{Scene: id, Op: model.AuditApply}); len(*entries) != 1 {
+		t.Fatalf("expected 1 apply of the scene, found %d", len(*entries))
+	}
+}
+
+func TestAuditAdministration(t *testing.T) {
+	err, s, _ := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if s.Audit, err = audit.Open(dir, 1024*1024, 2); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	defer s.Audit.Close()
+
+	orphaned := s.Model.Scenes[0]
+	orphaned.Things = []model.ThingState{{ID: "ghost", Channels: []model.ChannelState{{ID: "on-off", State: false}}}}
+	scene, err := s.StoreScene(&model.Scene{Scope: "room:lounge", Slot: 2, Things: []model.ThingState{
+		{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}},
+	}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	session := NewSession(s, model.Caller{Transport: model.TransportREST, Key: "admin-key"})
+	for _, op := range []func() error{
+		func() error {
+			_, err := session.SwapSlots(&model.SlotRequest{Scope: "room:lounge", Slot: 2, With: 5})
+			return err
+		},
+		func() error {
+			_, err := session.SetSlotLimit(&model.SlotLimit{Scope: "room:lounge", Max: 6})
+			return err
+		},
+		func() error {
+			_, err := session.StoreZone(&model.Zone{ID: "downstairs", Rooms: []string{"lounge"}})
+			return err
+		},
+		func() error { _, err := session.DeleteZone("downstairs"); return err },
+		func() error {
+			_, err := session.CreateKey(&model.KeyRequest{Name: "panel", Role: model.RoleOperator})
+			return err
+		},
+		func() error { _, err := session.DeleteKey("panel"); return err },
+		func() error { _, err := session.AuditOrphans(&model.OrphanRequest{}); return err },
+		func() error {
+			_, err := session.AuditOrphans(&model.OrphanRequest{Action: model.OrphanPrune})
+			return err
+		},
+	} {
+		if err := op(); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+
+	entries, err := s.FetchAudit(&model.AuditQuery{})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	ops := make([]string, 0, len(*entries))
+	for i := len(*entries) - 1; i >= 0; i-- {
+		if e := (*entries)[i]; e.Caller.Key == "admin-key" {
+			ops = append(ops, e.Op)
+		}
+	}
+	if strings.Join(ops, ",") != "slots,slots,zone,zone,key,key,prune" {
+		t.Fatalf("unexpected operations: %v", ops)
+	}
+	if e := (*entries)[len(*entries)-2]; e.Op != model.AuditSlots || len(e.Scenes) != 1 || e.Scenes[0] != scene.ID {
+		t.Fatalf("unexpected slots entry: %+v", e)
+	}
+	if e := (*entries)[0]; e.Op != model.AuditPrune || len(e.Scenes) != 1 || e.Scenes[0] != orphaned.ID {
+		t.Fatalf("unexpected prune entry: %+v", e)
+	}
+	revisions, _ := s.FetchRevisions(orphaned.ID)
+	if r := (*revisions)[len(*revisions)-1]; r.Action != model.RevisionPrune || r.Author != "admin-key" {
+		t.Fatalf("unexpected prune revision: %+v", r)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// the keys are managed by sessions, but are not methods of the service exported over RPC
+	for _, m := range []string{"FetchKeys", "CreateKey", "DeleteKey"} {
+		if _, ok := reflect.TypeOf(s).MethodByName(m); ok {
+			t.Fatalf("expected %s not to be exported over RPC", m)
+		}
+	}
+	session := NewSession(s, model.Caller{Transport: model.TransportREST, Key: "admin"})
+
+	grant, err := session.CreateKey(&model.KeyRequest{Name: "panel", Role: model.RoleOperator})
+	if err != nil || grant.Key == "" {
+		t.Fatalf("unexpected grant: %v, %v", grant, err)
+	}
+	if _, err := session.CreateKey(&model.KeyRequest{Name: "panel", Role: model.RoleViewer}); err == nil {
+		t.Fatalf("expected an error for a duplicate name")
+	}
+	if _, err := session.CreateKey(&model.KeyRequest{Name: "other", Role: "superuser"}); err == nil {
+		t.Fatalf("expected an error for an unknown role")
+	}
+
+	if s.Model.Keys[0].Hash == grant.Key || s.Model.Keys[0].Hash != model.HashKey(grant.Key) {
+		t.Fatalf("expected only the hash of the key to be stored")
+	}
+	if keys, _ := session.FetchKeys(); len(*keys) != 1 || (*keys)[0].Hash != "" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if key := Authenticate(s, grant.Key); key == nil || key.Name != "panel" || key.Role != model.RoleOperator {
+		t.Fatalf("unexpected authentication: %v", key)
+	}
+	if key := Authenticate(s, "guess"); key != nil {
+		t.Fatalf("expected an unknown key to be refused")
+	}
+
+	if _, err := session.DeleteKey("panel"); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if key := Authenticate(s, grant.Key); key != nil {
+		t.Fatalf("expected a deleted key to be refused")
+	}
+}
+
+func TestDestroyDuringRequests(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// requests made while the service is destroyed fail, rather than stopping the process
+	var wg sync.WaitGroup
+	failed := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := s.FetchScenes(&model.Query{}); err != nil {
+					failed <- err
+					return
+				}
+			}
+		}()
+	}
+	if err := s.Destroy(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	wg.Wait()
+	close(failed)
+	for err := range failed {
+		if !strings.Contains(err.Error(), "not initialized") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := s.FetchScenes(&model.Query{}); err == nil {
+		t.Fatalf("expected an error once the service is destroyed")
+	}
+}
+
+func TestDestroyDrainsQueue(t *testing.T) {
+	states := make(map[string]interface{})
+	for i := 0; i < 30; i++ {
+		states[fmt.Sprintf("channel-%d", i)] = true
+	}
+	err, s, tm := makeServiceWithThings(makeThing("lamp", "lounge", states))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	tm.Lock()
+	tm.delay = 2 * time.Millisecond
+	tm.Unlock()
+
+	scene, err := s.CaptureScene(&model.CaptureRequest{Slot: 5})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.ApplyScene(scene.Scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if err := s.Destroy(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	tm.Lock()
+	sets := len(tm.sets)
+	tm.Unlock()
+	if sets != 30 {
+		t.Fatalf("expected the queued sets to complete before Destroy returned, but only %d of 30 did", sets)
+	}
+
+	if err := s.enqueue(&task{topic: "x", method: "set"}); err == nil {
+		t.Fatalf("expected tasks to be refused once the service is destroyed")
+	}
+	if _, err := s.ApplyScene(scene.Scene.ID); err == nil || !strings.Contains(err.Error(), "not initialized") {
+		t.Fatalf("err was %v but expected an error once the service is destroyed", err)
+	}
+	if err := s.Destroy(); err == nil {
+		t.Fatalf("expected an error when destroying a destroyed service")
+	}
+
+	if err := s.Init(); err != nil {
+		t.Fatalf("err was %v but expected nil on restart", err)
+	}
+	if err := s.Init(); err == nil {
+		t.Fatalf("expected an error when initializing an initialized service")
+	}
+	tm.Lock()
+	tm.delay = 0
+	tm.Unlock()
+	tm.waitForSets(0)
+	if _, err := s.ApplyScene(scene.Scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil after restart", err)
+	}
+	if sets := tm.waitForSets(30); len(sets) != 30 {
+		t.Fatalf("expected 30 sets after restart, found %d", len(sets))
+	}
+	s.Destroy()
+}
+
+// failingClient fails every call of the specified method
+type failingClient struct {
+	mockClient
+	method string
+}
+
+func (c *failingClient) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	if method == c.method {
+		return fmt.Errorf("unreachable")
+	}
+	return c.mockClient.Call(method, args, reply, timeout)
+}
+
+func TestHealthAndStatus(t *testing.T) {
+	err, s, tm := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if health, _ := s.FetchHealth(); health.Status != model.ServiceOK {
+		t.Fatalf("health was %s but expected ok", health.Status)
+	}
+	if ready, _ := s.FetchReadiness(); ready.Status != model.ServiceOK {
+		t.Fatalf("readiness was %v but expected ok", ready.Checks)
+	}
+
+	captured, err := s.CaptureScene(&model.CaptureRequest{Scope: "room:lounge", Slot: 1})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	status, err := s.FetchStatus()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if status.Workers < 1 || status.QueueCapacity != status.Workers {
+		t.Fatalf("unexpected worker count %d and queue capacity %d", status.Workers, status.QueueCapacity)
+	}
+	if status.Generation == 0 {
+		t.Fatalf("expected the generation to advance when a scene was stored")
+	}
+	if status.Scenes["site:site-id"] != 1 || status.Scenes[captured.Scene.Scope] != 1 {
+		t.Fatalf("unexpected scene counts: %v", status.Scenes)
+	}
+
+	s.client = func(topic string) serviceClient {
+		return &failingClient{mockClient{topic: topic, tm: tm}, "set"}
+	}
+	if _, err := s.ApplyScene(captured.Scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	for i := 0; i < 100 && status.ApplyFailures == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, _ = s.FetchStatus()
+	}
+	if status.ApplyFailures != 1 || len(status.RecentFailures) != 1 || status.RecentFailures[0].Method != "set" {
+		t.Fatalf("unexpected apply failures: %d %v", status.ApplyFailures, status.RecentFailures)
+	}
+	s.client = func(topic string) serviceClient {
+		return &failingClient{mockClient{topic: topic, tm: tm}, "fetchAll"}
+	}
+	ready, _ := s.FetchReadiness()
+	if ready.Status != model.ServiceUnavailable || ready.Checks["thingModel"] == model.ServiceOK {
+		t.Fatalf("expected readiness to fail when the thing model is unreachable: %v", ready.Checks)
+	}
+
+	s.Destroy()
+	if ready, _ := s.FetchReadiness(); ready.Checks["initialized"] == model.ServiceOK {
+		t.Fatalf("expected readiness to fail once the service is destroyed")
+	}
+
+	// the readiness and status may be fetched while the service is initialized
+	s = &PresetsService{
+		Model: &model.Presets{Version: "1"},
+		Save:  func(m *model.Presets) {},
+		Conn:  &mockConnection{},
+		Log:   logger.GetLogger("mock"),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.FetchReadiness()
+			s.FetchStatus()
+		}
+	}()
+	if err := s.Init(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	<-done
+	if status, err := s.FetchStatus(); err != nil || status.Started.IsZero() {
+		t.Fatalf("unexpected status: %+v, %v", status, err)
+	}
+	s.Destroy()
+}
+
+func TestMetrics(t *testing.T) {
+	err, s, tm := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.Destroy()
+	s.Metrics = metrics.NewRegistry()
+	if err := s.Init(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	captured, err := s.CaptureScene(&model.CaptureRequest{Scope: "room:lounge", Slot: 1})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.ApplyScene(captured.Scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	tm.waitForSets(1)
+	if _, err := s.UndoScene(captured.Scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	tm.waitForSets(1)
+	s.Destroy() // wait for the workers to record their metrics
+
+	b := &bytes.Buffer{}
+	s.Metrics.Write(b)
+	for _, expected := range []string{
+		`presets_scene_operations_total{scope="room:lounge",operation="apply"} 1`,
+		`presets_scene_operations_total{scope="room:lounge",operation="undo"} 1`,
+		`presets_channel_set_duration_seconds_count{thing="lamp"} 2`,
+		`presets_queue_wait_seconds_count 2`,
+		`presets_thingmodel_call_duration_seconds_count{method="fetch"}`,
+		`presets_thingmodel_call_duration_seconds_count{method="fetchAll"}`,
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Fatalf("expected the metrics to contain '%s' but they were\n%s", expected, b.String())
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	a := &model.Scene{ID: "a", Scope: "site"}
+	b := &model.Scene{ID: "b", Scope: "site"}
+	for i := 0; i < 2; i++ {
+		if err := l.take(a); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+	if err, ok := l.take(a).(*RateLimitError); !ok || err.Scope != "" || err.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("expected the scene limit to be exceeded, but err was %v", err)
+	}
+	if err := l.take(b); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if err, ok := l.take(b).(*RateLimitError); !ok || err.Scope != "site" {
+		t.Fatalf("expected the scope limit to be exceeded, but err was %v", err)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if err := l.take(a); err != nil {
+		t.Fatalf("err was %v but expected nil once a token was refilled", err)
+	}
+
+	// the buckets that have refilled are evicted, so those of deleted scenes do not accumulate
+	if len(l.buckets) != 3 {
+		t.Fatalf("expected 3 buckets, found %d", len(l.buckets))
+	}
+	now = now.Add(sweepInterval)
+	c := &model.Scene{ID: "c", Scope: "room:kitchen"}
+	if err := l.take(c); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, ok := l.buckets["scene:a"]; ok || len(l.buckets) != 2 {
+		t.Fatalf("expected only the buckets of c to remain, found %d", len(l.buckets))
+	}
+}
+
+func TestSupersededTasks(t *testing.T) {
+	err, s := makeService()
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	first := &task{topic: "$thing/lamp/channel/on-off", method: "set", payload: true}
+	second := &task{topic: "$thing/lamp/channel/on-off", method: "set", payload: false}
+	other := &task{topic: "$thing/lamp/channel/brightness", method: "set", payload: 0.5}
+	s.supersede(first)
+	s.supersede(other)
+	s.supersede(second)
+	if s.release(first) {
+		t.Fatalf("expected the superseded task to be cancelled")
+	}
+	if !s.release(other) || !s.release(second) {
+		t.Fatalf("expected the latest tasks to be performed")
+	}
+	if len(s.pending) != 0 {
+		t.Fatalf("expected no pending tasks, but found %d", len(s.pending))
+	}
+}
+
+func TestReapplyKeepsUndoState(t *testing.T) {
+	err, s, tm := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.limiter = newRateLimiter(0, 0)
+	captured, err := s.CaptureScene(&model.CaptureRequest{Scope: "room:lounge", Slot: 1})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// set the lamp to the opposite state, so that applying the scene turns it on again
+	setState := func(state bool) {
+		tm.Lock()
+		(*tm.things[0].Device.Channels)[0].LastState = map[string]interface{}{"payload": state}
+		tm.Unlock()
+	}
+	undoState := func(scene *model.Scene) interface{} {
+		return scene.Things[0].Channels[0].UndoState
+	}
+
+	setState(false)
+	scene, err := s.ApplyScene(captured.Scene.ID)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if undoState(scene) != false {
+		t.Fatalf("undo state was %v but expected false", undoState(scene))
+	}
+
+	// the lamp is on by the time the scene is applied again, but the original undo state is kept
+	setState(true)
+	if scene, err = s.ApplyScene(captured.Scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if undoState(scene) != false {
+		t.Fatalf("undo state was %v but expected false to be kept", undoState(scene))
+	}
+
+	// once the coalescing window has passed, the undo state is recorded afresh
+	s.coalesce = 0
+	if scene, err = s.ApplyScene(captured.Scene.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if undoState(scene) != true {
+		t.Fatalf("undo state was %v but expected true", undoState(scene))
+	}
+}
+
+func TestConcurrentApplyAndStore(t *testing.T) {
+	err, s, _ := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.limiter = newRateLimiter(0, 0)
+	store := func(state bool) error {
+		_, err := s.StoreScene(&model.Scene{
+			ID:     "evening",
+			Slot:   1,
+			Scope:  "room:lounge",
+			Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: state}}}},
+		})
+		return err
+	}
+	if err := store(false); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// applies, undos, stores and fetches of the same scene may overlap
+	var wg sync.WaitGroup
+	for _, op := range []func(i int){
+		func(i int) { s.ApplyScene("evening") },
+		func(i int) { s.UndoScene("evening") },
+		func(i int) { store(i%2 == 0) },
+		func(i int) {
+			if scenes, err := s.FetchScenes(&model.Query{}); err == nil {
+				json.Marshal(scenes)
+			}
+		},
+	} {
+		wg.Add(1)
+		go func(op func(i int)) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				op(i)
+			}
+		}(op)
+	}
+	wg.Wait()
+
+	if scene := s.lookupScene("evening"); scene == nil || len(scene.Things) != 1 {
+		t.Fatalf("unexpected scene: %+v", scene)
+	}
+}
+
+func TestScopeLocks(t *testing.T) {
+	err, s, _ := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.limiter = newRateLimiter(0, 0)
+	events := make([]string, 0)
+	s.notify = func(event string, payload interface{}) {
+		if event == "lock" {
+			e := payload.(*model.LockEvent)
+			events = append(events, e.Outcome+":"+e.Scene)
+		}
+	}
+	for i, id := range []string{"party", "night"} {
+		if _, err := s.StoreScene(&model.Scene{
+			ID:     id,
+			Slot:   i + 1,
+			Scope:  "room:lounge",
+			Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: id == "party"}}}},
+		}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+
+	// a manual activation does not hold the scope unless a manual hold is configured
+	if result, err := s.ActivateScene(&model.ActivateRequest{ID: "party", Manual: true}); err != nil || result.Lock != nil {
+		t.Fatalf("unexpected result: %+v, %v", result, err)
+	}
+	if locks, _ := s.FetchLocks(); len(*locks) != 0 {
+		t.Fatalf("expected no locks without a manual hold, but found %d", len(*locks))
+	}
+	s.manualHold = 3600
+
+	// a manual activation holds the scope at the manual priority
+	result, err := s.ActivateScene(&model.ActivateRequest{ID: "party", Manual: true})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if result.Outcome != model.LockApplied || result.Lock == nil || result.Lock.Scene != "party" ||
+		result.Lock.Priority != 10 || result.Lock.Expires == nil {
+		t.Fatalf("unexpected result: %+v, %+v", result, result.Lock)
+	}
+
+	// so a scheduled activation is rejected with the reason, or deferred
+	if _, err := s.ApplyScene("night"); err == nil {
+		t.Fatalf("expected the activation of a lower priority scene to be rejected")
+	} else if locked, ok := err.(*ScopeLockedError); !ok || !strings.Contains(locked.Reason, "held by scene party") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result, err = s.ActivateScene(&model.ActivateRequest{ID: "night", Defer: true}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if result.Outcome != model.LockDeferred || result.Reason == "" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if night := s.lookupScene("night"); night.Report != nil {
+		t.Fatalf("expected the deferred scene not to be applied yet")
+	}
+
+	// the holder itself may be applied again
+	if _, err := s.ApplyScene("party"); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	locks, err := s.FetchLocks()
+	if err != nil || len(*locks) != 1 || (*locks)[0].Scope != "room:lounge" {
+		t.Fatalf("unexpected locks: %v, %v", locks, err)
+	}
+
+	// releasing the scope applies the deferred scene
+	if _, err := s.ReleaseScope(&model.LockRequest{Scope: "room:lounge"}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if night := s.lookupScene("night"); night.Report == nil {
+		t.Fatalf("expected the deferred scene to be applied once the scope was released")
+	}
+	if _, err := s.ReleaseScope(&model.LockRequest{Scope: "room:lounge"}); err == nil {
+		t.Fatalf("expected an error when releasing a scope that is not locked")
+	}
+
+	// a higher priority scene overrides a lock
+	lock, err := s.LockScope(&model.LockRequest{Scope: "room:lounge", ID: "party", Hold: -1})
+	if err != nil || lock.Expires != nil || lock.Priority != 0 {
+		t.Fatalf("unexpected lock: %+v, %v", lock, err)
+	}
+	high := 5
+	if _, err := s.PatchScene(&model.ScenePatch{ID: "night", Priority: &high}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.ApplyScene("night"); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// an expired lock no longer holds the scope
+	past := time.Now().Add(-time.Second)
+	s.Model.Locks["room:lounge"].Priority = 100
+	s.Model.Locks["room:lounge"].Expires = &past
+	if locks, _ := s.FetchLocks(); len(*locks) != 0 {
+		t.Fatalf("expected no locks once the lock expired, but found %d", len(*locks))
+	}
+
+	expected := "acquired:party,rejected:night,deferred:night,released:party,acquired:party"
+	if strings.Join(events, ",") != expected {
+		t.Fatalf("events were %v but expected %s", events, expected)
+	}
+
+	// an activation that fails to apply its scene restores the lock it replaced
+	if _, err := s.LockScope(&model.LockRequest{Scope: "room:lounge", ID: "party", Hold: -1}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	frozen := time.Now()
+	s.limiter = newRateLimiter(1, 0)
+	s.limiter.now = func() time.Time { return frozen }
+	if _, err := s.ApplyScene("night"); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	events = events[:0]
+	if _, err := s.ActivateScene(&model.ActivateRequest{ID: "night", Manual: true}); err == nil {
+		t.Fatalf("expected the activation to be rate limited")
+	}
+	if lock := s.Model.Locks["room:lounge"]; lock == nil || lock.Scene != "party" || lock.Expires != nil {
+		t.Fatalf("expected the lock of party to be restored, but found %+v", lock)
+	}
+	if strings.Join(events, ",") != "acquired:night,released:night" {
+		t.Fatalf("events were %v but expected the lock of night to be acquired and released", events)
+	}
+}
+
+func TestDeferredActivationAudited(t *testing.T) {
+	err, s, _ := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.limiter = newRateLimiter(0, 0)
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if s.Audit, err = audit.Open(dir, 1024*1024, 2); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	defer s.Audit.Close()
+	if _, err := s.StoreScene(&model.Scene{
+		ID:     "night",
+		Slot:   1,
+		Scope:  "room:lounge",
+		Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}}},
+	}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	high := 10
+	if _, err := s.LockScope(&model.LockRequest{Scope: "room:lounge", Priority: &high, Hold: -1}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// the deferred activation is applied, and recorded, on behalf of the caller that requested it
+	panel := NewSession(s, model.Caller{Transport: model.TransportREST, Key: "panel"})
+	if result, err := panel.ActivateScene(&model.ActivateRequest{ID: "night", Defer: true}); err != nil || result.Outcome != model.LockDeferred {
+		t.Fatalf("unexpected result: %+v, %v", result, err)
+	}
+	if _, err := s.ReleaseScope(&model.LockRequest{Scope: "room:lounge"}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	entries, err := s.FetchAudit(&model.AuditQuery{Op: model.AuditApply})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	applies := 0
+	for _, e := range *entries {
+		if e.Caller.Key != "panel" || e.Caller.Transport != model.TransportREST || e.Outcome != "ok" {
+			t.Fatalf("unexpected entry: %+v", e)
+		}
+		applies++
+	}
+	if applies != 2 {
+		t.Fatalf("recorded %d applies but expected the deferral and the deferred apply", applies)
+	}
+}
+
+// fakeClock is a Clock whose time only moves when it is advanced
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	when    time.Time
+	f       func()
+	stopped bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+// advance the clock, firing the timers that fall due in the order in which they fall due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	until := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.stopped && !t.when.After(until) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.stopped = true
+		if next.when.After(c.now) {
+			c.now = next.when
+		}
+		c.Unlock()
+		next.f()
+		c.Lock()
+	}
+	c.now = until
+	c.Unlock()
+}
+
+func TestSimulation(t *testing.T) {
+	sensor := makeThing("sensor", "lounge", map[string]interface{}{"motion": false})
+	err, s, tm := makeServiceWithThings(makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}), sensor)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	s.random = rand.New(rand.NewSource(1))
+	s.limiter = newRateLimiter(0, 0)
+	s.presenceInterval = time.Hour
+	events := make([]string, 0)
+	s.notify = func(event string, payload interface{}) {
+		if event == "simulation" {
+			events = append(events, fmt.Sprintf("%v", payload.(*model.Simulation).Enabled))
+		}
+	}
+	for i, id := range []string{"evening", "night"} {
+		if _, err := s.StoreScene(&model.Scene{
+			ID:     id,
+			Slot:   i + 1,
+			Scope:  "room:lounge",
+			Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: id == "evening"}}}},
+		}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+
+	if _, err := s.StartSimulation(&model.Simulation{
+		Scope:   "room:lounge",
+		Source:  model.SimulationPattern,
+		Pattern: []model.SimulationWindow{{Scene: "existing-uuid", From: "18:00", To: "19:00"}},
+	}); err == nil {
+		t.Fatalf("expected a scene of another scope to be rejected")
+	}
+
+	// each scene of the pattern is planned within its window
+	sim, err := s.StartSimulation(&model.Simulation{
+		Scope:  "room:lounge",
+		Source: model.SimulationPattern,
+		Pattern: []model.SimulationWindow{
+			{Scene: "night", From: "22:30", To: "23:00"},
+			{Scene: "evening", From: "18:00", To: "19:00"},
+		},
+		PresenceThing:   "sensor",
+		PresenceChannel: "motion",
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	day := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+	if len(sim.Planned) != 2 || sim.Planned[0].Scene != "evening" || sim.Planned[1].Scene != "night" ||
+		sim.Planned[0].Time.Before(day.Add(18*time.Hour)) || sim.Planned[0].Time.After(day.Add(19*time.Hour)) ||
+		sim.Planned[1].Time.Before(day.Add(22*time.Hour+30*time.Minute)) || sim.Planned[1].Time.After(day.Add(23*time.Hour)) {
+		t.Fatalf("unexpected plan: %+v", sim.Planned)
+	}
+
+	// the scene is applied when its time comes
+	clock.Advance(11 * time.Hour)
+	if evening := s.lookupScene("evening"); evening.Report == nil {
+		t.Fatalf("expected the evening scene to be applied")
+	}
+	if tm.waitForSets(1) == nil {
+		t.Fatalf("expected the lamp to be set")
+	}
+	started := sim
+	if sim, err = s.FetchSimulation("room:lounge"); err != nil || len(sim.Planned) != 1 {
+		t.Fatalf("unexpected plan: %+v, %v", sim, err)
+	}
+	if len(started.Planned) != 2 {
+		t.Fatalf("expected the answered simulation to be a snapshot: %+v", started.Planned)
+	}
+
+	// the simulation stops when presence is detected, before the next scene is applied
+	tm.Lock()
+	(*sensor.Device.Channels)[0].LastState = map[string]interface{}{"payload": true}
+	tm.Unlock()
+	clock.Advance(2 * time.Hour)
+	if sim, _ = s.FetchSimulation("room:lounge"); sim.Enabled || sim.Stopped == nil || !strings.Contains(sim.StopReason, "presence detected") || len(sim.Planned) != 0 {
+		t.Fatalf("unexpected simulation: %+v", sim)
+	}
+	clock.Advance(2 * time.Hour)
+	if night := s.lookupScene("night"); night.Report != nil {
+		t.Fatalf("expected the night scene not to be applied")
+	}
+	if _, err := s.StopSimulation("room:lounge"); err == nil {
+		t.Fatalf("expected an error when no simulation is running")
+	}
+
+	// a simulation learns from the applies recorded in the audit log, other than its own
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if s.Audit, err = audit.Open(dir, 1024*1024, 2); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	defer s.Audit.Close()
+	for _, e := range []*model.AuditEntry{
+		{Time: day.Add(7*time.Hour + 15*time.Minute), Op: model.AuditApply, Caller: model.Caller{Transport: model.TransportREST}, Scenes: []string{"evening"}, Outcome: "ok"},
+		{Time: day.Add(9 * time.Hour), Op: model.AuditApply, Caller: model.Caller{Transport: model.TransportREST}, Scenes: []string{"night"}, Outcome: "error"},
+		{Time: day.Add(10 * time.Hour), Op: model.AuditApply, Caller: model.Caller{Transport: model.TransportREST}, Scenes: []string{"existing-uuid"}, Outcome: "ok"},
+	} {
+		if err := s.Audit.Append(e); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+	clock.Lock()
+	clock.now = day.AddDate(0, 0, 1).Add(6 * time.Hour)
+	clock.Unlock()
+	sim, err = s.StartSimulation(&model.Simulation{Scope: "room:lounge", Source: model.SimulationHistory})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if sim.HistoryDays != 14 || len(sim.Planned) != 1 || sim.Planned[0].Scene != "evening" ||
+		!sim.Planned[0].Time.Equal(day.AddDate(0, 0, 1).Add(7*time.Hour+15*time.Minute)) {
+		t.Fatalf("unexpected simulation: %+v", sim)
+	}
+
+	simulations, err := s.FetchSimulations()
+	if err != nil || len(*simulations) != 1 || (*simulations)[0].Source != model.SimulationHistory || (*simulations)[0] == sim {
+		t.Fatalf("unexpected simulations: %v, %v", simulations, err)
+	}
+	if sim, err = s.StopSimulation("room:lounge"); err != nil || sim.Enabled || sim.StopReason != "stopped on request" {
+		t.Fatalf("unexpected simulation: %+v, %v", sim, err)
+	}
+	clock.Advance(2 * time.Hour)
+	if len(s.simulations) != 0 {
+		t.Fatalf("expected the timers of the simulation to be stopped")
+	}
+	if strings.Join(events, ",") != "true,false,true,false" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+}
+
+// wait until the run satisfies the condition
+func waitForRun(s *PresetsService, id string, cond func(*model.SequenceRun) bool) *model.SequenceRun {
+	for i := 0; i < 100; i++ {
+		if run, err := s.FetchRun(id); err == nil && cond(run) {
+			return run
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func waiting(run *model.SequenceRun) bool {
+	return run.Due != nil
+}
+
+func TestSequences(t *testing.T) {
+	err, s, tm := makeServiceWithThings(
+		makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}),
+		makeThing("kitchen", "kitchen", map[string]interface{}{"on-off": true}),
+		makeThing("hall", "hall", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 1, 5, 22, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	s.limiter = newRateLimiter(0, 0)
+	var eventsLock sync.Mutex
+	events := make([]string, 0)
+	s.notify = func(event string, payload interface{}) {
+		if event == "sequence" {
+			run := payload.(*model.SequenceRun)
+			eventsLock.Lock()
+			events = append(events, fmt.Sprintf("%s:%d", run.Status, run.Step))
+			eventsLock.Unlock()
+		}
+	}
+	if _, err := s.StoreScene(&model.Scene{
+		ID:     "dim",
+		Slot:   1,
+		Scope:  "room:lounge",
+		Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}}},
+	}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	if _, err := s.StoreSequence(&model.Sequence{Steps: []model.SequenceStep{{Action: model.StepApply, Scene: "missing"}}}); err == nil {
+		t.Fatalf("expected a step with a missing scene to be rejected")
+	}
+	if _, err := s.StoreSequence(&model.Sequence{Steps: []model.SequenceStep{{Action: model.StepWait}}}); err == nil {
+		t.Fatalf("expected a wait without seconds to be rejected")
+	}
+	sequence, err := s.StoreSequence(&model.Sequence{
+		ID:    "good-night",
+		Label: "Good night",
+		Steps: []model.SequenceStep{
+			{Action: model.StepApply, Scene: "dim"},
+			{Action: model.StepWait, Seconds: 120},
+			{Action: model.StepSet, Thing: "kitchen", Channel: "on-off", State: false},
+			{Action: model.StepWait, Seconds: 180},
+			{Action: model.StepSet, Thing: "hall", Channel: "on-off", State: false},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// the steps before the first wait are performed at once
+	run, err := s.StartSequence(sequence.ID)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if run = waitForRun(s, run.ID, waiting); run == nil || run.Step != 1 || run.Steps != 5 {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	if sets := tm.waitForSets(1); sets["$thing/lamp/channel/on-off"] != false {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+
+	// the next steps are performed when the wait ends
+	clock.Advance(119 * time.Second)
+	if run, _ = s.FetchRun(run.ID); run.Step != 1 {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	clock.Advance(time.Second)
+	if run, _ = s.FetchRun(run.ID); run.Step != 3 || run.Due == nil || !run.Due.Equal(clock.Now().Add(180*time.Second)) {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	if sets := tm.waitForSets(1); sets["$thing/kitchen/channel/on-off"] != false {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+
+	// a paused run suspends its wait until it is resumed
+	clock.Advance(60 * time.Second)
+	if run, err = s.PauseRun(run.ID); err != nil || run.Status != model.RunPaused || run.Remaining != 120 || run.Due != nil {
+		t.Fatalf("unexpected run: %+v, %v", run, err)
+	}
+	clock.Advance(time.Hour)
+	if run, _ = s.FetchRun(run.ID); run.Status != model.RunPaused || run.Step != 3 {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	if _, err := s.PauseRun(run.ID); err == nil {
+		t.Fatalf("expected an error when pausing a paused run")
+	}
+	if run, err = s.ResumeRun(run.ID); err != nil || run.Status != model.RunRunning || run.Due == nil {
+		t.Fatalf("unexpected run: %+v, %v", run, err)
+	}
+	clock.Advance(120 * time.Second)
+	if run = waitForRun(s, run.ID, finished); run == nil || run.Status != model.RunCompleted || run.Finished == nil {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	if sets := tm.waitForSets(1); sets["$thing/hall/channel/on-off"] != false {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	eventsLock.Lock()
+	if strings.Join(events, ",") != "running:0,running:1,running:1,running:2,running:3,running:3,paused:3,running:3,running:4,running:5,completed:5" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	eventsLock.Unlock()
+
+	// a cancelled run performs no further steps
+	run, _ = s.StartSequence(sequence.ID)
+	waitForRun(s, run.ID, waiting)
+	tm.waitForSets(1)
+	if run, err = s.CancelRun(run.ID); err != nil || run.Status != model.RunCancelled {
+		t.Fatalf("unexpected run: %+v, %v", run, err)
+	}
+	if _, err := s.ResumeRun(run.ID); err == nil {
+		t.Fatalf("expected an error when resuming a cancelled run")
+	}
+	clock.Advance(time.Hour)
+	tm.Lock()
+	if len(tm.sets) != 0 {
+		t.Fatalf("unexpected sets: %v", tm.sets)
+	}
+	tm.Unlock()
+
+	// a restart resumes or aborts the runs according to the policy of their sequence
+	sequence.Restart = model.RestartResume
+	if _, err := s.StoreSequence(sequence); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	resumed, _ := s.StartSequence(sequence.ID)
+	waitForRun(s, resumed.ID, waiting)
+	if _, err := s.StoreSequence(&model.Sequence{
+		ID:    "abort",
+		Steps: []model.SequenceStep{{Action: model.StepWait, Seconds: 60}},
+	}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	aborted, _ := s.StartSequence("abort")
+	waitForRun(s, aborted.ID, waiting)
+	tm.waitForSets(1)
+	if err := s.Destroy(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	clock.Advance(30 * time.Second)
+	if err := s.Init(); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.limiter = newRateLimiter(0, 0)
+	if aborted, _ = s.FetchRun(aborted.ID); aborted.Status != model.RunAborted {
+		t.Fatalf("unexpected run: %+v", aborted)
+	}
+	if resumed, _ = s.FetchRun(resumed.ID); resumed.Status != model.RunRunning || resumed.Step != 1 ||
+		!resumed.Due.Equal(clock.Now().Add(90*time.Second)) {
+		t.Fatalf("unexpected run: %+v", resumed)
+	}
+	clock.Advance(90 * time.Second)
+	if resumed, _ = s.FetchRun(resumed.ID); resumed.Step != 3 {
+		t.Fatalf("unexpected run: %+v", resumed)
+	}
+
+	// deleting a sequence cancels its runs
+	if _, err := s.DeleteSequence(sequence.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if resumed, _ = s.FetchRun(resumed.ID); resumed.Status != model.RunCancelled {
+		t.Fatalf("unexpected run: %+v", resumed)
+	}
+	if runs, err := s.FetchRuns(); err != nil || len(*runs) != 4 {
+		t.Fatalf("unexpected runs: %v, %v", runs, err)
+	}
+}
+
+func TestSequenceNotRateLimited(t *testing.T) {
+	err, s, tm := makeServiceWithThings(
+		makeThing("lamp", "lounge", map[string]interface{}{"on-off": true}),
+		makeThing("kitchen", "kitchen", map[string]interface{}{"on-off": true}),
+		makeThing("hall", "hall", map[string]interface{}{"on-off": true}))
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	s.limiter = newRateLimiter(2, 5)
+	if _, err := s.StoreScene(&model.Scene{
+		ID:     "dim",
+		Slot:   1,
+		Scope:  "room:lounge",
+		Things: []model.ThingState{{ID: "lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}}},
+	}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	sequence, err := s.StoreSequence(&model.Sequence{
+		ID: "busy",
+		Steps: []model.SequenceStep{
+			{Action: model.StepSet, Thing: "lamp", Channel: "on-off", State: false},
+			{Action: model.StepSet, Thing: "kitchen", Channel: "on-off", State: false},
+			{Action: model.StepSet, Thing: "hall", Channel: "on-off", State: false},
+			{Action: model.StepApply, Scene: "dim"},
+			{Action: model.StepUndo, Scene: "dim"},
+			{Action: model.StepApply, Scene: "dim"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// the steps of a sequence are not subject to the rate limiter
+	run, err := s.StartSequence(sequence.ID)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if run = waitForRun(s, run.ID, finished); run == nil || run.Status != model.RunCompleted {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	tm.waitForSets(3)
+
+	// but other callers still are
+	for i := 0; i < 2; i++ {
+		if _, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "on-off", State: true}}}); err != nil {
+			t.Fatalf("err was %v but expected nil", err)
+		}
+	}
+	if _, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "on-off", State: true}}}); err == nil {
+		t.Fatalf("expected the third set to be rate limited")
+	} else if _, ok := err.(*RateLimitError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSetChannels(t *testing.T) {
+	lamp := makeThing("lamp", "lounge", map[string]interface{}{"on-off": true, "brightness": 0.5})
+	err, s, tm := makeServiceWithThings(lamp)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "on-off"}}}); err == nil {
+		t.Fatalf("expected a channel without a state to be rejected")
+	}
+
+	// the channels are set and their previous states recorded, a later state replacing an earlier one
+	result, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{
+		{Thing: "lamp", Channel: "on-off", State: false},
+		{Thing: "lamp", Channel: "brightness", State: 0.1},
+		{Thing: "missing", Channel: "on-off", State: false},
+		{Thing: "lamp", Channel: "brightness", State: 0.2},
+	}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	sets := tm.waitForSets(2)
+	if sets["$thing/lamp/channel/on-off"] != false || sets["$thing/lamp/channel/brightness"] != 0.2 {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	if len(result.Things) != 2 || len(result.Things[0].Channels) != 2 ||
+		result.Things[0].Channels[0].UndoState != true || result.Things[0].Channels[1].UndoState != 0.5 {
+		t.Fatalf("unexpected result: %+v", result.Things)
+	}
+	if len(result.Report.Skipped) != 1 || result.Report.Skipped[0].Thing != "missing" {
+		t.Fatalf("unexpected report: %+v", result.Report)
+	}
+
+	// undo restores the channels that have not been modified since
+	tm.Lock()
+	for _, c := range *lamp.Device.Channels {
+		state := map[string]interface{}{"on-off": false, "brightness": 0.9}[c.ID]
+		c.LastState = map[string]interface{}{"payload": state}
+	}
+	tm.Unlock()
+	if _, err := s.UndoChannels("missing"); err == nil {
+		t.Fatalf("expected an error when undoing an unknown set")
+	}
+	undone, err := s.UndoChannels(result.ID)
+	if err != nil || undone.Undone == nil {
+		t.Fatalf("unexpected result: %+v, %v", undone, err)
+	}
+	sets = tm.waitForSets(1)
+	if len(sets) != 1 || sets["$thing/lamp/channel/on-off"] != true {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+	if all, err := s.FetchChannelSets(); err != nil || len(*all) != 1 || (*all)[0].ID != result.ID {
+		t.Fatalf("unexpected sets: %v, %v", all, err)
+	}
+
+	// a set can only be undone once
+	if _, err := s.UndoChannels(result.ID); err == nil {
+		t.Fatalf("expected an error when undoing a set twice")
+	} else if e, ok := err.(*SetUndoneError); !ok || !e.Undone.Equal(*undone.Undone) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tm.Lock()
+	if len(tm.sets) != 0 {
+		t.Fatalf("expected a set that was undone not to be undone again: %v", tm.sets)
+	}
+	tm.Unlock()
+
+	// a channel set again moments later keeps the undo state of the first set
+	s.limiter = newRateLimiter(0, 0)
+	first, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "brightness", State: 0.3}}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	tm.waitForSets(1)
+	tm.Lock()
+	for _, c := range *lamp.Device.Channels {
+		if c.ID == "brightness" {
+			c.LastState = map[string]interface{}{"payload": 0.3}
+		}
+	}
+	tm.Unlock()
+	second, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "brightness", State: 0.4}}})
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	tm.waitForSets(1)
+	if first.Things[0].Channels[0].UndoState != 0.9 || second.Things[0].Channels[0].UndoState != 0.9 {
+		t.Fatalf("unexpected undo states: %+v, %+v", first.Things, second.Things)
+	}
+
+	// a set is refused if a scope that contains the channels is locked with a higher priority
+	priority := 5
+	if _, err := s.LockScope(&model.LockRequest{Scope: "room:lounge", Priority: &priority, Hold: -1}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "on-off", State: true}}}); err == nil {
+		t.Fatalf("expected a set in a locked scope to be refused")
+	} else if _, ok := err.(*ScopeLockedError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.ReleaseScope(&model.LockRequest{Scope: "room:lounge"}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+
+	// sets are rate limited
+	s.limiter = newRateLimiter(1, 0)
+	if _, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "on-off", State: true}}}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	tm.waitForSets(1)
+	if _, err := s.SetChannels(&model.SetRequest{Channels: []model.ChannelSet{{Thing: "lamp", Channel: "on-off", State: false}}}); err == nil {
+		t.Fatalf("expected a set to be rate limited")
+	} else if _, ok := err.(*RateLimitError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	lounge := makeThing("lounge-lamp", "lounge", map[string]interface{}{"on-off": true, "brightness": 0.5})
+	kitchen := makeThing("kitchen-lamp", "kitchen", map[string]interface{}{"on-off": true})
+	fan := makeThing("fan", "lounge", map[string]interface{}{"on-off": true})
+	for _, thing := range []*nmodel.Thing{lounge, kitchen, fan} {
+		thing.Type = "light"
+		for _, c := range *thing.Device.Channels {
+			c.Schema = "http://schema.ninjablocks.com/protocol/" + c.ID
+		}
+	}
+	fan.Type = "fan"
+	err, s, tm := makeServiceWithThings(lounge, kitchen, fan)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if _, err := s.PreviewGroup(&model.GroupRequest{Selector: model.Selector{Scope: "room:lounge"}, State: false}); err == nil {
+		t.Fatalf("expected a selector that selects every channel to be rejected")
+	}
+	if _, err := s.ApplyGroup(&model.GroupRequest{Selector: model.Selector{Scope: "room:lounge", Type: "light"}, State: false}); err == nil {
+		t.Fatalf("expected a selector without a schema to be rejected")
+	}
+	tm.Lock()
+	if len(tm.sets) != 0 {
+		t.Fatalf("expected a rejected selector not to set any channels: %v", tm.sets)
+	}
+	tm.Unlock()
+
+	// the selector is resolved against the thing model
+	request := &model.GroupRequest{Selector: model.Selector{Scope: "room:lounge", Type: "light", Schema: "on-off"}, State: false}
+	preview, err := s.PreviewGroup(request)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if len(preview.Things) != 1 || preview.Things[0].ID != "lounge-lamp" || len(preview.Things[0].Channels) != 1 ||
+		preview.Things[0].Channels[0].State != false || preview.Things[0].Channels[0].UndoState != true {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+	tm.Lock()
+	if len(tm.sets) != 0 {
+		t.Fatalf("expected a preview not to set any channels: %v", tm.sets)
+	}
+	tm.Unlock()
+
+	result, err := s.ApplyGroup(request)
+	if err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if sets := tm.waitForSets(1); len(sets) != 1 || sets["$thing/lounge-lamp/channel/on-off"] != false {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+
+	// the group apply is undone like a set
+	tm.Lock()
+	for _, c := range *lounge.Device.Channels {
+		if c.ID == "on-off" {
+			c.LastState = map[string]interface{}{"payload": false}
+		}
+	}
+	tm.Unlock()
+	if _, err := s.UndoChannels(result.ID); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	if sets := tm.waitForSets(1); sets["$thing/lounge-lamp/channel/on-off"] != true {
+		t.Fatalf("unexpected sets: %v", sets)
+	}
+
+	// the scope defaults to the site
+	preview, err = s.PreviewGroup(&model.GroupRequest{Selector: model.Selector{Type: "light", Schema: "on-off"}, State: false})
+	if err != nil || preview.Scope != "site:site-id" || len(preview.Things) != 2 {
+		t.Fatalf("unexpected preview: %+v, %v", preview, err)
+	}
+	if _, err := s.ApplyGroup(&model.GroupRequest{Selector: model.Selector{Type: "heater", Schema: "on-off"}, State: false}); err == nil {
+		t.Fatalf("expected an error when no channels match the selector")
+	}
+
+	// tags select the channels of the scenes that have every tag
+	if _, err := s.StoreScene(&model.Scene{
+		Slot:   1,
+		Scope:  "room:kitchen",
+		Tags:   []string{"night", "lights"},
+		Things: []model.ThingState{{ID: "kitchen-lamp", Channels: []model.ChannelState{{ID: "on-off", State: false}}}},
+	}); err != nil {
+		t.Fatalf("err was %v but expected nil", err)
+	}
+	preview, err = s.PreviewGroup(&model.GroupRequest{Selector: model.Selector{Schema: "on-off", Tags: []string{"night"}}, State: false})
+	if err != nil || preview.Scope != "site:site-id" || len(preview.Things) != 1 || preview.Things[0].ID != "kitchen-lamp" {
+		t.Fatalf("unexpected preview: %+v, %v", preview, err)
+	}
+	if _, err := s.ApplyGroup(&model.GroupRequest{Selector: model.Selector{Schema: "on-off", Tags: []string{"night", "away"}}, State: false}); err == nil {
+		t.Fatalf("expected an error when no scene has every tag")
+	}
+}
@@ -0,0 +1,335 @@
+package service
+
+import (
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+)
+
+// A Session performs operations on behalf of a caller and records each operation that changes or
+// applies scenes in the audit log of the service, if any. RPC requests are performed by a session
+// for an RPC caller; the REST server creates a session for each request.
+type Session struct {
+	*PresetsService
+	caller model.Caller
+}
+
+// NewSession answers a session that performs operations of the service on behalf of the caller.
+func NewSession(ps *PresetsService, caller model.Caller) *Session {
+	return &Session{PresetsService: ps, caller: caller}
+}
+
+func (ps *PresetsService) rpcSession() *Session {
+	return NewSession(ps, model.Caller{Transport: model.TransportRPC})
+}
+
+// record an operation in the audit log
+func (s *Session) record(op string, params interface{}, scenes []string, err error) {
+	if s.Audit == nil {
+		return
+	}
+	entry := &model.AuditEntry{
+		Time:    time.Now(),
+		Op:      op,
+		Caller:  s.caller,
+		Scenes:  scenes,
+		Params:  params,
+		Outcome: "ok",
+	}
+	if entry.Scenes == nil {
+		entry.Scenes = make([]string, 0)
+	}
+	if err != nil {
+		entry.Outcome = "error"
+		entry.Error = err.Error()
+	}
+	if err := s.Audit.Append(entry); err != nil {
+		s.Log.Warningf("failed to record %s in the audit log: %v", op, err)
+	}
+}
+
+// answer true if the operations of the caller are subject to the rate limiter. The steps of
+// sequences and simulations are paced by their own schedules, so they are not limited.
+func rateLimited(caller model.Caller) bool {
+	return caller.Transport != model.TransportSequence && caller.Transport != model.TransportSimulation
+}
+
+// answer the id of the scene, if any, as a list
+func sceneIDs(scene *model.Scene) []string {
+	if scene == nil {
+		return nil
+	}
+	return []string{scene.ID}
+}
+
+func (s *Session) StoreScene(m *model.Scene) (*model.Scene, error) {
+	if m.ModifiedBy == "" {
+		m.ModifiedBy = s.caller.Key
+	}
+	scene, err := s.store(m)
+	s.record(model.AuditStore, m, sceneIDs(scene), err)
+	return scene, err
+}
+
+func (s *Session) PatchScene(p *model.ScenePatch) (*model.Scene, error) {
+	if p.ModifiedBy == "" {
+		p.ModifiedBy = s.caller.Key
+	}
+	scene, err := s.patchScene(p)
+	s.record(model.AuditPatch, p, []string{p.ID}, err)
+	return scene, err
+}
+
+func (s *Session) DeleteScenes(q *model.Query) (*[]*model.Scene, error) {
+	deleted, err := s.deleteScenes(q)
+	ids := make([]string, 0)
+	if deleted != nil {
+		for _, scene := range *deleted {
+			ids = append(ids, scene.ID)
+		}
+	}
+	s.record(model.AuditDelete, q, ids, err)
+	return deleted, err
+}
+
+func (s *Session) ApplyScene(id string) (*model.Scene, error) {
+	scene, err := s.applyScene(id, s.caller)
+	s.record(model.AuditApply, id, []string{id}, err)
+	return scene, err
+}
+
+func (s *Session) UndoScene(id string) (*model.Scene, error) {
+	scene, err := s.undoScene(id, rateLimited(s.caller))
+	s.record(model.AuditUndo, id, []string{id}, err)
+	return scene, err
+}
+
+func (s *Session) ApplySlot(r *model.SlotRequest) (*model.Scene, error) {
+	scene, err := s.applySlot(r, s.caller)
+	s.record(model.AuditApply, r, sceneIDs(scene), err)
+	return scene, err
+}
+
+func (s *Session) UndoSlot(r *model.SlotRequest) (*model.Scene, error) {
+	scene, err := s.undoSlot(r, s.caller)
+	s.record(model.AuditUndo, r, sceneIDs(scene), err)
+	return scene, err
+}
+
+func (s *Session) CaptureScene(r *model.CaptureRequest) (*model.CaptureResult, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	result, err := s.captureScene(r)
+	var ids []string
+	if result != nil {
+		ids = sceneIDs(result.Scene)
+	}
+	s.record(model.AuditCapture, r, ids, err)
+	return result, err
+}
+
+func (s *Session) RefreshScene(r *model.RefreshRequest) (*model.RefreshResult, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	result, err := s.refreshScene(r)
+	s.record(model.AuditRefresh, r, []string{r.ID}, err)
+	return result, err
+}
+
+func (s *Session) RollbackScene(r *model.RevisionRequest) (*model.Scene, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	scene, err := s.rollbackScene(r)
+	s.record(model.AuditRollback, r, []string{r.ID}, err)
+	return scene, err
+}
+
+func (s *Session) ActivateScene(r *model.ActivateRequest) (*model.ActivateResult, error) {
+	if r.Holder == "" {
+		r.Holder = s.caller.Key
+	}
+	result, err := s.activateScene(r, s.caller)
+	var ids []string
+	if result != nil {
+		ids = sceneIDs(result.Scene)
+	}
+	s.record(model.AuditApply, r, ids, err)
+	return result, err
+}
+
+func (s *Session) LockScope(r *model.LockRequest) (*model.ScopeLock, error) {
+	if r.Holder == "" {
+		r.Holder = s.caller.Key
+	}
+	lock, err := s.lockScope(r)
+	var ids []string
+	if r.ID != "" {
+		ids = []string{r.ID}
+	}
+	s.record(model.AuditLock, r, ids, err)
+	return lock, err
+}
+
+func (s *Session) ReleaseScope(r *model.LockRequest) (*model.ScopeLock, error) {
+	lock, err := s.releaseScope(r)
+	var ids []string
+	if lock != nil && lock.Scene != "" {
+		ids = []string{lock.Scene}
+	}
+	s.record(model.AuditRelease, r, ids, err)
+	return lock, err
+}
+
+func (s *Session) MoveScene(r *model.SlotRequest) (*[]*model.Scene, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	scenes, moved, err := s.moveScene(r)
+	s.record(model.AuditSlots, r, moved, err)
+	return scenes, err
+}
+
+func (s *Session) SwapSlots(r *model.SlotRequest) (*[]*model.Scene, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	scenes, moved, err := s.swapSlots(r)
+	s.record(model.AuditSlots, r, moved, err)
+	return scenes, err
+}
+
+func (s *Session) InsertScene(r *model.SlotRequest) (*[]*model.Scene, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	scenes, moved, err := s.insertScene(r)
+	s.record(model.AuditSlots, r, moved, err)
+	return scenes, err
+}
+
+func (s *Session) CompactSlots(r *model.SlotRequest) (*[]*model.Scene, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	scenes, moved, err := s.compactSlots(r)
+	s.record(model.AuditSlots, r, moved, err)
+	return scenes, err
+}
+
+func (s *Session) SetSlotLimit(l *model.SlotLimit) (*model.SlotLimit, error) {
+	limit, err := s.setSlotLimit(l)
+	s.record(model.AuditSlots, l, nil, err)
+	return limit, err
+}
+
+func (s *Session) StoreZone(z *model.Zone) (*model.Zone, error) {
+	zone, err := s.storeZone(z)
+	s.record(model.AuditZone, z, nil, err)
+	return zone, err
+}
+
+func (s *Session) DeleteZone(id string) (*model.Zone, error) {
+	zone, err := s.deleteZone(id)
+	s.record(model.AuditZone, id, nil, err)
+	return zone, err
+}
+
+// only audits that prune orphans are recorded, since the others do not change scenes
+func (s *Session) AuditOrphans(r *model.OrphanRequest) (*[]*model.Scene, error) {
+	if r.Author == "" {
+		r.Author = s.caller.Key
+	}
+	scenes, pruned, err := s.checkOrphans(r)
+	if r.Action == model.OrphanPrune {
+		s.record(model.AuditPrune, r, pruned, err)
+	}
+	return scenes, err
+}
+
+func (s *Session) StartSimulation(m *model.Simulation) (*model.Simulation, error) {
+	sim, err := s.startSimulation(m)
+	s.record(model.AuditSimulate, m, nil, err)
+	return sim, err
+}
+
+func (s *Session) StopSimulation(scope string) (*model.Simulation, error) {
+	sim, err := s.stopSimulation(scope)
+	s.record(model.AuditSimulate, scope, nil, err)
+	return sim, err
+}
+
+func (s *Session) StoreSequence(m *model.Sequence) (*model.Sequence, error) {
+	sequence, err := s.storeSequence(m)
+	s.record(model.AuditSequence, m, nil, err)
+	return sequence, err
+}
+
+func (s *Session) DeleteSequence(id string) (*model.Sequence, error) {
+	sequence, err := s.deleteSequence(id)
+	s.record(model.AuditSequence, id, nil, err)
+	return sequence, err
+}
+
+func (s *Session) StartSequence(id string) (*model.SequenceRun, error) {
+	run, err := s.startSequence(id, s.caller.Key)
+	s.record(model.AuditSequence, id, nil, err)
+	return run, err
+}
+
+func (s *Session) CancelRun(id string) (*model.SequenceRun, error) {
+	run, err := s.cancelRun(id)
+	s.record(model.AuditSequence, id, nil, err)
+	return run, err
+}
+
+func (s *Session) PauseRun(id string) (*model.SequenceRun, error) {
+	run, err := s.pauseRun(id)
+	s.record(model.AuditSequence, id, nil, err)
+	return run, err
+}
+
+func (s *Session) ResumeRun(id string) (*model.SequenceRun, error) {
+	run, err := s.resumeRun(id)
+	s.record(model.AuditSequence, id, nil, err)
+	return run, err
+}
+
+func (s *Session) SetChannels(r *model.SetRequest) (*model.SetResult, error) {
+	result, err := s.setChannels(r, s.caller.Key, rateLimited(s.caller))
+	s.record(model.AuditSet, r, nil, err)
+	return result, err
+}
+
+func (s *Session) UndoChannels(id string) (*model.SetResult, error) {
+	result, err := s.undoChannels(id)
+	s.record(model.AuditUndo, id, nil, err)
+	return result, err
+}
+
+func (s *Session) ApplyGroup(r *model.GroupRequest) (*model.SetResult, error) {
+	result, err := s.applyGroup(r, s.caller.Key)
+	s.record(model.AuditSet, r, nil, err)
+	return result, err
+}
+
+// API keys are managed only by sessions, which are not exported over RPC, so that only an admin
+// of the REST API can manage them.
+
+func (s *Session) FetchKeys() (*[]*model.APIKey, error) {
+	return s.fetchKeys()
+}
+
+func (s *Session) CreateKey(r *model.KeyRequest) (*model.KeyGrant, error) {
+	grant, err := s.createKey(r)
+	s.record(model.AuditKey, r, nil, err)
+	return grant, err
+}
+
+func (s *Session) DeleteKey(name string) (*model.APIKey, error) {
+	key, err := s.deleteKey(name)
+	s.record(model.AuditKey, name, nil, err)
+	return key, err
+}
@@ -0,0 +1,480 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+	nmodel "github.com/ninjasphere/go-ninja/model"
+)
+
+const defaultHistoryDays = 14
+
+// simulationTimers holds the timers of a running simulation
+type simulationTimers struct {
+	day      time.Time // the start of the day whose applies are planned
+	apply    Timer     // fires when the next apply is due, or when the next day is to be planned
+	presence Timer     // fires when presence is next to be checked
+}
+
+func (t *simulationTimers) stop() {
+	if t.apply != nil {
+		t.apply.Stop()
+	}
+	if t.presence != nil {
+		t.presence.Stop()
+	}
+}
+
+// answer a copy of the simulation, which its timers continue to change. The caller must hold the
+// mutex.
+func snapshotSimulation(sim *model.Simulation) *model.Simulation {
+	result := *sim
+	if sim.Planned != nil {
+		result.Planned = append([]model.SimulatedApply{}, sim.Planned...)
+	}
+	return &result
+}
+
+// answer the start of the day of the specified time
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// parse a time of day of the form "hh:mm" and answer the time since the start of the day
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil || n != 2 ||
+		hours < 0 || hours > 23 || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("illegal argument: '%s' is not a time of day of the form hh:mm", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// validate the simulation and fill in its defaults. The caller must hold the mutex.
+func (ps *PresetsService) validateSimulation(sim *model.Simulation) error {
+	switch sim.Source {
+	case model.SimulationHistory:
+		if ps.Audit == nil {
+			return fmt.Errorf("illegal state: the audit log is not enabled, so there is no history to learn from")
+		}
+		if sim.HistoryDays == 0 {
+			sim.HistoryDays = defaultHistoryDays
+		}
+	case model.SimulationPattern:
+		if len(sim.Pattern) == 0 {
+			return fmt.Errorf("illegal argument: the pattern is empty")
+		}
+		for _, w := range sim.Pattern {
+			if scene := ps.lookupScene(w.Scene); scene == nil || scene.Scope != sim.Scope {
+				return fmt.Errorf("illegal argument: no scene %s in scope %s", w.Scene, sim.Scope)
+			}
+			for _, t := range []string{w.From, w.To} {
+				if _, err := parseTimeOfDay(t); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("illegal argument: source must be '%s' or '%s': '%s'", model.SimulationHistory, model.SimulationPattern, sim.Source)
+	}
+	if sim.HistoryDays < 0 || sim.Jitter < 0 {
+		return fmt.Errorf("illegal argument: historyDays and jitter must not be negative")
+	}
+	if (sim.PresenceThing == "") != (sim.PresenceChannel == "") {
+		return fmt.Errorf("illegal argument: presenceThing and presenceChannel must be specified together")
+	}
+	return nil
+}
+
+// answer a random offset of up to the jitter of the simulation either way. The caller must hold the mutex.
+func (ps *PresetsService) jitter(sim *model.Simulation) time.Duration {
+	if sim.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(ps.random.Intn(2*sim.Jitter+1)-sim.Jitter) * time.Minute
+}
+
+// answer the applies of the simulation planned for the specified day that are due after now,
+// ordered by time. A simulation of history is planned from the audit entries read by
+// historyEntries. The caller must hold the mutex.
+func (ps *PresetsService) planSimulation(sim *model.Simulation, day time.Time, now time.Time, entries []*model.AuditEntry) []model.SimulatedApply {
+	planned := make([]model.SimulatedApply, 0)
+	switch sim.Source {
+	case model.SimulationPattern:
+		for _, w := range sim.Pattern {
+			from, _ := parseTimeOfDay(w.From)
+			to, _ := parseTimeOfDay(w.To)
+			if to < from {
+				to += 24 * time.Hour
+			}
+			offset := from + time.Duration(ps.random.Int63n(int64((to-from)/time.Minute)+1))*time.Minute
+			planned = append(planned, model.SimulatedApply{Time: day.Add(offset + ps.jitter(sim)), Scene: w.Scene})
+		}
+	case model.SimulationHistory:
+		history := ps.simulationHistory(sim, entries, now)
+		days := make([]time.Time, 0, len(history))
+		for d := range history {
+			days = append(days, d)
+		}
+		if len(days) == 0 {
+			break
+		}
+		sort.Sort(timesByOrder(days))
+		chosen := days[ps.random.Intn(len(days))]
+		for _, a := range history[chosen] {
+			offset := a.Time.Sub(chosen)
+			planned = append(planned, model.SimulatedApply{Time: day.Add(offset + ps.jitter(sim)), Scene: a.Scene})
+		}
+	}
+
+	result := make([]model.SimulatedApply, 0, len(planned))
+	for _, a := range planned {
+		if a.Time.After(now) {
+			result = append(result, a)
+		}
+	}
+	sort.Sort(appliesByTime(result))
+	return result
+}
+
+// answer the applies recorded in the audit log in the days of history of the simulation before
+// now, or nil if the simulation does not learn from history. Reading the audit log may be slow,
+// so the caller must not hold the mutex.
+func (ps *PresetsService) historyEntries(sim *model.Simulation, now time.Time) []*model.AuditEntry {
+	if sim.Source != model.SimulationHistory || ps.Audit == nil {
+		return nil
+	}
+	days := sim.HistoryDays
+	if days == 0 {
+		days = defaultHistoryDays
+	}
+	since := now.AddDate(0, 0, -days)
+	entries, err := ps.Audit.Query(&model.AuditQuery{Since: &since, Until: &now, Op: model.AuditApply})
+	if err != nil {
+		ps.Log.Warningf("failed to query the audit log for the history of scope %s: %v", sim.Scope, err)
+		return nil
+	}
+	return entries
+}
+
+// answer the applies of the entries to scenes of the scope of the simulation, other than those
+// of simulations, keyed by the start of their day. The caller must hold the mutex.
+func (ps *PresetsService) simulationHistory(sim *model.Simulation, entries []*model.AuditEntry, now time.Time) map[time.Time][]model.SimulatedApply {
+	result := make(map[time.Time][]model.SimulatedApply)
+	for _, e := range entries {
+		if e.Outcome != "ok" || e.Caller.Transport == model.TransportSimulation {
+			continue
+		}
+		for _, id := range e.Scenes {
+			if scene := ps.lookupScene(id); scene != nil && scene.Scope == sim.Scope {
+				at := e.Time.In(now.Location())
+				day := startOfDay(at)
+				result[day] = append(result[day], model.SimulatedApply{Time: at, Scene: id})
+			}
+		}
+	}
+	return result
+}
+
+type timesByOrder []time.Time
+
+func (t timesByOrder) Len() int           { return len(t) }
+func (t timesByOrder) Less(i, j int) bool { return t[i].Before(t[j]) }
+func (t timesByOrder) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+type appliesByTime []model.SimulatedApply
+
+func (a appliesByTime) Len() int           { return len(a) }
+func (a appliesByTime) Less(i, j int) bool { return a[i].Time.Before(a[j].Time) }
+func (a appliesByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// start the timer that performs the next planned apply of the simulation or, if no applies remain
+// for the current day, that plans the next day. The caller must hold the mutex.
+func (ps *PresetsService) armSimulation(sim *model.Simulation, now time.Time) {
+	timers := ps.simulations[sim.Scope]
+	if timers.apply != nil {
+		timers.apply.Stop()
+	}
+	if len(sim.Planned) == 0 {
+		next := timers.day.AddDate(0, 0, 1)
+		timers.apply = ps.clock().AfterFunc(next.Sub(now), func() {
+			ps.planNextDay(sim, next)
+		})
+	} else {
+		timers.apply = ps.clock().AfterFunc(sim.Planned[0].Time.Sub(now), func() {
+			ps.performSimulation(sim)
+		})
+	}
+}
+
+// answer true if the simulation is still running. The caller must hold the mutex.
+func (ps *PresetsService) simulating(sim *model.Simulation) bool {
+	return ps.isInitialized() && sim.Enabled && ps.Model.Simulations[sim.Scope] == sim
+}
+
+func (ps *PresetsService) planNextDay(sim *model.Simulation, day time.Time) {
+	entries := ps.historyEntries(sim, ps.clock().Now())
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if !ps.simulating(sim) {
+		return
+	}
+	now := ps.clock().Now()
+	ps.simulations[sim.Scope].day = day
+	sim.Planned = ps.planSimulation(sim, day, now, entries)
+	ps.armSimulation(sim, now)
+	ps.save()
+}
+
+// perform the next planned apply of the simulation, unless presence is detected
+func (ps *PresetsService) performSimulation(sim *model.Simulation) {
+	ps.mutex.Lock()
+	if !ps.simulating(sim) || len(sim.Planned) == 0 {
+		ps.mutex.Unlock()
+		return
+	}
+	next := sim.Planned[0]
+	sim.Planned = sim.Planned[1:]
+	ps.mutex.Unlock()
+
+	if ps.detectPresence(sim) {
+		return
+	}
+	session := NewSession(ps, model.Caller{Transport: model.TransportSimulation})
+	if _, err := session.ApplyScene(next.Scene); err != nil {
+		ps.Log.Warningf("simulation of scope %s failed to apply scene %s: %v", sim.Scope, next.Scene, err)
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.simulating(sim) {
+		ps.armSimulation(sim, ps.clock().Now())
+		ps.save()
+	}
+}
+
+// start the timer that next checks for presence, if the simulation has a presence channel. The
+// caller must hold the mutex.
+func (ps *PresetsService) armPresence(sim *model.Simulation) {
+	if sim.PresenceThing == "" {
+		return
+	}
+	ps.simulations[sim.Scope].presence = ps.clock().AfterFunc(ps.presenceInterval, func() {
+		if !ps.detectPresence(sim) {
+			ps.mutex.Lock()
+			defer ps.mutex.Unlock()
+			if ps.simulating(sim) {
+				ps.armPresence(sim)
+			}
+		}
+	})
+}
+
+// answer true, and stop the simulation, if its presence channel is in the presence state
+func (ps *PresetsService) detectPresence(sim *model.Simulation) bool {
+	if sim.PresenceThing == "" {
+		return false
+	}
+	thing := &nmodel.Thing{}
+	if err := ps.thingModel().Call("fetch", []string{sim.PresenceThing}, &thing, defaultTimeout); err != nil {
+		ps.Log.Warningf("simulation of scope %s failed to check for presence: %v", sim.Scope, err)
+		return false
+	}
+	if thing.Device == nil || thing.Device.Channels == nil {
+		return false
+	}
+	expected := sim.PresenceState
+	if expected == nil {
+		expected = true
+	}
+	for _, c := range *thing.Device.Channels {
+		if c.ID == sim.PresenceChannel && model.SameState(copyState(c), expected) {
+			ps.mutex.Lock()
+			defer ps.mutex.Unlock()
+			if ps.simulating(sim) {
+				ps.endSimulation(sim, fmt.Sprintf("presence detected by channel %s of thing %s", sim.PresenceChannel, sim.PresenceThing))
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// stop the simulation for the specified reason. The caller must hold the mutex.
+func (ps *PresetsService) endSimulation(sim *model.Simulation, reason string) {
+	if timers, ok := ps.simulations[sim.Scope]; ok {
+		timers.stop()
+		delete(ps.simulations, sim.Scope)
+	}
+	now := ps.clock().Now()
+	sim.Enabled = false
+	sim.Stopped = &now
+	sim.StopReason = reason
+	sim.Planned = nil
+	ps.save()
+	ps.sendEvent("simulation", snapshotSimulation(sim))
+	ps.Log.Infof("simulation of scope %s stopped: %s", sim.Scope, reason)
+}
+
+// run the simulation, planning the rest of the current day from the entries unless applies are
+// already planned. The caller must hold the mutex.
+func (ps *PresetsService) runSimulation(sim *model.Simulation, now time.Time, entries []*model.AuditEntry) {
+	if timers, ok := ps.simulations[sim.Scope]; ok {
+		timers.stop()
+	}
+	ps.simulations[sim.Scope] = &simulationTimers{day: startOfDay(now)}
+	if len(sim.Planned) == 0 {
+		sim.Planned = ps.planSimulation(sim, startOfDay(now), now, entries)
+	}
+	ps.armSimulation(sim, now)
+	ps.armPresence(sim)
+}
+
+// see: http://schema.ninjablocks.com/service/presets#startSimulation
+func (ps *PresetsService) StartSimulation(sim *model.Simulation) (*model.Simulation, error) {
+	return ps.rpcSession().StartSimulation(sim)
+}
+
+func (ps *PresetsService) startSimulation(sim *model.Simulation) (*model.Simulation, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	now := ps.clock().Now()
+	entries := ps.historyEntries(sim, now)
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scope, err := ps.slotScope(&model.SlotRequest{Scope: sim.Scope})
+	if err != nil {
+		return nil, err
+	}
+	sim.Scope = scope
+	if err := ps.validateSimulation(sim); err != nil {
+		return nil, err
+	}
+
+	sim.Enabled = true
+	sim.Started = now
+	sim.Stopped = nil
+	sim.StopReason = ""
+	sim.Planned = nil
+	if ps.Model.Simulations == nil {
+		ps.Model.Simulations = make(map[string]*model.Simulation)
+	}
+	ps.Model.Simulations[scope] = sim
+	ps.runSimulation(sim, now, entries)
+	ps.save()
+	ps.sendEvent("simulation", snapshotSimulation(sim))
+	return snapshotSimulation(sim), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#stopSimulation
+func (ps *PresetsService) StopSimulation(scope string) (*model.Simulation, error) {
+	return ps.rpcSession().StopSimulation(scope)
+}
+
+func (ps *PresetsService) stopSimulation(scope string) (*model.Simulation, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	normalized, err := ps.slotScope(&model.SlotRequest{Scope: scope})
+	if err != nil {
+		return nil, err
+	}
+	sim, ok := ps.Model.Simulations[normalized]
+	if !ok || !sim.Enabled {
+		return nil, fmt.Errorf("no simulation is running in scope %s", normalized)
+	}
+	ps.endSimulation(sim, "stopped on request")
+	return snapshotSimulation(sim), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchSimulations
+func (ps *PresetsService) FetchSimulations() (*[]*model.Simulation, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scopes := make([]string, 0, len(ps.Model.Simulations))
+	for scope := range ps.Model.Simulations {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	result := make([]*model.Simulation, len(scopes))
+	for i, scope := range scopes {
+		result[i] = snapshotSimulation(ps.Model.Simulations[scope])
+	}
+	return &result, nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchSimulation
+func (ps *PresetsService) FetchSimulation(scope string) (*model.Simulation, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	normalized, err := ps.slotScope(&model.SlotRequest{Scope: scope})
+	if err != nil {
+		return nil, err
+	}
+	sim, ok := ps.Model.Simulations[normalized]
+	if !ok {
+		return nil, fmt.Errorf("no simulation has been started in scope %s", normalized)
+	}
+	return snapshotSimulation(sim), nil
+}
+
+// answer the audit entries from which each enabled simulation may be planned, keyed by scope.
+// The audit log is read without the mutex, which is taken only to find the simulations.
+func (ps *PresetsService) restoreEntries(now time.Time) map[string][]*model.AuditEntry {
+	ps.mutex.Lock()
+	sims := make([]*model.Simulation, 0, len(ps.Model.Simulations))
+	for _, sim := range ps.Model.Simulations {
+		if sim.Enabled {
+			sims = append(sims, sim)
+		}
+	}
+	ps.mutex.Unlock()
+
+	result := make(map[string][]*model.AuditEntry)
+	for _, sim := range sims {
+		result[sim.Scope] = ps.historyEntries(sim, now)
+	}
+	return result
+}
+
+// resume the enabled simulations, keeping the applies that were planned before the service was
+// stopped and are still due, or planning the rest of the day from the entries read by
+// restoreEntries if none are. The caller must hold the mutex.
+func (ps *PresetsService) restoreSimulations(now time.Time, entries map[string][]*model.AuditEntry) {
+	for _, sim := range ps.Model.Simulations {
+		if !sim.Enabled {
+			continue
+		}
+		due := make([]model.SimulatedApply, 0, len(sim.Planned))
+		for _, a := range sim.Planned {
+			if a.Time.After(now) {
+				due = append(due, a)
+			}
+		}
+		sim.Planned = due
+		ps.runSimulation(sim, now, entries[sim.Scope])
+	}
+}
+
+// stop the timers of the simulations. The caller must hold the mutex.
+func (ps *PresetsService) stopSimulations() {
+	for scope, timers := range ps.simulations {
+		timers.stop()
+		delete(ps.simulations, scope)
+	}
+}
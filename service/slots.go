@@ -0,0 +1,214 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// normalize the scope of a slot request. An empty scope is the site scope.
+func (ps *PresetsService) slotScope(r *model.SlotRequest) (string, error) {
+	if r.Scope == "" {
+		r.Scope = "site"
+	}
+	scope, _, _, err := ps.parseScope(&r.Scope)
+	return scope, err
+}
+
+// answer the indicies of the scenes in the specified scope, ordered by slot
+func (ps *PresetsService) scopeScenes(scope string) []int {
+	found := ps.match(&model.Query{Scope: &scope})
+	sort.Stable(&sceneSorter{
+		selection: found,
+		less: func(i, j int) bool {
+			return ps.Model.Scenes[found[i]].Slot < ps.Model.Scenes[found[j]].Slot
+		},
+	})
+	return found
+}
+
+// answer the index of the scene in the specified slot of the scope, or -1 if the slot is empty
+func (ps *PresetsService) sceneAt(scope string, slot int) int {
+	for i, m := range ps.Model.Scenes {
+		if m.Scope == scope && m.Slot == slot {
+			return i
+		}
+	}
+	return -1
+}
+
+// answer the index of the specified scene, which must be in the specified scope
+func (ps *PresetsService) sceneIn(scope string, id string) (int, error) {
+	for i, m := range ps.Model.Scenes {
+		if m.ID == id {
+			if m.Scope != scope {
+				return -1, fmt.Errorf("illegal argument: scene '%s' is not in scope %s", id, scope)
+			}
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("failed to find a matching scene: %s", id)
+}
+
+// An EmptySlotError is answered when an operation refers to a slot in which no scene is stored.
+type EmptySlotError struct {
+	Scope string
+	Slot  int
+}
+
+func (e *EmptySlotError) Error() string {
+	return fmt.Sprintf("nothing is stored in slot %d of scope %s", e.Slot, e.Scope)
+}
+
+// A SlotConflictError is answered when a new scene would replace another scene in an occupied slot.
+type SlotConflictError struct {
+	Scope string
+	Slot  int
+	ID    string // the id of the scene in the slot
+}
+
+func (e *SlotConflictError) Error() string {
+	return fmt.Sprintf("slot %d of scope %s is occupied by scene '%s'", e.Slot, e.Scope, e.ID)
+}
+
+// answer the first slot of the scope in which no scene is stored. ps.mutex must be held.
+func (ps *PresetsService) freeSlot(scope string) (int, error) {
+	slot := 1
+	for ps.sceneAt(scope, slot) >= 0 {
+		slot++
+	}
+	if err := ps.checkSlot(scope, slot); err != nil {
+		return 0, fmt.Errorf("no free slot in scope %s: %v", scope, err)
+	}
+	return slot, nil
+}
+
+// answer the id of the scene stored in the slot of the scope specified by the request
+func (ps *PresetsService) sceneInSlot(r *model.SlotRequest) (string, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	scope, err := ps.slotScope(r)
+	if err != nil {
+		return "", err
+	}
+	if err := ps.checkSlot(scope, r.Slot); err != nil {
+		return "", err
+	}
+	if x := ps.sceneAt(scope, r.Slot); x >= 0 {
+		return ps.Model.Scenes[x].ID, nil
+	}
+	return "", &EmptySlotError{Scope: scope, Slot: r.Slot}
+}
+
+// answer the scene to be updated by a capture request: the scene with the requested id or,
+// if no id is requested, the scene in the requested slot of the scope, if any
+func (ps *PresetsService) sceneToUpdate(r *model.CaptureRequest, scope string) *model.Scene {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if r.ID != "" {
+		return ps.lookupScene(r.ID)
+	}
+	if x := ps.sceneAt(scope, r.Slot); x >= 0 {
+		return ps.Model.Scenes[x]
+	}
+	return nil
+}
+
+// choose the slot of a newly captured scene: the requested slot, unless it is occupied, or the
+// first free slot of the scope if no slot is requested
+func (ps *PresetsService) captureSlot(scene *model.Scene) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if scene.Slot <= 0 {
+		slot, err := ps.freeSlot(scene.Scope)
+		if err != nil {
+			return err
+		}
+		scene.Slot = slot
+	} else if x := ps.sceneAt(scene.Scope, scene.Slot); x >= 0 {
+		return &SlotConflictError{Scope: scene.Scope, Slot: scene.Slot, ID: ps.Model.Scenes[x].ID}
+	}
+	return nil
+}
+
+// answer the maximum slot of the specified scope, or 0 if the scope has no limit
+func (ps *PresetsService) slotLimit(scope string) int {
+	if max, ok := ps.Model.SlotLimits[scope]; ok {
+		return max
+	}
+	return config.Int(0, "app-presets.service.slots.max")
+}
+
+// answer an error if the slot is not a valid slot of the specified scope
+func (ps *PresetsService) checkSlot(scope string, slot int) error {
+	if slot < 1 {
+		return fmt.Errorf("illegal argument: slot must be at least 1: %d", slot)
+	}
+	if max := ps.slotLimit(scope); max > 0 && slot > max {
+		return fmt.Errorf("illegal argument: slot %d exceeds the limit of %d slots of scope %s", slot, max, scope)
+	}
+	return nil
+}
+
+// apply a plan, which maps the indicies of scenes in the scope to their new slots. The plan is
+// checked before any changes are made, so either every scene is moved or none are. Each moved scene
+// is replaced by a copy in its new slot, and a revision of it is recorded with the operation as its
+// action and the specified author, if known. If any slot changes, the model is saved and a "slots"
+// event is sent. Answers the scenes of the scope, ordered by slot, and the ids of the moved scenes.
+func (ps *PresetsService) applySlotPlan(scope string, op string, plan map[int]int, author string) (*[]*model.Scene, []string, error) {
+	occupied := make(map[int]string)
+	for _, x := range ps.scopeScenes(scope) {
+		m := ps.Model.Scenes[x]
+		slot := m.Slot
+		if to, ok := plan[x]; ok {
+			slot = to
+			if err := ps.checkSlot(scope, slot); err != nil {
+				return nil, nil, err
+			}
+		}
+		if other, ok := occupied[slot]; ok {
+			return nil, nil, fmt.Errorf("illegal state: scenes '%s' and '%s' would share slot %d", other, m.ID, slot)
+		}
+		occupied[slot] = m.ID
+	}
+
+	indicies := make([]int, 0, len(plan))
+	for x := range plan {
+		indicies = append(indicies, x)
+	}
+	sort.Ints(indicies)
+
+	now := time.Now()
+	event := &model.SlotEvent{
+		Scope:   scope,
+		Op:      op,
+		Changes: make([]model.SlotChange, 0, len(plan)),
+	}
+	moved := make([]string, 0, len(plan))
+	for _, x := range indicies {
+		m := ps.Model.Scenes[x]
+		if m.Slot != plan[x] {
+			event.Changes = append(event.Changes, model.SlotChange{ID: m.ID, From: m.Slot, To: plan[x]})
+			moved = append(moved, m.ID)
+			copied := *m
+			copied.Slot = plan[x]
+			copied.Modified = now
+			copied.ModifiedBy = author
+			ps.Model.Scenes[x] = &copied
+			ps.recordRevision(&copied, op, 0)
+		}
+	}
+
+	if len(event.Changes) > 0 {
+		ps.save()
+		ps.sendEvent("slots", event)
+	}
+	result := ps.copyScenes(ps.scopeScenes(scope))
+	return &result, moved, nil
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ninjasphere/app-presets/model"
+	nmodel "github.com/ninjasphere/go-ninja/model"
+)
+
+const (
+	readyTimeout = 5 * time.Second // the time a readiness check waits for the thing model
+	maxFailures  = 20              // the number of recent apply failures that are retained
+)
+
+// save the model and advance its generation
+func (ps *PresetsService) save() {
+	atomic.AddUint64(&ps.generation, 1)
+	ps.Save(ps.Model)
+}
+
+// record a task that failed, discarding the oldest failure once maxFailures are retained
+func (ps *PresetsService) recordFailure(t *task, err error) {
+	ps.diagnostics.Lock()
+	defer ps.diagnostics.Unlock()
+	ps.failed++
+	ps.failures = append(ps.failures, model.ApplyFailure{
+		Time:   time.Now(),
+		Topic:  t.topic,
+		Method: t.method,
+		Error:  err.Error(),
+	})
+	if len(ps.failures) > maxFailures {
+		ps.failures = ps.failures[len(ps.failures)-maxFailures:]
+	}
+}
+
+// answer a report with the specified checks, which is ok only if every check is ok
+func healthReport(checks map[string]string) *model.HealthReport {
+	status := model.ServiceOK
+	for _, outcome := range checks {
+		if outcome != model.ServiceOK {
+			status = model.ServiceUnavailable
+		}
+	}
+	return &model.HealthReport{Status: status, Checks: checks}
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchHealth
+func (ps *PresetsService) FetchHealth() (*model.HealthReport, error) {
+	// the service is live if it can answer at all
+	return healthReport(nil), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchReadiness
+func (ps *PresetsService) FetchReadiness() (*model.HealthReport, error) {
+	checks := map[string]string{
+		"initialized": model.ServiceOK,
+		"exported":    model.ServiceOK,
+		"thingModel":  model.ServiceOK,
+	}
+	ps.lifecycle.RLock()
+	initialized, stopping, announced := ps.initialized, ps.stopping, ps.announced
+	ps.lifecycle.RUnlock()
+	if !initialized {
+		checks["initialized"] = "the service is not initialized"
+	} else if stopping {
+		checks["initialized"] = "the service is stopping"
+	}
+	if !announced {
+		checks["exported"] = "the service has not been exported"
+	}
+	if ps.Conn == nil && ps.client == nil {
+		checks["thingModel"] = "the service has no connection"
+	} else {
+		things := make([]*nmodel.Thing, 0)
+		if err := ps.thingModel().Call("fetchAll", nil, &things, readyTimeout); err != nil {
+			checks["thingModel"] = fmt.Sprintf("failed to fetch things: %v", err)
+		}
+	}
+	return healthReport(checks), nil
+}
+
+// see: http://schema.ninjablocks.com/service/presets#fetchStatus
+func (ps *PresetsService) FetchStatus() (*model.ServiceStatus, error) {
+	if err := ps.checkInit(); err != nil {
+		return nil, err
+	}
+	status := &model.ServiceStatus{
+		Scenes: make(map[string]int),
+	}
+
+	ps.lifecycle.RLock()
+	status.Started = ps.started
+	status.UptimeSeconds = int64(time.Since(ps.started) / time.Second)
+	status.Stopping = ps.stopping
+	status.Workers = ps.numWorkers
+	status.QueueDepth = len(ps.queue)
+	status.QueueCapacity = cap(ps.queue)
+	ps.lifecycle.RUnlock()
+
+	ps.mutex.Lock()
+	status.Generation = atomic.LoadUint64(&ps.generation)
+	for _, s := range ps.Model.Scenes {
+		status.Scenes[s.Scope]++
+	}
+	ps.mutex.Unlock()
+
+	ps.diagnostics.Lock()
+	status.ApplyFailures = ps.failed
+	status.RecentFailures = make([]model.ApplyFailure, len(ps.failures))
+	for i, f := range ps.failures {
+		status.RecentFailures[len(ps.failures)-1-i] = f
+	}
+	ps.diagnostics.Unlock()
+
+	return status, nil
+}